@@ -0,0 +1,641 @@
+package coreblocksync
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	corecodec "github.com/jneubaum/honestvote.io/core/core-codec"
+	coreconsensus "github.com/jneubaum/honestvote.io/core/core-consensus"
+	corecrypto "github.com/jneubaum/honestvote.io/core/core-crypto"
+	coredatabase "github.com/jneubaum/honestvote.io/core/core-database/src"
+	corenetwork "github.com/jneubaum/honestvote.io/core/core-network"
+)
+
+// These bound what a single request asks for
+const (
+	MaxHeaders     = 2000
+	MaxBlocks      = 64
+	MaxBlocksBytes = 3 << 20
+)
+
+// These bound a single sync pass. A node further behind than
+// MaxSyncHeaders just runs more passes.
+const (
+	SyncPeers      = 8
+	MaxSyncHeaders = 20000
+	MaxBuffered    = 1024
+)
+
+// RequestTimeout is how long a peer gets to answer a request
+const RequestTimeout = 30 * time.Second
+
+var (
+	// ErrBadHeaders is returned when a peer's headers do not form a valid chain
+	ErrBadHeaders = errors.New("coreblocksync: headers do not form a valid chain")
+	// ErrBadBody is returned when a downloaded block does not match its header
+	ErrBadBody = errors.New("coreblocksync: block does not match its header")
+	// ErrNoPeers is returned when no peer is left to download the blocks from
+	ErrNoPeers = errors.New("coreblocksync: no peer has the blocks")
+	// ErrTimeout is returned when a peer does not answer in time
+	ErrTimeout = errors.New("coreblocksync: request timed out")
+	// errUnrelated is returned for a peer whose chain split from ours too long ago to follow
+	errUnrelated = errors.New("coreblocksync: peer is on an unrelated chain")
+)
+
+// GetHeadersMessage asks for up to Limit headers starting at height From
+type GetHeadersMessage struct {
+	Request string `json:"request"`
+	From    uint64 `json:"from"`
+	Limit   int    `json:"limit"`
+}
+
+// HeadersMessage answers GetHeaders. Height is the sender's chain height.
+type HeadersMessage struct {
+	Request string                     `json:"request"`
+	Height  uint64                     `json:"height"`
+	Headers []coredatabase.BlockHeader `json:"headers"`
+}
+
+// GetBlocksMessage asks for the blocks with the given hashes
+type GetBlocksMessage struct {
+	Request string   `json:"request"`
+	Hashes  []string `json:"hashes"`
+}
+
+// BlocksMessage answers GetBlocks with the requested blocks the sender has,
+// in order, stopping at the first one it does not
+type BlocksMessage struct {
+	Request string                `json:"request"`
+	Blocks  []*coredatabase.Block `json:"blocks"`
+}
+
+// Progress is how far a sync has got
+type Progress struct {
+	Syncing      bool
+	StartHeight  uint64
+	Height       uint64
+	HeaderHeight uint64
+	TargetHeight uint64
+	Peers        int
+}
+
+type pending struct {
+	peer      *corenetwork.Peer
+	responses chan corecodec.Frame
+}
+
+// Downloader brings a node that is behind up to date, headers first. It
+// asks several peers for their headers, checks each chain of headers and
+// picks the best by the fork choice rule, then downloads the block bodies
+// in parallel from the peers whose chain has them and hands them to the
+// consensus engine in order.
+type Downloader struct {
+	manager *corenetwork.PeerManager
+	chain   *coredatabase.Chain
+	engine  coreconsensus.Engine
+
+	mu       sync.Mutex
+	requests map[string]*pending
+	heights  map[string]uint64 // latest height each peer reported, by node ID
+	running  bool
+	progress Progress
+}
+
+// NewDownloader returns a downloader that adds blocks to chain through
+// engine and penalizes peers that send bad data through manager
+func NewDownloader(manager *corenetwork.PeerManager, chain *coredatabase.Chain, engine coreconsensus.Engine) *Downloader {
+	return &Downloader{
+		manager:  manager,
+		chain:    chain,
+		engine:   engine,
+		requests: make(map[string]*pending),
+		heights:  make(map[string]uint64),
+	}
+}
+
+// Progress reports how far the current sync has got
+func (d *Downloader) Progress() Progress {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	progress := d.progress
+	progress.Height = d.chain.Height()
+	return progress
+}
+
+// Behind reports whether peer has said it has blocks we do not
+func (d *Downloader) Behind(peer *corenetwork.Peer) bool {
+	return d.height(peer) > d.chain.Height()
+}
+
+func (d *Downloader) height(peer *corenetwork.Peer) uint64 {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if height, ok := d.heights[peer.NodeID]; ok {
+		return height
+	}
+	return peer.Height
+}
+
+// Receive handles GetHeaders, Headers, GetBlocks and Blocks frames
+func (d *Downloader) Receive(peer *corenetwork.Peer, frame corecodec.Frame) error {
+	switch frame.Type {
+	case corecodec.GetHeaders:
+		var request GetHeadersMessage
+		if err := frame.Unmarshal(&request); err != nil {
+			return err
+		}
+		return d.serveHeaders(peer, request)
+	case corecodec.GetBlocks:
+		var request GetBlocksMessage
+		if err := frame.Unmarshal(&request); err != nil {
+			return err
+		}
+		return d.serveBlocks(peer, request)
+	case corecodec.Headers, corecodec.Blocks:
+		var response struct {
+			Request string `json:"request"`
+		}
+		if err := frame.Unmarshal(&response); err != nil {
+			return err
+		}
+
+		d.mu.Lock()
+		request, ok := d.requests[response.Request]
+		d.mu.Unlock()
+		if !ok || request.peer != peer {
+			return &corenetwork.Misbehavior{Penalty: corenetwork.PenaltyUnknownMessage, Reason: "response to unknown request"}
+		}
+
+		select {
+		case request.responses <- frame:
+		default:
+			return &corenetwork.Misbehavior{Penalty: corenetwork.PenaltySpam, Reason: "answered the same request twice"}
+		}
+	}
+	return nil
+}
+
+func (d *Downloader) serveHeaders(peer *corenetwork.Peer, request GetHeadersMessage) error {
+	if request.Limit <= 0 || request.Limit > MaxHeaders {
+		request.Limit = MaxHeaders
+	}
+
+	response := HeadersMessage{Request: request.Request, Height: d.chain.Height(), Headers: []coredatabase.BlockHeader{}}
+	for height := request.From; height <= response.Height && len(response.Headers) < request.Limit; height++ {
+		block, err := d.chain.BlockAt(height)
+		if err != nil {
+			break
+		}
+		response.Headers = append(response.Headers, block.Header)
+	}
+	return send(peer, corecodec.Headers, response)
+}
+
+func (d *Downloader) serveBlocks(peer *corenetwork.Peer, request GetBlocksMessage) error {
+	if len(request.Hashes) > MaxBlocks {
+		request.Hashes = request.Hashes[:MaxBlocks]
+	}
+
+	response := BlocksMessage{Request: request.Request, Blocks: []*coredatabase.Block{}}
+	size := 0
+	for _, hash := range request.Hashes {
+		block, err := d.chain.Block(hash)
+		if err != nil {
+			break
+		}
+		//Always send at least one block so the requester makes progress
+		data, _ := json.Marshal(block)
+		if size += len(data); size > MaxBlocksBytes && len(response.Blocks) > 0 {
+			break
+		}
+		response.Blocks = append(response.Blocks, block)
+	}
+	return send(peer, corecodec.Blocks, response)
+}
+
+func send(peer *corenetwork.Peer, t corecodec.MessageType, v interface{}) error {
+	frame, err := corecodec.NewFrame(t, v)
+	if err != nil {
+		return err
+	}
+	//A peer we cannot write to is dropped by its read loop soon enough
+	peer.Send(frame)
+	return nil
+}
+
+// request sends a request to peer and waits for the answer. set puts the
+// request ID into the message before it is sent.
+func (d *Downloader) request(ctx context.Context, peer *corenetwork.Peer, t corecodec.MessageType, message interface{}, set func(id string)) (corecodec.Frame, error) {
+	nonce, err := corecrypto.NewNonce()
+	if err != nil {
+		return corecodec.Frame{}, err
+	}
+	id := hex.EncodeToString(nonce[:8])
+	set(id)
+	request := &pending{peer: peer, responses: make(chan corecodec.Frame, 1)}
+
+	d.mu.Lock()
+	d.requests[id] = request
+	d.mu.Unlock()
+	defer func() {
+		d.mu.Lock()
+		delete(d.requests, id)
+		d.mu.Unlock()
+	}()
+
+	frame, err := corecodec.NewFrame(t, message)
+	if err != nil {
+		return corecodec.Frame{}, err
+	}
+	if err := peer.Send(frame); err != nil {
+		return corecodec.Frame{}, err
+	}
+
+	select {
+	case frame := <-request.responses:
+		return frame, nil
+	case <-time.After(RequestTimeout):
+		return corecodec.Frame{}, ErrTimeout
+	case <-ctx.Done():
+		return corecodec.Frame{}, ctx.Err()
+	}
+}
+
+// Sync downloads blocks until no peer knows of a better chain than ours or
+// ctx is cancelled. Only one sync runs at a time, calling Sync while one is
+// running returns straight away.
+func (d *Downloader) Sync(ctx context.Context) error {
+	d.mu.Lock()
+	if d.running {
+		d.mu.Unlock()
+		return nil
+	}
+	d.running = true
+	d.progress = Progress{Syncing: true, StartHeight: d.chain.Height()}
+	d.mu.Unlock()
+
+	defer func() {
+		d.mu.Lock()
+		d.running = false
+		d.progress.Syncing = false
+		d.mu.Unlock()
+	}()
+
+	for {
+		before := d.chain.Height()
+		headers, sources, err := d.headers(ctx)
+		if err != nil {
+			return err
+		}
+		if len(headers) == 0 {
+			return nil
+		}
+		log.Printf("Syncing blocks %d to %d from %d peers", headers[0].Height, headers[len(headers)-1].Height, len(sources))
+		if err := d.bodies(ctx, headers, sources); err != nil {
+			return err
+		}
+		//Stop once a pass gets us nowhere, for example because the best
+		//chain a peer offered is one the engine keeps on a side branch
+		if d.chain.Height() <= before {
+			return nil
+		}
+	}
+}
+
+// headers asks the peers that are ahead of us for their headers and returns
+// the best chain of them along with the peers that have each block
+func (d *Downloader) headers(ctx context.Context) ([]coredatabase.BlockHeader, map[*corenetwork.Peer]map[string]bool, error) {
+	//Start a little below the head so a peer on a recent fork links up
+	height := d.chain.Height()
+	from := uint64(0)
+	if height > coreconsensus.MaxReorgDepth {
+		from = height - coreconsensus.MaxReorgDepth
+	}
+	base, err := d.chain.BlockAt(from)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var peers []*corenetwork.Peer
+	for _, peer := range d.manager.Peers() {
+		if d.Behind(peer) {
+			peers = append(peers, peer)
+		}
+	}
+	sort.Slice(peers, func(i, j int) bool { return d.height(peers[i]) > d.height(peers[j]) })
+	if len(peers) > SyncPeers {
+		peers = peers[:SyncPeers]
+	}
+
+	chains := make([][]coredatabase.BlockHeader, len(peers))
+	var wg sync.WaitGroup
+	for i, peer := range peers {
+		wg.Add(1)
+		go func(i int, peer *corenetwork.Peer) {
+			defer wg.Done()
+			headers, err := d.fetchHeaders(ctx, peer, base.Header)
+			if err == ErrBadHeaders {
+				d.manager.Penalize(peer, corenetwork.PenaltyInvalidSignature, err.Error())
+			}
+			if err == nil {
+				chains[i] = headers
+			}
+		}(i, peer)
+	}
+	wg.Wait()
+	if ctx.Err() != nil {
+		return nil, nil, ctx.Err()
+	}
+
+	//Pick the chain the fork choice rule likes best, and only if it beats ours
+	var best []coredatabase.BlockHeader
+	bestTip := d.chain.Head()
+	sources := make(map[*corenetwork.Peer]map[string]bool)
+	for i, headers := range chains {
+		if len(headers) == 0 {
+			continue
+		}
+		has := make(map[string]bool)
+		for _, header := range headers {
+			has[header.Hash()] = true
+		}
+		sources[peers[i]] = has
+
+		tip := &coredatabase.Block{Header: headers[len(headers)-1]}
+		if coreconsensus.Prefer(tip, bestTip) {
+			best, bestTip = headers, tip
+		}
+	}
+
+	d.mu.Lock()
+	d.progress.Peers = len(sources)
+	d.progress.HeaderHeight = bestTip.Height()
+	for peer := range sources {
+		if h := d.heights[peer.NodeID]; h > d.progress.TargetHeight {
+			d.progress.TargetHeight = h
+		}
+	}
+	d.mu.Unlock()
+
+	return best, sources, nil
+}
+
+// fetchHeaders downloads and checks peer's headers from the block after base
+func (d *Downloader) fetchHeaders(ctx context.Context, peer *corenetwork.Peer, base coredatabase.BlockHeader) ([]coredatabase.BlockHeader, error) {
+	var headers []coredatabase.BlockHeader
+	prev := base
+	for len(headers) < MaxSyncHeaders {
+		request := GetHeadersMessage{From: prev.Height + 1, Limit: MaxHeaders}
+		frame, err := d.request(ctx, peer, corecodec.GetHeaders, &request, func(id string) { request.Request = id })
+		if err != nil {
+			return nil, err
+		}
+		var response HeadersMessage
+		if err := frame.Unmarshal(&response); err != nil || len(response.Headers) > MaxHeaders {
+			return nil, ErrBadHeaders
+		}
+
+		d.mu.Lock()
+		d.heights[peer.NodeID] = response.Height
+		d.mu.Unlock()
+
+		for _, header := range response.Headers {
+			//A first header that does not link to ours is a chain that split
+			//off too long ago, which is not the peer's fault
+			if len(headers) == 0 && header.PrevHash != base.Hash() {
+				return nil, errUnrelated
+			}
+			if err := verifyHeader(d.engine, prev, header); err != nil {
+				return nil, ErrBadHeaders
+			}
+			headers = append(headers, header)
+			prev = header
+		}
+		if len(response.Headers) < MaxHeaders {
+			break
+		}
+	}
+	return headers, nil
+}
+
+// verifyHeader checks that header links to prev and passes the engine's checks
+func verifyHeader(engine coreconsensus.Engine, prev, header coredatabase.BlockHeader) error {
+	if header.Height != prev.Height+1 || header.PrevHash != prev.Hash() || header.Timestamp < prev.Timestamp {
+		return ErrBadHeaders
+	}
+	return engine.VerifyHeader(prev, header)
+}
+
+// download is a range of headers being fetched from one peer
+type download struct {
+	peer   *corenetwork.Peer
+	start  int
+	end    int
+	blocks []*coredatabase.Block
+	err    error
+}
+
+// bodies downloads the blocks for headers from the peers in sources that
+// have them, several at once, and hands them to the engine in order
+func (d *Downloader) bodies(ctx context.Context, headers []coredatabase.BlockHeader, sources map[*corenetwork.Peer]map[string]bool) error {
+	//Skip the blocks we already have
+	next := 0
+	for next < len(headers) {
+		block, err := d.chain.BlockAt(headers[next].Height)
+		if err != nil || block.Hash() != headers[next].Hash() {
+			break
+		}
+		next++
+	}
+
+	var queue [][2]int
+	for start := next; start < len(headers); start += MaxBlocks {
+		end := start + MaxBlocks
+		if end > len(headers) {
+			end = len(headers)
+		}
+		queue = append(queue, [2]int{start, end})
+	}
+
+	idle := make(map[*corenetwork.Peer]bool)
+	for peer := range sources {
+		idle[peer] = true
+	}
+	buffered := make(map[int]*coredatabase.Block)
+	providers := make(map[int]*corenetwork.Peer)
+	results := make(chan download)
+	inflight := 0
+
+	for next < len(headers) {
+		//Hand the earliest ranges to idle peers that have them, without
+		//running too far ahead of the blocks already applied
+		for i := 0; i < len(queue); {
+			job := queue[i]
+			if job[0] >= next+MaxBuffered {
+				break
+			}
+			peer := d.pick(idle, sources, headers[job[1]-1].Hash())
+			if peer == nil {
+				i++
+				continue
+			}
+			delete(idle, peer)
+			queue = append(queue[:i], queue[i+1:]...)
+			inflight++
+			go func(job download) {
+				job.blocks, job.err = d.fetchBlocks(ctx, job.peer, headers[job.start:job.end])
+				results <- job
+			}(download{peer: peer, start: job[0], end: job[1]})
+		}
+		if inflight == 0 {
+			return ErrNoPeers
+		}
+
+		var result download
+		select {
+		case result = <-results:
+		case <-ctx.Done():
+			//Let the downloads that are still running finish into the void
+			go func(n int) {
+				for ; n > 0; n-- {
+					<-results
+				}
+			}(inflight)
+			return ctx.Err()
+		}
+		inflight--
+
+		switch {
+		case sources[result.peer] == nil:
+			//The peer was dropped while this download ran
+			queue = requeue(queue, result.start, result.end)
+		case result.err != nil || len(result.blocks) == 0:
+			//Try someone else for this range and leave the peer out from now on
+			if result.err == ErrBadBody {
+				d.manager.Penalize(result.peer, corenetwork.PenaltyMalformed, result.err.Error())
+			}
+			delete(sources, result.peer)
+			queue = requeue(queue, result.start, result.end)
+		default:
+			idle[result.peer] = true
+			for i, block := range result.blocks {
+				buffered[result.start+i] = block
+				providers[result.start+i] = result.peer
+			}
+			if got := result.start + len(result.blocks); got < result.end {
+				queue = requeue(queue, got, result.end)
+			}
+		}
+
+		applied := next
+		for ; next < len(headers) && buffered[next] != nil; next++ {
+			err := d.engine.Accept(buffered[next])
+			if err != nil && err != coreconsensus.ErrKnownBlock && err != coreconsensus.ErrSideBlock {
+				//Get the block and the rest of what the provider sent from
+				//someone else. Only a block that is wrong in itself is the
+				//provider's fault, one that is early or that we cannot store
+				//right now is not.
+				provider := providers[next]
+				log.Println("Block", headers[next].Height, "from", provider.Address, "was not accepted:", err)
+				if invalid(err) {
+					d.manager.Penalize(provider, corenetwork.PenaltyMalformed, err.Error())
+				}
+				delete(sources, provider)
+				delete(idle, provider)
+				start := -1
+				for i := next; i <= len(headers); i++ {
+					if i < len(headers) && providers[i] == provider {
+						delete(buffered, i)
+						delete(providers, i)
+						if start < 0 {
+							start = i
+						}
+						continue
+					}
+					if start >= 0 {
+						queue = requeue(queue, start, i)
+						start = -1
+					}
+				}
+				break
+			}
+			delete(buffered, next)
+			delete(providers, next)
+		}
+		if next > applied {
+			log.Printf("Synced to block %d of %d", headers[next-1].Height, headers[len(headers)-1].Height)
+		}
+	}
+	return nil
+}
+
+// invalid reports whether the engine refused a block because of something
+// wrong with the block itself, as opposed to, say, it being early
+func invalid(err error) bool {
+	for _, bad := range []error{
+		coreconsensus.ErrNotValidator,
+		coreconsensus.ErrWrongTurn,
+		coreconsensus.ErrBadCommit,
+		coredatabase.ErrBadSignature,
+		coredatabase.ErrBadStateRoot,
+		coredatabase.ErrBadLink,
+		coredatabase.ErrBadMerkleRoot,
+		coredatabase.ErrBadTimestamp,
+	} {
+		if errors.Is(err, bad) {
+			return true
+		}
+	}
+	return false
+}
+
+// pick returns an idle peer that has the block with hash
+func (d *Downloader) pick(idle map[*corenetwork.Peer]bool, sources map[*corenetwork.Peer]map[string]bool, hash string) *corenetwork.Peer {
+	for peer := range idle {
+		if sources[peer][hash] {
+			return peer
+		}
+	}
+	return nil
+}
+
+// requeue puts a range back in the queue, keeping it sorted by start
+func requeue(queue [][2]int, start, end int) [][2]int {
+	i := sort.Search(len(queue), func(i int) bool { return queue[i][0] >= start })
+	queue = append(queue, [2]int{})
+	copy(queue[i+1:], queue[i:])
+	queue[i] = [2]int{start, end}
+	return queue
+}
+
+// fetchBlocks downloads the blocks for headers from peer and checks that
+// each matches its header and commits to its transactions
+func (d *Downloader) fetchBlocks(ctx context.Context, peer *corenetwork.Peer, headers []coredatabase.BlockHeader) ([]*coredatabase.Block, error) {
+	request := GetBlocksMessage{}
+	for _, header := range headers {
+		request.Hashes = append(request.Hashes, header.Hash())
+	}
+	frame, err := d.request(ctx, peer, corecodec.GetBlocks, &request, func(id string) { request.Request = id })
+	if err != nil {
+		return nil, err
+	}
+
+	var response BlocksMessage
+	if err := frame.Unmarshal(&response); err != nil || len(response.Blocks) > len(headers) {
+		return nil, ErrBadBody
+	}
+	for i, block := range response.Blocks {
+		if block == nil || block.Hash() != request.Hashes[i] || block.Header.MerkleRoot != coredatabase.TransactionRoot(block.Transactions) {
+			return nil, ErrBadBody
+		}
+	}
+	return response.Blocks, nil
+}
@@ -0,0 +1,225 @@
+package coreblocksync
+
+import (
+	"context"
+	"crypto/ed25519"
+	"net"
+	"testing"
+	"time"
+
+	corecodec "github.com/jneubaum/honestvote.io/core/core-codec"
+	coreconsensus "github.com/jneubaum/honestvote.io/core/core-consensus"
+	corecrypto "github.com/jneubaum/honestvote.io/core/core-crypto"
+	coredatabase "github.com/jneubaum/honestvote.io/core/core-database/src"
+	coremempool "github.com/jneubaum/honestvote.io/core/core-mempool"
+	corenetwork "github.com/jneubaum/honestvote.io/core/core-network"
+)
+
+// node is a PoA follower listening on a local port
+type node struct {
+	manager    *corenetwork.PeerManager
+	address    string
+	chain      *coredatabase.Chain
+	engine     *coreconsensus.PoA
+	downloader *Downloader
+	withhold   bool // answer every GetBlocks with no blocks
+}
+
+func newNode(t *testing.T, validators coreconsensus.Validators) *node {
+	t.Helper()
+
+	chain, err := coredatabase.NewChain(coredatabase.NewMemoryStore())
+	if err != nil {
+		t.Fatal(err)
+	}
+	state := coredatabase.NewState(nil)
+	n := &node{
+		chain:  chain,
+		engine: coreconsensus.NewPoA(validators, time.Second, chain, state, coremempool.NewMempool(state.Check, 0, 0)),
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := corecrypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+	identity := &corenetwork.Identity{Key: key, Address: ":" + port, Role: corenetwork.RoleFull, Height: chain.Height}
+	n.manager = corenetwork.NewPeerManager(identity, 5, n.handle)
+	n.downloader = NewDownloader(n.manager, chain, n.engine)
+	n.address = listener.Addr().String()
+	t.Cleanup(func() {
+		listener.Close()
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		n.manager.Shutdown(ctx, "test over")
+	})
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go n.manager.Accept(conn)
+		}
+	}()
+	return n
+}
+
+func (n *node) handle(peer *corenetwork.Peer, frame corecodec.Frame) error {
+	if n.withhold && frame.Type == corecodec.GetBlocks {
+		var request GetBlocksMessage
+		if err := frame.Unmarshal(&request); err != nil {
+			return err
+		}
+		return send(peer, corecodec.Blocks, BlocksMessage{Request: request.Request, Blocks: []*coredatabase.Block{}})
+	}
+	return n.downloader.Receive(peer, frame)
+}
+
+// connect connects n to the others and waits for the handshakes
+func (n *node) connect(t *testing.T, others ...*node) {
+	t.Helper()
+
+	for _, other := range others {
+		if err := n.manager.Connect(other.address); err != nil {
+			t.Fatal(err)
+		}
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for n.manager.Len() < len(others) {
+		if time.Now().After(deadline) {
+			t.Fatal("peers did not connect")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// extend adds count empty blocks signed by key to each of the nodes
+func extend(t *testing.T, key ed25519.PrivateKey, count int, start int64, nodes ...*node) {
+	t.Helper()
+
+	root := coredatabase.NewState(nil).Root()
+	for i := 0; i < count; i++ {
+		head := nodes[0].chain.Head()
+		block := coredatabase.NewBlock(head, []coredatabase.Transaction{}, root, start+int64(head.Height()), key)
+		for _, n := range nodes {
+			if err := n.engine.Accept(block); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+}
+
+func TestSyncFromSeveralPeers(t *testing.T) {
+	public, key, _ := ed25519.GenerateKey(nil)
+	validators := coreconsensus.Validators{public}
+	ahead, behind, partway := newNode(t, validators), newNode(t, validators), newNode(t, validators)
+	start := time.Now().Unix() - 5000
+	extend(t, key, 500, start, ahead, partway)
+	extend(t, key, 500, start, ahead)
+
+	behind.connect(t, ahead, partway)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	if err := behind.downloader.Sync(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if behind.chain.Head().Hash() != ahead.chain.Head().Hash() {
+		t.Fatal("synced to height", behind.chain.Height(), "of", ahead.chain.Height())
+	}
+	if progress := behind.downloader.Progress(); progress.Syncing || progress.Height != 1000 || progress.TargetHeight != 1000 {
+		t.Fatalf("unexpected progress %+v", progress)
+	}
+}
+
+func TestSyncAroundWithheldBodies(t *testing.T) {
+	public, key, _ := ed25519.GenerateKey(nil)
+	validators := coreconsensus.Validators{public}
+	honest, withholding, behind := newNode(t, validators), newNode(t, validators), newNode(t, validators)
+	withholding.withhold = true
+	extend(t, key, 300, time.Now().Unix()-5000, honest, withholding)
+
+	//Headers from both peers name the same chain, but only one of them
+	//sends the blocks
+	behind.connect(t, withholding, honest)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	if err := behind.downloader.Sync(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if behind.chain.Head().Hash() != honest.chain.Head().Hash() {
+		t.Fatal("synced to height", behind.chain.Height(), "of", honest.chain.Height())
+	}
+}
+
+func TestSyncOnlyFromWithholdingPeer(t *testing.T) {
+	public, key, _ := ed25519.GenerateKey(nil)
+	validators := coreconsensus.Validators{public}
+	withholding, behind := newNode(t, validators), newNode(t, validators)
+	withholding.withhold = true
+	extend(t, key, 100, time.Now().Unix()-5000, withholding)
+
+	behind.connect(t, withholding)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	if err := behind.downloader.Sync(ctx); err != ErrNoPeers {
+		t.Fatal("expected ErrNoPeers, got", err)
+	}
+	if behind.chain.Height() != 0 {
+		t.Fatal("added blocks nobody sent")
+	}
+}
+
+func TestSyncSwitchesToLongerFork(t *testing.T) {
+	public, key, _ := ed25519.GenerateKey(nil)
+	validators := coreconsensus.Validators{public}
+	ahead, behind := newNode(t, validators), newNode(t, validators)
+	start := time.Now().Unix() - 5000
+	extend(t, key, 50, start, ahead, behind)
+	extend(t, key, 5, start+1000, behind)
+	extend(t, key, 10, start+2000, ahead)
+
+	behind.connect(t, ahead)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	if err := behind.downloader.Sync(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if behind.chain.Head().Hash() != ahead.chain.Head().Hash() {
+		t.Fatal("did not switch to the longer fork")
+	}
+}
+
+func TestSyncPenalizesInvalidBlock(t *testing.T) {
+	public, key, _ := ed25519.GenerateKey(nil)
+	validators := coreconsensus.Validators{public}
+	ahead, behind := newNode(t, validators), newNode(t, validators)
+	start := time.Now().Unix() - 5000
+	extend(t, key, 4, start, ahead)
+
+	//The header checks out, but applying the block does not give its state root
+	bad := coredatabase.NewBlock(ahead.chain.Head(), []coredatabase.Transaction{}, "wrong", start+4, key)
+	if err := ahead.chain.Append(bad); err != nil {
+		t.Fatal(err)
+	}
+
+	behind.connect(t, ahead)
+	peer := behind.manager.Peers()[0]
+	before := peer.Score()
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	if err := behind.downloader.Sync(ctx); err != ErrNoPeers {
+		t.Fatal("expected ErrNoPeers, got", err)
+	}
+	if behind.chain.Height() != 4 {
+		t.Fatal("expected the blocks before the bad one, got height", behind.chain.Height())
+	}
+	if peer.Score() >= before {
+		t.Fatal("the peer that sent the bad block was not penalized")
+	}
+}
@@ -0,0 +1,134 @@
+package corecodec
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+)
+
+// MessageType identifies what kind of message a Frame carries
+type MessageType uint8
+
+// These constants are the message types understood by every node
+const (
+	Handshake MessageType = iota + 1
+	GetData
+	ReceiveData
+	Register
+	GetPeers
+	Peers
+	HandshakeProof
+	Reject
+	Gossip
+	SyncRequest
+	SyncBatch
+	Ping
+	Pong
+	Disconnect
+	Transaction
+	Block
+	Consensus
+	GetHeaders
+	Headers
+	GetBlocks
+	Blocks
+)
+
+// HeaderSize is the number of bytes in front of every payload: one byte for
+// the message type followed by a four byte big endian payload length
+const HeaderSize = 5
+
+// MaxFrameSize is the largest payload a Decoder will accept by default
+const MaxFrameSize = 4 << 20
+
+// ErrFrameTooLarge is returned when a frame announces a payload bigger than the limit
+var ErrFrameTooLarge = errors.New("corecodec: frame exceeds maximum size")
+
+// Frame is a single message on the wire
+type Frame struct {
+	Type    MessageType
+	Payload []byte
+}
+
+// NewFrame builds a frame whose payload is the JSON encoding of v
+func NewFrame(t MessageType, v interface{}) (Frame, error) {
+	payload, err := json.Marshal(v)
+	if err != nil {
+		return Frame{}, err
+	}
+	return Frame{Type: t, Payload: payload}, nil
+}
+
+// Unmarshal decodes the JSON payload of the frame into v
+func (f Frame) Unmarshal(v interface{}) error {
+	return json.Unmarshal(f.Payload, v)
+}
+
+// Encode returns the wire representation of the frame
+func (f Frame) Encode() ([]byte, error) {
+	if len(f.Payload) > MaxFrameSize {
+		return nil, ErrFrameTooLarge
+	}
+	buf := make([]byte, HeaderSize+len(f.Payload))
+	buf[0] = byte(f.Type)
+	binary.BigEndian.PutUint32(buf[1:HeaderSize], uint32(len(f.Payload)))
+	copy(buf[HeaderSize:], f.Payload)
+	return buf, nil
+}
+
+// WriteFrame writes the frame to w with a single Write call, so frames
+// written from different goroutines never interleave on the same socket
+// as long as the caller serializes calls
+func WriteFrame(w io.Writer, f Frame) error {
+	buf, err := f.Encode()
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(buf)
+	return err
+}
+
+// Decoder reads frames from a stream. It keeps reading until a whole frame
+// has arrived, so frames split across several TCP reads or several frames
+// packed into one read are both handled.
+type Decoder struct {
+	r   *bufio.Reader
+	max int
+}
+
+// NewDecoder returns a decoder that reads from r and enforces MaxFrameSize
+func NewDecoder(r io.Reader) *Decoder {
+	return NewDecoderSize(r, MaxFrameSize)
+}
+
+// NewDecoderSize returns a decoder that rejects payloads larger than max bytes
+func NewDecoderSize(r io.Reader, max int) *Decoder {
+	return &Decoder{r: bufio.NewReader(r), max: max}
+}
+
+// Decode reads the next frame. A frame that is larger than the limit returns
+// ErrFrameTooLarge without reading the payload; the stream cannot be used
+// after that because it is no longer aligned on a frame boundary.
+func (d *Decoder) Decode() (Frame, error) {
+	var header [HeaderSize]byte
+	if _, err := io.ReadFull(d.r, header[:]); err != nil {
+		return Frame{}, err
+	}
+
+	length := binary.BigEndian.Uint32(header[1:])
+	if int64(length) > int64(d.max) {
+		return Frame{}, ErrFrameTooLarge
+	}
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(d.r, payload); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return Frame{}, err
+	}
+
+	return Frame{Type: MessageType(header[0]), Payload: payload}, nil
+}
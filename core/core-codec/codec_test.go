@@ -0,0 +1,78 @@
+package corecodec
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"testing/iotest"
+)
+
+// encode returns the wire form of frames one after the other
+func encode(t *testing.T, frames ...Frame) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	for _, f := range frames {
+		if err := WriteFrame(&buf, f); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return buf.Bytes()
+}
+
+func TestDecodeSplitAndPackedFrames(t *testing.T) {
+	frames := []Frame{
+		{Type: Ping, Payload: []byte(`{"nonce":1}`)},
+		{Type: Blocks, Payload: bytes.Repeat([]byte("x"), 10000)},
+		{Type: Pong, Payload: []byte{}},
+	}
+	data := encode(t, frames...)
+
+	readers := map[string]io.Reader{
+		"packed in one read": bytes.NewReader(data),
+		"one byte per read":  iotest.OneByteReader(bytes.NewReader(data)),
+		"half a frame":       iotest.HalfReader(bytes.NewReader(data)),
+	}
+	for name, r := range readers {
+		d := NewDecoder(r)
+		for i, want := range frames {
+			got, err := d.Decode()
+			if err != nil {
+				t.Fatalf("%s: frame %d: %v", name, i, err)
+			}
+			if got.Type != want.Type || !bytes.Equal(got.Payload, want.Payload) {
+				t.Fatalf("%s: frame %d came out different", name, i)
+			}
+		}
+		if _, err := d.Decode(); err != io.EOF {
+			t.Fatalf("%s: expected io.EOF after the last frame, got %v", name, err)
+		}
+	}
+}
+
+func TestDecodeRejects(t *testing.T) {
+	data := encode(t, Frame{Type: Ping, Payload: []byte("12345678")})
+
+	cases := []struct {
+		name string
+		data []byte
+		max  int
+		err  error
+	}{
+		{"partial header", data[:3], MaxFrameSize, io.ErrUnexpectedEOF},
+		{"partial payload", data[:len(data)-1], MaxFrameSize, io.ErrUnexpectedEOF},
+		{"header only", data[:HeaderSize], MaxFrameSize, io.ErrUnexpectedEOF},
+		{"over the limit", []byte{byte(Blocks), 0, 0, 0, 9}, 8, ErrFrameTooLarge},
+		{"over the default limit", []byte{byte(Blocks), 0xff, 0xff, 0xff, 0xff}, MaxFrameSize, ErrFrameTooLarge},
+		{"at the limit", data, 8, nil},
+	}
+	for _, c := range cases {
+		if _, err := NewDecoderSize(bytes.NewReader(c.data), c.max).Decode(); err != c.err {
+			t.Errorf("%s: expected %v, got %v", c.name, c.err, err)
+		}
+	}
+
+	if _, err := (Frame{Type: Blocks, Payload: make([]byte, MaxFrameSize+1)}).Encode(); err != ErrFrameTooLarge {
+		t.Error("expected ErrFrameTooLarge encoding an oversized frame, got", err)
+	}
+}
@@ -0,0 +1,727 @@
+package coreconsensus
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	coredatabase "github.com/jneubaum/honestvote.io/core/core-database/src"
+	coremempool "github.com/jneubaum/honestvote.io/core/core-mempool"
+)
+
+// These are how long a round waits at each step before giving up on it.
+// Every round after the first waits TimeoutDelta longer than the one before,
+// so the network eventually waits long enough for slow validators.
+const (
+	TimeoutPropose   = 3 * time.Second
+	TimeoutPrevote   = time.Second
+	TimeoutPrecommit = time.Second
+	TimeoutDelta     = 500 * time.Millisecond
+)
+
+// MaxRoundsAhead is how many rounds past our own we keep messages for
+const MaxRoundsAhead = 10
+
+// RebroadcastInterval is how often a validator sends its messages for the
+// current round again while the round lasts, so validators that missed them,
+// for example because they connected after they were sent, still hear them
+const RebroadcastInterval = 2 * time.Second
+
+var (
+	// ErrBadMessage is returned for consensus messages that do not make sense
+	ErrBadMessage = errors.New("coreconsensus: malformed consensus message")
+	// ErrNotProposer is returned for proposals from a validator whose turn it is not
+	ErrNotProposer = errors.New("coreconsensus: proposal from a validator that is not the round's proposer")
+	// ErrConflictingVote is returned when a validator sends two different messages for the same step
+	ErrConflictingVote = errors.New("coreconsensus: validator already voted differently in this round")
+	// ErrBadCommit is returned for blocks without 2/3+ valid precommits
+	ErrBadCommit = errors.New("coreconsensus: block does not carry a valid commit")
+	// ErrBadProposalTime is returned for proposed blocks whose timestamp is not after their parent's or lies outside the height being decided
+	ErrBadProposalTime = errors.New("coreconsensus: proposed block timestamp is outside the round")
+)
+
+// Step is how far a round has got
+type Step uint8
+
+// These constants are the steps of a round. StepCommit is the wait between
+// committing a block and starting on the next height.
+const (
+	StepPropose Step = iota
+	StepPrevote
+	StepPrecommit
+	StepCommit
+)
+
+// MessageType says what a consensus message is
+type MessageType string
+
+// These constants are the kinds of consensus message
+const (
+	Proposal  MessageType = "proposal"
+	Prevote   MessageType = "prevote"
+	Precommit MessageType = "precommit"
+)
+
+// Message is a signed proposal or vote from a validator. A vote with an
+// empty BlockHash is a vote for no block in that round.
+type Message struct {
+	Type       MessageType         `json:"type"`
+	Height     uint64              `json:"height"`
+	Round      uint32              `json:"round"`
+	BlockHash  string              `json:"blockHash"`
+	ValidRound int32               `json:"validRound"`      // proposals only, the round the block was prevoted in or -1
+	Block      *coredatabase.Block `json:"block,omitempty"` // proposals only
+	Validator  ed25519.PublicKey   `json:"validator"`
+	Signature  []byte              `json:"signature"`
+	Resent     int64               `json:"resent,omitempty"` // unix nanoseconds a copy was sent again, not signed
+}
+
+// signingBytes is what the validator signs. The block itself is covered
+// through its hash.
+func (m *Message) signingBytes() []byte {
+	return []byte(fmt.Sprintf("honestvote %s %d %d %s %d", m.Type, m.Height, m.Round, m.BlockHash, m.ValidRound))
+}
+
+// Sign sets the validator and signs the message with its key
+func (m *Message) Sign(key ed25519.PrivateKey) {
+	m.Validator = key.Public().(ed25519.PublicKey)
+	m.Signature = ed25519.Sign(key, m.signingBytes())
+}
+
+// Verify checks the validator's signature
+func (m *Message) Verify() error {
+	if len(m.Validator) != ed25519.PublicKeySize || !ed25519.Verify(m.Validator, m.signingBytes(), m.Signature) {
+		return coredatabase.ErrBadSignature
+	}
+	return nil
+}
+
+// Quorum is how many validators make up more than two thirds of the set
+func (v Validators) Quorum() int {
+	return 2*len(v)/3 + 1
+}
+
+// MaxFaulty is how many Byzantine validators the set can tolerate
+func (v Validators) MaxFaulty() int {
+	return (len(v) - 1) / 3
+}
+
+// VerifyCommit checks that block carries precommits for it from more than
+// two thirds of the validators
+func VerifyCommit(validators Validators, block *coredatabase.Block) error {
+	if block.Commit == nil {
+		return ErrBadCommit
+	}
+	signed := make(map[string]bool)
+	for _, signature := range block.Commit.Signatures {
+		vote := Message{
+			Type:      Precommit,
+			Height:    block.Height(),
+			Round:     block.Commit.Round,
+			BlockHash: block.Hash(),
+			Validator: signature.Validator,
+			Signature: signature.Signature,
+		}
+		if !validators.Contains(vote.Validator) || vote.Verify() != nil {
+			return ErrBadCommit
+		}
+		signed[hex.EncodeToString(vote.Validator)] = true
+	}
+	if len(signed) < validators.Quorum() {
+		return ErrBadCommit
+	}
+	return nil
+}
+
+// voteSet is the votes of one type in one round
+type voteSet struct {
+	votes map[string]*Message // keyed by validator
+	count map[string]int      // keyed by block hash
+}
+
+func newVoteSet() *voteSet {
+	return &voteSet{votes: make(map[string]*Message), count: make(map[string]int)}
+}
+
+// add records vote and reports whether it was new
+func (s *voteSet) add(vote *Message) (bool, error) {
+	validator := hex.EncodeToString(vote.Validator)
+	if existing, ok := s.votes[validator]; ok {
+		if existing.BlockHash != vote.BlockHash {
+			return false, ErrConflictingVote
+		}
+		return false, nil
+	}
+	s.votes[validator] = vote
+	s.count[vote.BlockHash]++
+	return true, nil
+}
+
+// outbox is what the engine has to send once it lets go of the lock
+type outbox struct {
+	messages []*Message
+	blocks   []*coredatabase.Block
+}
+
+// BFT is Byzantine fault tolerant consensus in the style of Tendermint.
+// Each height runs in rounds. The round's proposer proposes a block, the
+// validators prevote for it or for nothing, and once more than two thirds
+// prevote for the block they precommit it. A block with precommits from
+// more than two thirds of the validators is final and never reorganized.
+// Rounds that fail time out and the next validator proposes. Validators
+// lock on a block they precommit, which keeps two blocks from being
+// finalized at one height as long as fewer than a third are Byzantine.
+type BFT struct {
+	ledger
+	validators Validators
+	interval   time.Duration
+
+	ctx         context.Context
+	height      uint64
+	started     time.Time // when we moved on to height
+	round       uint32
+	step        Step
+	lockedRound int32
+	lockedBlock *coredatabase.Block
+	validRound  int32
+	validBlock  *coredatabase.Block
+	proposals   map[uint32]*Message
+	blocks      map[string]*coredatabase.Block // valid proposed blocks by hash
+	prevotes    map[uint32]*voteSet
+	precommits  map[uint32]*voteSet
+	senders     map[uint32]map[string]bool // validators heard from in each round
+	fired       map[string]bool            // rules that only run once per round
+	next        map[string]*Message        // messages for the next height, by validator, type and round
+	out         outbox
+
+	// These are optional and must be set before Run. Key is this node's
+	// validator key, without it the node follows consensus without voting.
+	// Broadcast sends this node's consensus messages to the network and
+	// Publish sends blocks once they are final.
+	Key             ed25519.PrivateKey
+	Broadcast       func(message *Message) error
+	Publish         func(block *coredatabase.Block) error
+	MaxTransactions int
+	MaxBlockBytes   int
+}
+
+// NewBFT returns BFT consensus among validators that waits interval after
+// every block before starting on the next
+func NewBFT(validators Validators, interval time.Duration, chain *coredatabase.Chain, state *coredatabase.State, mempool *coremempool.Mempool) *BFT {
+	if interval <= 0 {
+		interval = DefaultBlockInterval
+	}
+	b := &BFT{
+		ledger:          newLedger(chain, state, mempool),
+		validators:      validators,
+		interval:        interval,
+		MaxTransactions: DefaultMaxTransactions,
+		MaxBlockBytes:   DefaultMaxBlockBytes,
+		next:            make(map[string]*Message),
+	}
+	b.reset()
+	return b
+}
+
+// Height returns the height consensus is being reached on
+func (b *BFT) Height() uint64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.height
+}
+
+// Round returns the current round and step
+func (b *BFT) Round() (uint32, Step) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.round, b.step
+}
+
+// reset clears everything about the height being decided and moves on to
+// the one after the chain head, taking in the messages for it that arrived
+// early. The caller must hold the lock.
+func (b *BFT) reset() {
+	b.height = b.chain.Height() + 1
+	b.started = time.Now()
+	b.round = 0
+	b.step = StepCommit
+	b.lockedRound, b.lockedBlock = -1, nil
+	b.validRound, b.validBlock = -1, nil
+	b.proposals = make(map[uint32]*Message)
+	b.blocks = make(map[string]*coredatabase.Block)
+	b.prevotes = make(map[uint32]*voteSet)
+	b.precommits = make(map[uint32]*voteSet)
+	b.senders = make(map[uint32]map[string]bool)
+	b.fired = make(map[string]bool)
+
+	early := b.next
+	b.next = make(map[string]*Message)
+	for _, message := range early {
+		if message.Height == b.height {
+			if err := b.add(message); err != nil {
+				log.Println("Dropping early consensus message:", err)
+			}
+		}
+	}
+}
+
+// Run takes part in consensus until ctx is cancelled
+func (b *BFT) Run(ctx context.Context) {
+	if len(b.validators) == 0 {
+		return
+	}
+
+	b.mu.Lock()
+	b.ctx = ctx
+	b.startRound(0)
+	b.unlock()
+
+	<-ctx.Done()
+}
+
+// unlock releases the lock and sends whatever was queued while it was held
+func (b *BFT) unlock() {
+	out := b.out
+	b.out = outbox{}
+	b.mu.Unlock()
+
+	for _, message := range out.messages {
+		if b.Broadcast != nil {
+			if err := b.Broadcast(message); err != nil {
+				log.Println("Broadcasting consensus message failed:", err)
+			}
+		}
+	}
+	for _, block := range out.blocks {
+		if b.Publish != nil {
+			if err := b.Publish(block); err != nil {
+				log.Println("Publishing block failed:", err)
+			}
+		}
+	}
+}
+
+// Receive handles a consensus message from another validator. Messages for
+// the next height are kept until we get there, since a validator that
+// commits a moment after the others would otherwise miss the start of the
+// next height. Messages for other heights, or rounds too far ahead, are
+// ignored without an error so they still reach validators that need them.
+func (b *BFT) Receive(message *Message) error {
+	if err := message.Verify(); err != nil {
+		return err
+	}
+	if !b.validators.Contains(message.Validator) {
+		return ErrNotValidator
+	}
+
+	b.mu.Lock()
+	defer b.unlock()
+
+	if message.Round > b.round+MaxRoundsAhead {
+		return nil
+	}
+	switch message.Height {
+	case b.height:
+		if err := b.add(message); err != nil {
+			return err
+		}
+		b.process()
+	case b.height + 1:
+		if message.Round > MaxRoundsAhead {
+			return nil
+		}
+		key := fmt.Sprintf("%x/%s/%d", message.Validator, message.Type, message.Round)
+		if _, ok := b.next[key]; !ok {
+			b.next[key] = message
+		}
+	}
+	return nil
+}
+
+// add records a message for the current height. The caller must hold the lock.
+func (b *BFT) add(message *Message) error {
+	switch message.Type {
+	case Proposal:
+		if !b.proposer(message.Round).Equal(message.Validator) {
+			return ErrNotProposer
+		}
+		block := message.Block
+		if block == nil || block.Hash() != message.BlockHash || message.ValidRound < -1 || message.ValidRound >= int32(message.Round) {
+			return ErrBadMessage
+		}
+		if existing, ok := b.proposals[message.Round]; ok {
+			if existing.BlockHash != message.BlockHash {
+				return ErrConflictingVote
+			}
+			return nil
+		}
+		if _, ok := b.blocks[message.BlockHash]; !ok {
+			if err := b.checkBlock(block); err != nil {
+				return err
+			}
+			b.blocks[message.BlockHash] = block
+		}
+		b.proposals[message.Round] = message
+	case Prevote, Precommit:
+		if message.Block != nil || message.ValidRound != 0 {
+			return ErrBadMessage
+		}
+		votes := b.prevotes
+		if message.Type == Precommit {
+			votes = b.precommits
+		}
+		if votes[message.Round] == nil {
+			votes[message.Round] = newVoteSet()
+		}
+		if _, err := votes[message.Round].add(message); err != nil {
+			return err
+		}
+	default:
+		return ErrBadMessage
+	}
+
+	if b.senders[message.Round] == nil {
+		b.senders[message.Round] = make(map[string]bool)
+	}
+	b.senders[message.Round][hex.EncodeToString(message.Validator)] = true
+	return nil
+}
+
+// checkBlock makes sure a proposed block was made by a validator and can
+// follow the chain head. Its timestamp must be after the head's, and no
+// earlier than when we moved on to this height, give or take
+// MaxClockDrift, since it was made in one of the height's rounds. The
+// caller must hold the lock.
+func (b *BFT) checkBlock(block *coredatabase.Block) error {
+	if block.Height() != b.height {
+		return ErrBadMessage
+	}
+	if err := block.VerifySignature(); err != nil {
+		return err
+	}
+	if !b.validators.Contains(block.Header.Proposer) {
+		return ErrNotValidator
+	}
+	timestamp := time.Unix(block.Header.Timestamp, 0)
+	if block.Header.Timestamp <= b.chain.Head().Header.Timestamp || timestamp.Before(b.started.Add(-MaxClockDrift)) {
+		return ErrBadProposalTime
+	}
+	_, err := b.check(block)
+	return err
+}
+
+// proposer returns the validator that proposes in round of the current height
+func (b *BFT) proposer(round uint32) ed25519.PublicKey {
+	return b.validators.Proposer(b.height + uint64(round))
+}
+
+// self returns this node's key if it is a validator
+func (b *BFT) self() ed25519.PublicKey {
+	if b.Key == nil {
+		return nil
+	}
+	public := b.Key.Public().(ed25519.PublicKey)
+	if !b.validators.Contains(public) {
+		return nil
+	}
+	return public
+}
+
+// send signs a message, records it as if it came from the network and
+// queues it for broadcast. Nodes that are not validators send nothing. The
+// caller must hold the lock.
+func (b *BFT) send(message *Message) {
+	if b.self() == nil {
+		return
+	}
+	message.Height = b.height
+	message.Sign(b.Key)
+	if err := b.add(message); err != nil {
+		log.Println("Recording own consensus message failed:", err)
+		return
+	}
+	b.out.messages = append(b.out.messages, message)
+}
+
+// vote sends a prevote or precommit for hash in the current round and moves
+// on to the next step. The caller must hold the lock.
+func (b *BFT) vote(t MessageType, hash string) {
+	b.send(&Message{Type: t, Round: b.round, BlockHash: hash})
+	if t == Prevote {
+		b.step = StepPrevote
+	} else {
+		b.step = StepPrecommit
+	}
+}
+
+// startRound moves to round and proposes if it is our turn. The caller
+// must hold the lock.
+func (b *BFT) startRound(round uint32) {
+	b.round = round
+	b.step = StepPropose
+
+	if self := b.self(); self != nil && b.proposer(round).Equal(self) {
+		block := b.validBlock
+		if block == nil {
+			timestamp := time.Now().Unix()
+			if head := b.chain.Head(); timestamp <= head.Header.Timestamp {
+				timestamp = head.Header.Timestamp + 1
+			}
+			block = b.build(timestamp, b.Key, b.MaxTransactions, b.MaxBlockBytes)
+		}
+		b.send(&Message{Type: Proposal, Round: round, BlockHash: block.Hash(), ValidRound: b.validRound, Block: block})
+	}
+
+	b.schedule(b.timeout(TimeoutPropose), func() {
+		if b.step == StepPropose {
+			b.vote(Prevote, "")
+		}
+	})
+	b.rebroadcast()
+	b.process()
+}
+
+// rebroadcast queues this node's messages for the current round again
+// every RebroadcastInterval until the round ends. Each copy has its own
+// Resent time, which gossip would otherwise drop as a message it has seen,
+// and validators that already have the message ignore it. The caller must
+// hold the lock.
+func (b *BFT) rebroadcast() {
+	b.schedule(RebroadcastInterval, func() {
+		self := b.self()
+		if self == nil {
+			return
+		}
+		var messages []*Message
+		if proposal := b.proposals[b.round]; proposal != nil && proposal.Validator.Equal(self) {
+			messages = append(messages, proposal)
+		}
+		for _, votes := range []*voteSet{b.prevotes[b.round], b.precommits[b.round]} {
+			if votes == nil {
+				continue
+			}
+			if vote, ok := votes.votes[hex.EncodeToString(self)]; ok {
+				messages = append(messages, vote)
+			}
+		}
+		for _, message := range messages {
+			again := *message
+			again.Resent = time.Now().UnixNano()
+			b.out.messages = append(b.out.messages, &again)
+		}
+		b.rebroadcast()
+	})
+}
+
+// timeout returns how long the current round waits at a step whose first
+// round waits base
+func (b *BFT) timeout(base time.Duration) time.Duration {
+	return base + time.Duration(b.round)*TimeoutDelta
+}
+
+// schedule runs fn after delay, unless the engine has moved on to another
+// height or round by then. The caller must hold the lock.
+func (b *BFT) schedule(delay time.Duration, fn func()) {
+	height, round := b.height, b.round
+	time.AfterFunc(delay, func() {
+		b.mu.Lock()
+		defer b.unlock()
+
+		if b.ctx == nil || b.ctx.Err() != nil || b.height != height || b.round != round {
+			return
+		}
+		fn()
+		b.process()
+	})
+}
+
+// once reports whether the named rule has not yet run for round, and marks
+// it as run
+func (b *BFT) once(rule string, round uint32) bool {
+	key := fmt.Sprintf("%s/%d", rule, round)
+	if b.fired[key] {
+		return false
+	}
+	b.fired[key] = true
+	return true
+}
+
+// process applies the consensus rules to what has been received so far
+// until none of them change anything. The caller must hold the lock.
+func (b *BFT) process() {
+	for b.step != StepCommit && b.processOnce() {
+	}
+}
+
+func (b *BFT) processOnce() bool {
+	//A block precommitted by 2/3+ in any round is final
+	for round, votes := range b.precommits {
+		for hash, count := range votes.count {
+			if block, ok := b.blocks[hash]; ok && hash != "" && count >= b.validators.Quorum() {
+				b.commit(block, round)
+				return true
+			}
+		}
+	}
+
+	round := b.round
+	quorum := b.validators.Quorum()
+	proposal := b.proposals[round]
+	prevotes := b.prevotes[round]
+	if prevotes == nil {
+		prevotes = newVoteSet()
+	}
+
+	if b.step == StepPropose && proposal != nil {
+		hash := proposal.BlockHash
+		if proposal.ValidRound == -1 {
+			if b.lockedRound == -1 || b.lockedBlock.Hash() == hash {
+				b.vote(Prevote, hash)
+			} else {
+				b.vote(Prevote, "")
+			}
+			return true
+		}
+		if earlier := b.prevotes[uint32(proposal.ValidRound)]; earlier != nil && earlier.count[hash] >= quorum {
+			if b.lockedRound <= proposal.ValidRound || b.lockedBlock.Hash() == hash {
+				b.vote(Prevote, hash)
+			} else {
+				b.vote(Prevote, "")
+			}
+			return true
+		}
+	}
+
+	if b.step == StepPrevote && len(prevotes.votes) >= quorum && b.once("prevote-timeout", round) {
+		b.schedule(b.timeout(TimeoutPrevote), func() {
+			if b.step == StepPrevote {
+				b.vote(Precommit, "")
+			}
+		})
+	}
+
+	if b.step >= StepPrevote && proposal != nil && prevotes.count[proposal.BlockHash] >= quorum && b.once("polka", round) {
+		block := b.blocks[proposal.BlockHash]
+		if b.step == StepPrevote {
+			b.lockedRound, b.lockedBlock = int32(round), block
+			b.vote(Precommit, proposal.BlockHash)
+		}
+		b.validRound, b.validBlock = int32(round), block
+		return true
+	}
+
+	if b.step == StepPrevote && prevotes.count[""] >= quorum {
+		b.vote(Precommit, "")
+		return true
+	}
+
+	if precommits := b.precommits[round]; precommits != nil && len(precommits.votes) >= quorum && b.once("precommit-timeout", round) {
+		b.schedule(b.timeout(TimeoutPrecommit), func() {
+			b.startRound(round + 1)
+		})
+	}
+
+	//If more than f validators are already in a later round we are behind,
+	//so skip ahead to the latest such round
+	skip := round
+	for later, senders := range b.senders {
+		if later > skip && len(senders) > b.validators.MaxFaulty() {
+			skip = later
+		}
+	}
+	if skip > round {
+		b.startRound(skip)
+		return true
+	}
+	return false
+}
+
+// commit finalizes block with the precommits from round, then waits out the
+// block interval before starting the next height. The caller must hold the lock.
+func (b *BFT) commit(block *coredatabase.Block, round uint32) {
+	final := *block
+	final.Commit = &coredatabase.Commit{Round: round}
+	for _, vote := range b.precommits[round].votes {
+		if vote.BlockHash == block.Hash() {
+			final.Commit.Signatures = append(final.Commit.Signatures, coredatabase.CommitSignature{Validator: vote.Validator, Signature: vote.Signature})
+		}
+	}
+	//Validators that saw the same precommits publish the same block, which
+	//gossip then only carries once
+	sort.Slice(final.Commit.Signatures, func(i, j int) bool {
+		return bytes.Compare(final.Commit.Signatures[i].Validator, final.Commit.Signatures[j].Validator) < 0
+	})
+
+	if err := b.ledger.commit(&final); err != nil {
+		//Every block that gets here was checked when it was proposed
+		log.Println("Committing block", final.Height(), "failed:", err)
+		return
+	}
+	b.out.blocks = append(b.out.blocks, &final)
+	b.nextHeight()
+}
+
+// nextHeight moves on to the height after the chain head and starts it
+// once the block interval has passed. The caller must hold the lock.
+func (b *BFT) nextHeight() {
+	b.reset()
+	b.schedule(b.interval, func() {
+		if b.step == StepCommit {
+			b.startRound(0)
+		}
+	})
+}
+
+// VerifyHeader checks that the block was signed by a validator. Whether it
+// is final is only known from the commit that comes with the whole block.
+func (b *BFT) VerifyHeader(prev, header coredatabase.BlockHeader) error {
+	if err := (&coredatabase.Block{Header: header}).VerifySignature(); err != nil {
+		return err
+	}
+	if !b.validators.Contains(header.Proposer) {
+		return ErrNotValidator
+	}
+	return nil
+}
+
+// Accept adds a final block from another node to the chain. This is how
+// nodes that missed the votes catch up. Final blocks are never replaced, so
+// a second final block for a height we have means the validators forked.
+func (b *BFT) Accept(block *coredatabase.Block) error {
+	b.mu.Lock()
+	defer b.unlock()
+
+	if err := b.known(block); err != nil {
+		if err == ErrStaleBlock && VerifyCommit(b.validators, block) == nil {
+			log.Println("Fork detected: conflicting final block", block.Hash(), "at height", block.Height())
+			return ErrConflictingCommit
+		}
+		return err
+	}
+	if err := block.VerifySignature(); err != nil {
+		return err
+	}
+	if !b.validators.Contains(block.Header.Proposer) {
+		return ErrNotValidator
+	}
+	if err := VerifyCommit(b.validators, block); err != nil {
+		return err
+	}
+	if err := b.ledger.commit(block); err != nil {
+		return err
+	}
+	if b.ctx != nil {
+		b.nextHeight()
+	} else {
+		b.reset()
+	}
+	return nil
+}
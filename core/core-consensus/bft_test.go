@@ -0,0 +1,231 @@
+package coreconsensus
+
+import (
+	"context"
+	"crypto/ed25519"
+	"testing"
+	"time"
+
+	coredatabase "github.com/jneubaum/honestvote.io/core/core-database/src"
+	coremempool "github.com/jneubaum/honestvote.io/core/core-mempool"
+)
+
+// newValidators makes count validator keys
+func newValidators(t *testing.T, count int) (Validators, []ed25519.PrivateKey) {
+	t.Helper()
+
+	var validators Validators
+	var keys []ed25519.PrivateKey
+	for i := 0; i < count; i++ {
+		public, private := newKey(t)
+		validators = append(validators, public)
+		keys = append(keys, private)
+	}
+	return validators, keys
+}
+
+// newBFT makes a BFT engine on an empty in-memory chain
+func newBFT(t *testing.T, validators Validators, key ed25519.PrivateKey) *BFT {
+	t.Helper()
+
+	chain, err := coredatabase.NewChain(coredatabase.NewMemoryStore())
+	if err != nil {
+		t.Fatal(err)
+	}
+	state := coredatabase.NewState(nil)
+	b := NewBFT(validators, 100*time.Millisecond, chain, state, coremempool.NewMempool(state.Check, 0, 0))
+	b.Key = key
+	return b
+}
+
+// precommit is key's signature on a precommit for block in round
+func precommit(key ed25519.PrivateKey, block *coredatabase.Block, round uint32) coredatabase.CommitSignature {
+	vote := Message{Type: Precommit, Height: block.Height(), Round: round, BlockHash: block.Hash()}
+	vote.Sign(key)
+	return coredatabase.CommitSignature{Validator: vote.Validator, Signature: vote.Signature}
+}
+
+// committed returns a first block proposed by keys[0] with precommits from
+// the keys at signers
+func committed(keys []ed25519.PrivateKey, signers ...int) *coredatabase.Block {
+	return committedAt(keys, time.Now().Unix(), signers...)
+}
+
+// committedAt is committed for a block made at timestamp
+func committedAt(keys []ed25519.PrivateKey, timestamp int64, signers ...int) *coredatabase.Block {
+	block, _ := build(coredatabase.NewState(nil), coredatabase.Genesis(), nil, timestamp, keys[0])
+	block.Commit = &coredatabase.Commit{Round: 0}
+	for _, i := range signers {
+		block.Commit.Signatures = append(block.Commit.Signatures, precommit(keys[i], block, 0))
+	}
+	return block
+}
+
+func TestVerifyCommit(t *testing.T) {
+	validators, keys := newValidators(t, 4)
+	_, outsider := newKey(t)
+
+	if err := VerifyCommit(validators, committed(keys, 0, 1, 2)); err != nil {
+		t.Fatal("rejected a commit from three of four validators:", err)
+	}
+
+	cases := map[string]*coredatabase.Block{
+		"no commit":        committed(keys),
+		"two of four":      committed(keys, 0, 1),
+		"duplicate signer": committed(keys, 0, 1, 1),
+	}
+	cases["no commit"].Commit = nil
+
+	outside := committed(keys, 0, 1)
+	outside.Commit.Signatures = append(outside.Commit.Signatures, precommit(outsider, outside, 0))
+	cases["non-validator signer"] = outside
+
+	forged := committed(keys, 0, 1, 2)
+	forged.Commit.Signatures[2].Signature = forged.Commit.Signatures[1].Signature
+	cases["forged signature"] = forged
+
+	otherRound := committed(keys, 0, 1, 2)
+	otherRound.Commit.Round = 1
+	cases["wrong round"] = otherRound
+
+	for name, block := range cases {
+		if err := VerifyCommit(validators, block); err != ErrBadCommit {
+			t.Errorf("%s: expected ErrBadCommit, got %v", name, err)
+		}
+	}
+}
+
+func TestBFTKeepsNextHeightMessages(t *testing.T) {
+	validators, keys := newValidators(t, 4)
+	b := newBFT(t, validators, nil)
+
+	early := &Message{Type: Prevote, Height: 2, Round: 0, BlockHash: "next"}
+	early.Sign(keys[1])
+	if err := b.Receive(early); err != nil {
+		t.Fatal(err)
+	}
+	later := &Message{Type: Prevote, Height: 3, Round: 0, BlockHash: "later"}
+	later.Sign(keys[1])
+	if err := b.Receive(later); err != nil {
+		t.Fatal(err)
+	}
+	_, outsider := newKey(t)
+	stranger := &Message{Type: Prevote, Height: 1, Round: 0}
+	stranger.Sign(outsider)
+	if err := b.Receive(stranger); err != ErrNotValidator {
+		t.Fatal("expected ErrNotValidator, got", err)
+	}
+
+	if err := b.Accept(committed(keys, 0, 1, 2)); err != nil {
+		t.Fatal(err)
+	}
+	if b.Height() != 2 {
+		t.Fatal("expected height 2, got", b.Height())
+	}
+	votes := b.prevotes[0]
+	if votes == nil || votes.count["next"] != 1 {
+		t.Fatal("the early prevote was not replayed at its height")
+	}
+	if len(b.next) != 0 {
+		t.Fatal("kept a message two heights ahead")
+	}
+}
+
+func TestBFTChecksProposalTime(t *testing.T) {
+	validators, keys := newValidators(t, 4)
+	b := newBFT(t, validators, nil)
+	now := time.Now().Unix()
+	parent := committedAt(keys, now-100, 0, 1, 2)
+	if err := b.Accept(parent); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name      string
+		timestamp int64
+		err       error
+	}{
+		{"same time as the parent", now - 100, ErrBadProposalTime},
+		{"before the height started", now - 50, ErrBadProposalTime},
+		{"too far ahead", now + 1000, ErrFutureBlock},
+		{"now", now, nil},
+	}
+	for round, c := range cases {
+		//Each case goes in a round of its own, proposed by that round's proposer
+		key := keys[(2+round)%len(keys)]
+		block, _ := build(coredatabase.NewState(nil), parent, nil, c.timestamp, key)
+		proposal := &Message{Type: Proposal, Height: 2, Round: uint32(round), BlockHash: block.Hash(), ValidRound: -1, Block: block}
+		proposal.Sign(key)
+		if err := b.Receive(proposal); err != c.err {
+			t.Errorf("%s: expected %v, got %v", c.name, c.err, err)
+		}
+	}
+}
+
+func TestBFTFinalizes(t *testing.T) {
+	validators, keys := newValidators(t, 4)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	//One validator of four is offline, which the rest can tolerate
+	var live []*BFT
+	for _, key := range keys[:3] {
+		live = append(live, newBFT(t, validators, key))
+	}
+	for i, b := range live {
+		i := i
+		b.Broadcast = func(message *Message) error {
+			for j, other := range live {
+				if j != i {
+					go other.Receive(message)
+				}
+			}
+			return nil
+		}
+		go b.Run(ctx)
+	}
+
+	const height = 3
+	deadline := time.Now().Add(20 * time.Second)
+	for time.Now().Before(deadline) {
+		done := true
+		for _, b := range live {
+			if b.chain.Height() < height {
+				done = false
+			}
+		}
+		if done {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	lagging := newBFT(t, validators, keys[3])
+	for h := uint64(1); h <= height; h++ {
+		block, err := live[0].chain.BlockAt(h)
+		if err != nil {
+			t.Fatal("validators did not reach height", height)
+		}
+		for _, b := range live[1:] {
+			other, err := b.chain.BlockAt(h)
+			if err != nil || other.Hash() != block.Hash() {
+				t.Fatal("validators finalized different blocks at height", h)
+			}
+		}
+		if err := VerifyCommit(validators, block); err != nil {
+			t.Fatal("block", h, err)
+		}
+
+		//The offline validator catches up from the final blocks
+		if h == height {
+			short := *block
+			short.Commit = &coredatabase.Commit{Round: block.Commit.Round, Signatures: block.Commit.Signatures[:validators.Quorum()-1]}
+			if err := lagging.Accept(&short); err != ErrBadCommit {
+				t.Fatal("expected ErrBadCommit, got", err)
+			}
+		}
+		if err := lagging.Accept(block); err != nil {
+			t.Fatal("catching up at", h, err)
+		}
+	}
+}
@@ -0,0 +1,216 @@
+package coreconsensus
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	coredatabase "github.com/jneubaum/honestvote.io/core/core-database/src"
+	coremempool "github.com/jneubaum/honestvote.io/core/core-mempool"
+)
+
+// Mode picks the consensus engine a network runs
+type Mode string
+
+// These constants are the consensus modes a node can run
+const (
+	ModePoA Mode = "poa"
+	ModeBFT Mode = "bft"
+)
+
+// These are the block limits used when none are configured
+const (
+	DefaultBlockInterval   = 5 * time.Second
+	DefaultMaxTransactions = 1000
+	DefaultMaxBlockBytes   = 1 << 20
+)
+
+// MaxClockDrift is how far ahead of our clock a block's timestamp may be
+const MaxClockDrift = 10 * time.Second
+
+var (
+	// ErrNotValidator is returned for blocks proposed by a key outside the validator set
+	ErrNotValidator = errors.New("coreconsensus: proposer is not a validator")
+	// ErrWrongTurn is returned for blocks proposed outside the proposer's slot
+	ErrWrongTurn = errors.New("coreconsensus: block proposed out of turn")
+	// ErrFutureBlock is returned for blocks timestamped too far ahead of our clock
+	ErrFutureBlock = errors.New("coreconsensus: block is from the future")
+	// ErrKnownBlock is returned for blocks already on the chain
+	ErrKnownBlock = errors.New("coreconsensus: block already on the chain")
+	// ErrStaleBlock is returned for blocks at a height the chain already has a different block for
+	ErrStaleBlock = errors.New("coreconsensus: chain already has a block at that height")
+	// ErrMissingParent is returned for blocks that do not build on a block we have
+	ErrMissingParent = errors.New("coreconsensus: block does not build on our chain")
+)
+
+// Engine decides which blocks join the chain
+type Engine interface {
+	// Run takes part in producing blocks until ctx is cancelled
+	Run(ctx context.Context)
+	// Accept adds a block another node produced to the chain
+	Accept(block *coredatabase.Block) error
+	// VerifyHeader checks what can be checked of a block from its header
+	// alone, which lets a syncing node weed out bad chains before it
+	// downloads them
+	VerifyHeader(prev, header coredatabase.BlockHeader) error
+}
+
+// ParseMode returns the mode named by name, PoA if it is empty
+func ParseMode(name string) (Mode, error) {
+	switch Mode(name) {
+	case "":
+		return ModePoA, nil
+	case ModePoA, ModeBFT:
+		return Mode(name), nil
+	}
+	return "", fmt.Errorf("coreconsensus: unknown consensus mode %q", name)
+}
+
+// Validators is the ordered set of keys allowed to propose blocks. Every
+// node on a network must be given the same set in the same order.
+type Validators []ed25519.PublicKey
+
+// Contains reports whether key is one of the validators
+func (v Validators) Contains(key ed25519.PublicKey) bool {
+	return v.index(key) >= 0
+}
+
+func (v Validators) index(key ed25519.PublicKey) int {
+	for i, validator := range v {
+		if bytes.Equal(validator, key) {
+			return i
+		}
+	}
+	return -1
+}
+
+// Proposer returns the validator whose turn it is in slot
+func (v Validators) Proposer(slot uint64) ed25519.PublicKey {
+	if len(v) == 0 {
+		return nil
+	}
+	return v[slot%uint64(len(v))]
+}
+
+// ledger is the chain, state and mempool an engine adds blocks to, along
+// with the recent history it needs to switch to another branch
+type ledger struct {
+	chain   *coredatabase.Chain
+	state   *coredatabase.State
+	mempool *coremempool.Mempool
+
+	//mu serializes changes to the chain and state
+	mu sync.Mutex
+
+	base       *coredatabase.State            // settled state, which side branches are replayed from
+	baseHeight uint64                         // height of the block base is the state after
+	side       map[string]*coredatabase.Block // recent blocks that are not on the chain, by hash
+}
+
+func newLedger(chain *coredatabase.Chain, state *coredatabase.State, mempool *coremempool.Mempool) ledger {
+	head := chain.Head()
+	return ledger{
+		chain:      chain,
+		state:      state,
+		mempool:    mempool,
+		base:       state.Copy(),
+		baseHeight: head.Height(),
+		side:       make(map[string]*coredatabase.Block),
+	}
+}
+
+// known sorts out blocks that are not the next one on the chain. The
+// caller must hold the lock.
+func (l *ledger) known(block *coredatabase.Block) error {
+	head := l.chain.Head()
+	if block.Height() <= head.Height() {
+		existing, err := l.chain.BlockAt(block.Height())
+		if err == nil && existing.Hash() == block.Hash() {
+			return ErrKnownBlock
+		}
+		return ErrStaleBlock
+	}
+	if block.Height() > head.Height()+1 || block.Header.PrevHash != head.Hash() {
+		return ErrMissingParent
+	}
+	return nil
+}
+
+// check makes sure block can follow the head and its transactions apply,
+// and returns the state after it without changing anything. The caller
+// must hold the lock.
+func (l *ledger) check(block *coredatabase.Block) (*coredatabase.State, error) {
+	return l.checkOn(l.chain.Head(), l.state, block)
+}
+
+// checkOn does the work of check for a block that follows prev, whose
+// state after it is given
+func (l *ledger) checkOn(prev *coredatabase.Block, state *coredatabase.State, block *coredatabase.Block) (*coredatabase.State, error) {
+	if err := coredatabase.ValidateLink(prev, block); err != nil {
+		return nil, err
+	}
+	if time.Unix(block.Header.Timestamp, 0).After(time.Now().Add(MaxClockDrift)) {
+		return nil, ErrFutureBlock
+	}
+	return state.After(block)
+}
+
+// commit applies block to the state and adds it to the chain. The caller
+// must hold the lock.
+func (l *ledger) commit(block *coredatabase.Block) error {
+	//Apply to a copy first so a block that fails to apply is never stored
+	next, err := l.check(block)
+	if err != nil {
+		return err
+	}
+	if err := l.chain.Append(block); err != nil {
+		return err
+	}
+	l.state.Adopt(next)
+	l.prune()
+
+	l.settle(nil, []*coredatabase.Block{block})
+	return nil
+}
+
+// settle brings the mempool in line with a change to the chain. The
+// transactions in added blocks leave the pool, and the ones in removed
+// blocks go back in if they still apply.
+func (l *ledger) settle(removed, added []*coredatabase.Block) {
+	included := make(map[string]bool)
+	var hashes []string
+	for _, block := range added {
+		for _, tx := range block.Transactions {
+			included[tx.Hash()] = true
+			hashes = append(hashes, tx.Hash())
+		}
+	}
+	l.mempool.Remove(hashes...)
+	l.mempool.Revalidate()
+
+	for _, block := range removed {
+		for _, tx := range block.Transactions {
+			if !included[tx.Hash()] {
+				l.mempool.Add(tx)
+			}
+		}
+	}
+}
+
+// build signs a block on top of the head from the mempool transactions that
+// still apply one after the other, along with the state root they lead to.
+// The caller must hold the lock.
+func (l *ledger) build(timestamp int64, key ed25519.PrivateKey, maxTransactions, maxBytes int) *coredatabase.Block {
+	scratch := l.state.Copy()
+	transactions := []coredatabase.Transaction{}
+	for _, tx := range l.mempool.Batch(maxTransactions, maxBytes) {
+		if scratch.Apply(tx, timestamp) == nil {
+			transactions = append(transactions, tx)
+		}
+	}
+	return coredatabase.NewBlock(l.chain.Head(), transactions, scratch.Root(), timestamp, key)
+}
@@ -0,0 +1,225 @@
+package coreconsensus
+
+import (
+	"errors"
+	"log"
+	"sort"
+
+	coredatabase "github.com/jneubaum/honestvote.io/core/core-database/src"
+)
+
+// MaxReorgDepth is how many blocks below the head a branch may fork off
+// and still replace the chain. Older history is treated as settled.
+const MaxReorgDepth = 32
+
+// MaxSideBlocks is how many blocks off the chain are kept at most. Past it
+// the lowest ones are forgotten, so a validator signing blocks on many
+// branches cannot make us hold on to all of them.
+const MaxSideBlocks = 64
+
+var (
+	// ErrSideBlock is returned for valid blocks that went on a branch the chain does not follow
+	ErrSideBlock = errors.New("coreconsensus: block is on a branch the chain does not follow")
+	// ErrConflictingCommit is returned for a final block that conflicts with one already on the chain
+	ErrConflictingCommit = errors.New("coreconsensus: conflicting final block, more than a third of validators are faulty")
+)
+
+// Prefer is the fork choice rule. It reports whether the branch ending in
+// tip should replace the chain ending in head: the longer branch wins, and
+// between two of the same length the one whose tip has the lower hash, so
+// every node settles on the same branch no matter which it saw first.
+func Prefer(tip, head *coredatabase.Block) bool {
+	if tip.Height() != head.Height() {
+		return tip.Height() > head.Height()
+	}
+	return tip.Hash() < head.Hash()
+}
+
+// fork records a block that does not build on the head. If it builds on a
+// recent block, on or off the chain, it is kept and the chain switches to
+// its branch when the fork choice rule prefers it. The caller must hold the
+// lock and have checked that block was made by the right validator.
+func (l *ledger) fork(block *coredatabase.Block) error {
+	if _, ok := l.side[block.Hash()]; ok {
+		return ErrKnownBlock
+	}
+	parent, err := l.recent(block.Header.PrevHash)
+	if err != nil {
+		return err
+	}
+	state, err := l.stateAt(parent)
+	if err != nil {
+		return err
+	}
+	next, err := l.checkOn(parent, state, block)
+	if err != nil {
+		return err
+	}
+	l.side[block.Hash()] = block
+
+	if !Prefer(block, l.chain.Head()) {
+		l.prune()
+		return ErrSideBlock
+	}
+	return l.reorganize(block, next)
+}
+
+// recent returns a block a branch may still fork off, from a side branch or
+// the chain no lower than the settled state. The caller must hold the lock.
+func (l *ledger) recent(hash string) (*coredatabase.Block, error) {
+	if block, ok := l.side[hash]; ok {
+		return block, nil
+	}
+	block, err := l.chain.Block(hash)
+	if err != nil || block.Height() < l.floor() {
+		return nil, ErrMissingParent
+	}
+	if onChain, err := l.chain.BlockAt(block.Height()); err != nil || onChain.Hash() != hash {
+		return nil, ErrMissingParent
+	}
+	return block, nil
+}
+
+// floor is the lowest chain block a branch may fork off. The caller must
+// hold the lock.
+func (l *ledger) floor() uint64 {
+	floor := l.baseHeight
+	if height := l.chain.Height(); height > MaxReorgDepth && height-MaxReorgDepth > floor {
+		floor = height - MaxReorgDepth
+	}
+	return floor
+}
+
+// branch returns the side blocks from where the branch ending in tip leaves
+// the chain up to tip, which is empty if tip is on the chain. The caller
+// must hold the lock.
+func (l *ledger) branch(tip *coredatabase.Block) ([]*coredatabase.Block, error) {
+	var branch []*coredatabase.Block
+	for block := tip; ; {
+		side, ok := l.side[block.Hash()]
+		if !ok {
+			return branch, nil
+		}
+		branch = append([]*coredatabase.Block{side}, branch...)
+		parent, err := l.recent(side.Header.PrevHash)
+		if err != nil {
+			return nil, err
+		}
+		block = parent
+	}
+}
+
+// stateAt rebuilds the state after a recent block. Only the head's and the
+// settled state are kept, so it replays the chain from the settled state to
+// where the block's branch leaves it, then the branch. The caller must hold
+// the lock.
+func (l *ledger) stateAt(block *coredatabase.Block) (*coredatabase.State, error) {
+	if block.Hash() == l.chain.Head().Hash() {
+		return l.state, nil
+	}
+	branch, err := l.branch(block)
+	if err != nil {
+		return nil, err
+	}
+	fork := block.Height()
+	if len(branch) > 0 {
+		fork = branch[0].Height() - 1
+	}
+	blocks, err := l.chainBlocks(l.baseHeight+1, fork)
+	if err != nil {
+		return nil, err
+	}
+	return l.base.After(append(blocks, branch...)...)
+}
+
+// chainBlocks returns the blocks on the chain from height from to height
+// to. The caller must hold the lock.
+func (l *ledger) chainBlocks(from, to uint64) ([]*coredatabase.Block, error) {
+	var blocks []*coredatabase.Block
+	for height := from; height <= to; height++ {
+		block, err := l.chain.BlockAt(height)
+		if err != nil {
+			return nil, err
+		}
+		blocks = append(blocks, block)
+	}
+	return blocks, nil
+}
+
+// reorganize switches the chain to the branch ending in tip, whose state
+// after it is given. The blocks it replaces go to the side branches and
+// transactions only the old branch had go back to the mempool. The caller
+// must hold the lock.
+func (l *ledger) reorganize(tip *coredatabase.Block, state *coredatabase.State) error {
+	branch, err := l.branch(tip)
+	if err != nil {
+		return err
+	}
+	ancestor := branch[0].Height() - 1
+
+	head := l.chain.Head()
+	removed, err := l.chainBlocks(ancestor+1, head.Height())
+	if err != nil {
+		return err
+	}
+
+	if err := l.chain.Reorganize(ancestor, branch); err != nil {
+		return err
+	}
+	l.state.Adopt(state)
+	for _, block := range removed {
+		l.side[block.Hash()] = block
+	}
+	for _, block := range branch {
+		delete(l.side, block.Hash())
+	}
+	log.Printf("Reorganized from block %d to block %d, forked at %d", head.Height(), tip.Height(), ancestor)
+	l.prune()
+
+	l.settle(removed, branch)
+	return nil
+}
+
+// prune moves the settled state up once the head is well past it, and
+// forgets side blocks too far below the head to be reorganized to along with
+// the lowest ones past MaxSideBlocks. The settled state stays between one
+// and two MaxReorgDepth below the head, so it moves only every
+// MaxReorgDepth blocks. The caller must hold the lock.
+func (l *ledger) prune() {
+	height := l.chain.Height()
+	if height >= l.baseHeight+2*MaxReorgDepth {
+		settled := height - MaxReorgDepth
+		blocks, err := l.chainBlocks(l.baseHeight+1, settled)
+		if err == nil {
+			var base *coredatabase.State
+			if base, err = l.base.After(blocks...); err == nil {
+				l.base, l.baseHeight = base, settled
+			}
+		}
+		if err != nil {
+			log.Printf("Could not settle the state at block %d: %v", settled, err)
+		}
+	}
+
+	floor := l.floor()
+	var kept []*coredatabase.Block
+	for hash, block := range l.side {
+		if block.Height() < floor {
+			delete(l.side, hash)
+		} else {
+			kept = append(kept, block)
+		}
+	}
+	if len(kept) <= MaxSideBlocks {
+		return
+	}
+	sort.Slice(kept, func(i, j int) bool {
+		if kept[i].Height() != kept[j].Height() {
+			return kept[i].Height() < kept[j].Height()
+		}
+		return kept[i].Hash() < kept[j].Hash()
+	})
+	for _, block := range kept[:len(kept)-MaxSideBlocks] {
+		delete(l.side, block.Hash())
+	}
+}
@@ -0,0 +1,179 @@
+package coreconsensus
+
+import (
+	"testing"
+	"time"
+
+	coredatabase "github.com/jneubaum/honestvote.io/core/core-database/src"
+)
+
+func TestPrefer(t *testing.T) {
+	_, key := newKey(t)
+	state := coredatabase.NewState(nil)
+	genesis := coredatabase.Genesis()
+	a, _ := build(state, genesis, nil, 1, key)
+	b, _ := build(state, genesis, nil, 2, key)
+	longer, _ := build(state, a, nil, 3, key)
+	low, high := a, b
+	if high.Hash() < low.Hash() {
+		low, high = high, low
+	}
+
+	cases := []struct {
+		name      string
+		tip, head *coredatabase.Block
+		want      bool
+	}{
+		{"longer branch", longer, b, true},
+		{"shorter branch", b, longer, false},
+		{"same length, lower hash", low, high, true},
+		{"same length, higher hash", high, low, false},
+		{"same block", a, a, false},
+	}
+	for _, c := range cases {
+		if got := Prefer(c.tip, c.head); got != c.want {
+			t.Errorf("%s: expected %v, got %v", c.name, c.want, got)
+		}
+	}
+}
+
+func TestReorganize(t *testing.T) {
+	public1, key1 := newKey(t)
+	public2, key2 := newKey(t)
+	admins, adminKey := newAdmin(t)
+	p := newPoA(t, Validators{public1, public2}, admins)
+	timestamp := slotOf(p)
+	genesis := coredatabase.NewState(admins)
+
+	tx := electionTx(t, adminKey, "e1", 1)
+	a1, a1State := build(genesis, coredatabase.Genesis(), []coredatabase.Transaction{tx}, timestamp, key1)
+	if err := p.Accept(a1); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := p.state.Election("e1"); !ok {
+		t.Fatal("did not apply the election")
+	}
+
+	//A competing first block is kept, and only taken if it wins the tie
+	b1, b1State := build(genesis, coredatabase.Genesis(), nil, timestamp+1, key2)
+	if err := p.Accept(b1); err != nil && err != ErrSideBlock {
+		t.Fatal(err)
+	}
+	want := a1
+	if Prefer(b1, a1) {
+		want = b1
+	}
+	if p.chain.Head().Hash() != want.Hash() {
+		t.Fatal("did not follow the fork choice rule between blocks of the same height")
+	}
+
+	b2, _ := build(b1State, b1, nil, timestamp+2, key1)
+	if err := p.Accept(b2); err != nil {
+		t.Fatal(err)
+	}
+	if p.chain.Head().Hash() != b2.Hash() || p.chain.Height() != 2 {
+		t.Fatal("did not switch to the longer branch")
+	}
+	if _, ok := p.state.Election("e1"); ok {
+		t.Fatal("kept the election from the replaced branch")
+	}
+	if p.state.Root() != b2.Header.StateRoot {
+		t.Fatal("state does not match the new head")
+	}
+	if p.mempool.Len() != 1 {
+		t.Fatal("the replaced branch's transaction did not go back to the mempool")
+	}
+	if err := p.chain.Verify(); err != nil {
+		t.Fatal(err)
+	}
+
+	//Growing the first branch past the second switches back to it, if the
+	//tie at height 2 has not already
+	a2, a2State := build(a1State, a1, nil, timestamp+3, key2)
+	if err := p.Accept(a2); err != nil && err != ErrSideBlock {
+		t.Fatal(err)
+	}
+	a3, _ := build(a2State, a2, nil, timestamp+4, key1)
+	if err := p.Accept(a3); err != nil {
+		t.Fatal(err)
+	}
+	if p.chain.Head().Hash() != a3.Hash() || p.chain.Height() != 3 {
+		t.Fatal("did not switch back to the first branch")
+	}
+	if _, ok := p.state.Election("e1"); !ok {
+		t.Fatal("did not apply the election again")
+	}
+	if p.mempool.Len() != 0 {
+		t.Fatal("kept a transaction that is on the chain again in the mempool")
+	}
+	if err := p.chain.Verify(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestForkLimits(t *testing.T) {
+	public, key := newKey(t)
+	p := newPoA(t, Validators{public}, nil)
+	root := coredatabase.NewState(nil).Root()
+	start := time.Now().Unix() - 10000
+
+	for height := int64(1); height <= 3*MaxReorgDepth; height++ {
+		block := coredatabase.NewBlock(p.chain.Head(), nil, root, start+10*height, key)
+		if err := p.Accept(block); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if p.baseHeight != 2*MaxReorgDepth || p.floor() != 2*MaxReorgDepth {
+		t.Fatalf("expected the state settled at %d, got %d", 2*MaxReorgDepth, p.baseHeight)
+	}
+
+	//Shorter branches off every recent block, more than are kept
+	added := 0
+	for height := p.floor(); added < MaxSideBlocks+10; height++ {
+		parent, err := p.chain.BlockAt(height)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for offset := int64(1); offset < 10 && added < MaxSideBlocks+10; offset++ {
+			side := coredatabase.NewBlock(parent, nil, root, parent.Header.Timestamp+offset, key)
+			if err := p.Accept(side); err != ErrSideBlock {
+				t.Fatal("expected ErrSideBlock, got", err)
+			}
+			added++
+		}
+	}
+	if len(p.side) != MaxSideBlocks {
+		t.Fatalf("expected %d side blocks, got %d", MaxSideBlocks, len(p.side))
+	}
+
+	settled, err := p.chain.BlockAt(p.floor() - 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	below := coredatabase.NewBlock(settled, nil, root, settled.Header.Timestamp+5, key)
+	if err := p.Accept(below); err != ErrMissingParent {
+		t.Fatal("expected ErrMissingParent for a fork below the settled state, got", err)
+	}
+
+	//A longer branch off a block above the side blocks takes over
+	tip, err := p.chain.BlockAt(p.chain.Height() - 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	head := p.chain.Height()
+	for tip.Height() <= head {
+		tip = coredatabase.NewBlock(tip, nil, root, tip.Header.Timestamp+15, key)
+		if err := p.Accept(tip); err != nil && err != ErrSideBlock {
+			t.Fatal(err)
+		}
+	}
+	if p.chain.Head().Hash() != tip.Hash() {
+		t.Fatal("did not switch to the longer branch")
+	}
+	if len(p.side) > MaxSideBlocks {
+		t.Fatal("kept", len(p.side), "side blocks after reorganizing")
+	}
+	if err := p.chain.Verify(); err != nil {
+		t.Fatal(err)
+	}
+}
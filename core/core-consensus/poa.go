@@ -0,0 +1,178 @@
+package coreconsensus
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"log"
+	"time"
+
+	coredatabase "github.com/jneubaum/honestvote.io/core/core-database/src"
+	coremempool "github.com/jneubaum/honestvote.io/core/core-mempool"
+)
+
+// PoA is proof-of-authority consensus. Time is cut into slots of one block
+// interval and the validators take turns owning them, so a validator that
+// is offline only costs the network its own slots. A block is accepted when
+// it is signed by the owner of the slot its timestamp falls in and comes
+// from a later slot than its parent.
+type PoA struct {
+	ledger
+	validators Validators
+	interval   time.Duration
+
+	// These are optional and must be set before Run. Key is this node's
+	// validator key, without it the node only follows the chain. Publish
+	// sends the blocks this node proposes to the network.
+	Key             ed25519.PrivateKey
+	Publish         func(block *coredatabase.Block) error
+	MaxTransactions int
+	MaxBlockBytes   int
+}
+
+// NewPoA returns consensus among validators that adds a block to chain at
+// most once every interval, applying it to state and clearing its
+// transactions out of mempool
+func NewPoA(validators Validators, interval time.Duration, chain *coredatabase.Chain, state *coredatabase.State, mempool *coremempool.Mempool) *PoA {
+	//Timestamps are in seconds so slots cannot be any shorter
+	if interval < time.Second {
+		interval = DefaultBlockInterval
+	}
+	return &PoA{
+		ledger:          newLedger(chain, state, mempool),
+		validators:      validators,
+		interval:        interval,
+		MaxTransactions: DefaultMaxTransactions,
+		MaxBlockBytes:   DefaultMaxBlockBytes,
+	}
+}
+
+// Slot returns the slot a unix timestamp falls in. Slots are counted in
+// nanoseconds like the ticks in Run, so an interval that is not a whole
+// number of seconds gives the same slots in both.
+func (p *PoA) Slot(timestamp int64) uint64 {
+	if timestamp < 0 {
+		return 0
+	}
+	return uint64(timestamp * int64(time.Second) / int64(p.interval))
+}
+
+// slotTime returns the first whole second in slot, which is the timestamp
+// a block proposed in the slot gets. Slots are at least a second long, so
+// every slot has one.
+func (p *PoA) slotTime(slot uint64) int64 {
+	start := int64(slot) * int64(p.interval)
+	return (start + int64(time.Second) - 1) / int64(time.Second)
+}
+
+// Verify checks that block may follow prev: it is signed by the validator
+// that owns its slot, the slot comes after prev's and the timestamp is not
+// in the future
+func (p *PoA) Verify(prev, block *coredatabase.Block) error {
+	if err := block.VerifySignature(); err != nil {
+		return err
+	}
+	if !p.validators.Contains(block.Header.Proposer) {
+		return ErrNotValidator
+	}
+	slot := p.Slot(block.Header.Timestamp)
+	if !bytes.Equal(p.validators.Proposer(slot), block.Header.Proposer) {
+		return ErrWrongTurn
+	}
+	//Genesis is not proposed by anyone, so it does not take up a slot
+	if prev.Height() > 0 && slot <= p.Slot(prev.Header.Timestamp) {
+		return ErrWrongTurn
+	}
+	if time.Unix(block.Header.Timestamp, 0).After(time.Now().Add(MaxClockDrift)) {
+		return ErrFutureBlock
+	}
+	return nil
+}
+
+// VerifyHeader runs Verify on the header of a block
+func (p *PoA) VerifyHeader(prev, header coredatabase.BlockHeader) error {
+	return p.Verify(&coredatabase.Block{Header: prev}, &coredatabase.Block{Header: header})
+}
+
+// Accept adds a block proposed by another validator to the chain. A block
+// that forks off a recent block is kept on a side branch, and the chain
+// switches to that branch once the fork choice rule prefers it.
+func (p *PoA) Accept(block *coredatabase.Block) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	err := p.known(block)
+	if err == nil {
+		if err := p.Verify(p.chain.Head(), block); err != nil {
+			return err
+		}
+		return p.commit(block)
+	}
+	if err != ErrStaleBlock && err != ErrMissingParent {
+		return err
+	}
+
+	parent, err := p.recent(block.Header.PrevHash)
+	if err != nil {
+		return err
+	}
+	if err := p.Verify(parent, block); err != nil {
+		return err
+	}
+	return p.fork(block)
+}
+
+// Run proposes a block at the start of every slot this node owns until ctx
+// is cancelled
+func (p *PoA) Run(ctx context.Context) {
+	if p.Key == nil || !p.validators.Contains(p.Key.Public().(ed25519.PublicKey)) {
+		return
+	}
+
+	for {
+		now := time.Now()
+		wait := p.interval - time.Duration(now.UnixNano()%int64(p.interval))
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+
+		slot := uint64(time.Now().UnixNano() / int64(p.interval))
+		block, err := p.propose(p.slotTime(slot))
+		if err != nil {
+			log.Println("Proposing block failed:", err)
+			continue
+		}
+		if block != nil && p.Publish != nil {
+			if err := p.Publish(block); err != nil {
+				log.Println("Publishing block failed:", err)
+			}
+		}
+	}
+}
+
+// propose builds, signs and commits a block for the slot timestamp falls
+// in if that slot is ours. Slots with nothing to put in a block are skipped.
+func (p *PoA) propose(timestamp int64) (*coredatabase.Block, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	slot := p.Slot(timestamp)
+	head := p.chain.Head()
+	if !bytes.Equal(p.validators.Proposer(slot), p.Key.Public().(ed25519.PublicKey)) {
+		return nil, nil
+	}
+	if head.Height() > 0 && slot <= p.Slot(head.Header.Timestamp) {
+		return nil, nil
+	}
+
+	block := p.build(timestamp, p.Key, p.MaxTransactions, p.MaxBlockBytes)
+	if len(block.Transactions) == 0 {
+		return nil, nil
+	}
+	if err := p.commit(block); err != nil {
+		return nil, err
+	}
+	return block, nil
+}
@@ -0,0 +1,237 @@
+package coreconsensus
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"testing"
+	"time"
+
+	coredatabase "github.com/jneubaum/honestvote.io/core/core-database/src"
+	corehttp "github.com/jneubaum/honestvote.io/core/core-http"
+	coremempool "github.com/jneubaum/honestvote.io/core/core-mempool"
+)
+
+// newKey makes a validator key
+func newKey(t *testing.T) (ed25519.PublicKey, ed25519.PrivateKey) {
+	t.Helper()
+
+	public, private, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return public, private
+}
+
+// newAdmin makes an administrator that may create elections
+func newAdmin(t *testing.T) ([]corehttp.Voter, ed25519.PrivateKey) {
+	t.Helper()
+
+	public, private := newKey(t)
+	return []corehttp.Voter{{ID: "admin", PublicKey: public, Permissions: corehttp.VoterPermissions{CanCreateElection: true}}}, private
+}
+
+// newPoA makes a PoA engine on an empty in-memory chain
+func newPoA(t *testing.T, validators Validators, admins []corehttp.Voter) *PoA {
+	t.Helper()
+
+	chain, err := coredatabase.NewChain(coredatabase.NewMemoryStore())
+	if err != nil {
+		t.Fatal(err)
+	}
+	state := coredatabase.NewState(admins)
+	return NewPoA(validators, time.Second, chain, state, coremempool.NewMempool(state.Check, 0, 0))
+}
+
+// electionTx makes a transaction from the admin creating election id
+func electionTx(t *testing.T, key ed25519.PrivateKey, id corehttp.ElectionID, nonce uint64) coredatabase.Transaction {
+	t.Helper()
+
+	election := &coredatabase.ElectionTransaction{
+		Creator: "admin",
+		Election: corehttp.Election{
+			ID:          id,
+			DisplayName: "Election",
+			TicketEntries: []corehttp.TicketEntry{{
+				ID:                       "president",
+				DisplayName:              "President",
+				AllowedElectionPositions: []corehttp.ElectionPositionID{corehttp.ElectionPositionID(id + "-p")},
+				Tickets: []corehttp.Ticket{{
+					ID:                      "t1",
+					ElectionPositionEntries: []corehttp.ElectionPositionEntry{{CandidateID: "c1", ElectionPositionID: corehttp.ElectionPositionID(id + "-p")}},
+				}},
+			}},
+		},
+		Positions: []corehttp.ElectionPosition{{ID: corehttp.ElectionPositionID(id + "-p"), DisplayName: "President"}},
+		Nonce:     nonce,
+	}
+	election.Sign(key)
+	tx, err := election.Transaction()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tx
+}
+
+// build makes a block on prev whose state root is the one state reaches
+// after txs, and returns that state too. Transactions that do not apply are
+// left out of the root, so blocks that must be rejected can be built.
+func build(state *coredatabase.State, prev *coredatabase.Block, txs []coredatabase.Transaction, timestamp int64, key ed25519.PrivateKey) (*coredatabase.Block, *coredatabase.State) {
+	next := state.Copy()
+	for _, tx := range txs {
+		next.Apply(tx, timestamp)
+	}
+	return coredatabase.NewBlock(prev, txs, next.Root(), timestamp, key), next
+}
+
+// slotOf returns a timestamp a few slots back whose slot belongs to the
+// first of two validators
+func slotOf(p *PoA) int64 {
+	timestamp := time.Now().Unix() - 20
+	if p.Slot(timestamp)%2 != 0 {
+		timestamp--
+	}
+	return timestamp
+}
+
+func TestPoAPropose(t *testing.T) {
+	public1, key1 := newKey(t)
+	public2, _ := newKey(t)
+	admins, adminKey := newAdmin(t)
+	validators := Validators{public1, public2}
+	proposer := newPoA(t, validators, admins)
+	proposer.Key = key1
+	follower := newPoA(t, validators, admins)
+
+	tx := electionTx(t, adminKey, "e1", 1)
+	if err := proposer.mempool.Add(tx); err != nil {
+		t.Fatal(err)
+	}
+	if err := follower.mempool.Add(tx); err != nil {
+		t.Fatal(err)
+	}
+
+	timestamp := slotOf(proposer)
+	if block, err := proposer.propose(timestamp + 1); err != nil || block != nil {
+		t.Fatal("proposed in another validator's slot:", block, err)
+	}
+	block, err := proposer.propose(timestamp)
+	if err != nil || block == nil {
+		t.Fatal("did not propose in its own slot:", err)
+	}
+	if proposer.mempool.Len() != 0 {
+		t.Fatal("proposer kept the included transaction in its mempool")
+	}
+	if _, ok := proposer.state.Election("e1"); !ok {
+		t.Fatal("proposer did not apply its own block")
+	}
+	if block, err := proposer.propose(timestamp); err != nil || block != nil {
+		t.Fatal("proposed twice in one slot:", block, err)
+	}
+
+	if err := follower.Accept(block); err != nil {
+		t.Fatal(err)
+	}
+	if follower.chain.Height() != 1 || follower.mempool.Len() != 0 {
+		t.Fatal("follower did not commit the block")
+	}
+	if err := follower.Accept(block); err != ErrKnownBlock {
+		t.Fatal("expected ErrKnownBlock, got", err)
+	}
+}
+
+func TestPoASlots(t *testing.T) {
+	public1, key1 := newKey(t)
+	public2, key2 := newKey(t)
+	_, outsider := newKey(t)
+	p := newPoA(t, Validators{public1, public2}, nil)
+	timestamp := slotOf(p)
+
+	first, state := build(p.state, coredatabase.Genesis(), nil, timestamp, key1)
+	if err := p.Accept(first); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name  string
+		block *coredatabase.Block
+		err   error
+	}{
+		{"wrong turn", coredatabase.NewBlock(first, nil, state.Root(), timestamp+1, key1), ErrWrongTurn},
+		{"same slot as parent", coredatabase.NewBlock(first, nil, state.Root(), timestamp, key1), ErrWrongTurn},
+		{"earlier slot than parent", coredatabase.NewBlock(first, nil, state.Root(), timestamp-1, key2), ErrWrongTurn},
+		{"not a validator", coredatabase.NewBlock(first, nil, state.Root(), timestamp+1, outsider), ErrNotValidator},
+		{"future", coredatabase.NewBlock(first, nil, state.Root(), timestamp+1000, key1), ErrFutureBlock},
+	}
+	for _, c := range cases {
+		if err := p.Accept(c.block); err != c.err {
+			t.Errorf("%s: expected %v, got %v", c.name, c.err, err)
+		}
+	}
+
+	next, _ := build(state, first, nil, timestamp+1, key2)
+	if err := p.Accept(next); err != nil {
+		t.Fatal(err)
+	}
+	if p.chain.Height() != 2 {
+		t.Fatal("expected height 2, got", p.chain.Height())
+	}
+}
+
+func TestPoASlotTimes(t *testing.T) {
+	intervals := []time.Duration{time.Second, 1500 * time.Millisecond, 2500 * time.Millisecond, 7 * time.Second}
+	for _, interval := range intervals {
+		p := &PoA{interval: interval}
+		for slot := uint64(1); slot < 1000; slot++ {
+			timestamp := p.slotTime(slot)
+			if got := p.Slot(timestamp); got != slot {
+				t.Fatalf("%v: the time of slot %d is in slot %d", interval, slot, got)
+			}
+			if p.Slot(timestamp-1) >= slot {
+				t.Fatalf("%v: slot %d has an earlier whole second", interval, slot)
+			}
+			if want := uint64(time.Unix(timestamp, 0).UnixNano() / int64(interval)); p.Slot(timestamp) != want {
+				t.Fatalf("%v: slot %d does not match the ticks in Run", interval, slot)
+			}
+		}
+	}
+}
+
+func TestPoARejectsBadBlocks(t *testing.T) {
+	public1, key1 := newKey(t)
+	public2, key2 := newKey(t)
+	admins, adminKey := newAdmin(t)
+	p := newPoA(t, Validators{public1, public2}, admins)
+	timestamp := slotOf(p)
+
+	tx := electionTx(t, adminKey, "e1", 1)
+	first, state := build(p.state, coredatabase.Genesis(), []coredatabase.Transaction{tx}, timestamp, key1)
+	if err := p.Accept(first); err != nil {
+		t.Fatal(err)
+	}
+
+	//Replaying the transaction fails its nonce check, so nothing of the
+	//block may be applied
+	replay, _ := build(state, first, []coredatabase.Transaction{tx, electionTx(t, adminKey, "e2", 2)}, timestamp+1, key2)
+	if err := p.Accept(replay); err == nil {
+		t.Fatal("accepted a block with a replayed transaction")
+	}
+	if _, ok := p.state.Election("e2"); ok {
+		t.Fatal("applied part of a rejected block")
+	}
+
+	wrongRoot := coredatabase.NewBlock(first, nil, coredatabase.NewState(nil).Root(), timestamp+1, key2)
+	if err := p.Accept(wrongRoot); !errors.Is(err, coredatabase.ErrBadStateRoot) {
+		t.Fatal("expected ErrBadStateRoot, got", err)
+	}
+	if p.chain.Height() != 1 {
+		t.Fatal("expected height 1, got", p.chain.Height())
+	}
+
+	restarted := coredatabase.NewState(admins)
+	if err := restarted.Replay(p.chain); err != nil {
+		t.Fatal(err)
+	}
+	if restarted.Root() != p.state.Root() {
+		t.Fatal("replaying the chain reached a different state")
+	}
+}
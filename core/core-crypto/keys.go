@@ -0,0 +1,61 @@
+package corecrypto
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// NonceSize is the number of random bytes in a handshake nonce
+const NonceSize = 32
+
+// ErrBadKeyFile is returned when a key file does not hold a valid key
+var ErrBadKeyFile = errors.New("corecrypto: key file does not contain an ed25519 seed")
+
+// GenerateKey creates a new identity key
+func GenerateKey() (ed25519.PrivateKey, error) {
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	return private, err
+}
+
+// LoadKey reads the identity key stored at path, creating and saving a new
+// one the first time the node starts
+func LoadKey(path string) (ed25519.PrivateKey, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		private, err := GenerateKey()
+		if err != nil {
+			return nil, err
+		}
+		seed := hex.EncodeToString(private.Seed())
+		return private, ioutil.WriteFile(path, []byte(seed+"\n"), 0600)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	seed, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(seed) != ed25519.SeedSize {
+		return nil, ErrBadKeyFile
+	}
+
+	return ed25519.NewKeyFromSeed(seed), nil
+}
+
+// NodeID derives the identifier other nodes know this key by
+func NodeID(public ed25519.PublicKey) string {
+	sum := sha256.Sum256(public)
+	return hex.EncodeToString(sum[:20])
+}
+
+// NewNonce returns fresh random bytes for a challenge
+func NewNonce() ([]byte, error) {
+	nonce := make([]byte, NonceSize)
+	_, err := rand.Read(nonce)
+	return nonce, err
+}
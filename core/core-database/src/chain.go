@@ -0,0 +1,167 @@
+package coredatabase
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+var (
+	// ErrNotFound is returned when a block is not in the store
+	ErrNotFound = errors.New("coredatabase: block not found")
+	// ErrBadLink is returned when a block does not follow the chain head
+	ErrBadLink = errors.New("coredatabase: block does not extend the chain")
+	// ErrBadMerkleRoot is returned when a header does not commit to the block's transactions
+	ErrBadMerkleRoot = errors.New("coredatabase: merkle root does not match transactions")
+	// ErrBadTimestamp is returned for blocks older than their parent
+	ErrBadTimestamp = errors.New("coredatabase: block is older than its parent")
+	// ErrBadGenesis is returned when a store starts with a different genesis block
+	ErrBadGenesis = errors.New("coredatabase: store has a different genesis block")
+)
+
+// BlockStore keeps blocks. Chain is the only thing that writes to it, so
+// stores can trust that blocks arrive in height order.
+type BlockStore interface {
+	Put(block *Block) error
+	// PutBranch replaces the blocks at the heights of branch all at once, so
+	// a crash part way through a reorganization cannot leave a chain that
+	// switches branches half way up
+	PutBranch(branch []*Block) error
+	ByHash(hash string) (*Block, error)
+	ByHeight(height uint64) (*Block, error)
+	// Head returns the highest block, or ErrNotFound for an empty store
+	Head() (*Block, error)
+}
+
+// Chain is the hash-linked list of blocks that makes up the ledger
+type Chain struct {
+	mu    sync.RWMutex
+	store BlockStore
+	head  *Block
+}
+
+// NewChain opens the chain kept in store, writing the genesis block if the
+// store is empty
+func NewChain(store BlockStore) (*Chain, error) {
+	head, err := store.Head()
+	if err == ErrNotFound {
+		head = Genesis()
+		err = store.Put(head)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	genesis, err := store.ByHeight(0)
+	if err != nil {
+		return nil, err
+	}
+	if genesis.Hash() != Genesis().Hash() {
+		return nil, ErrBadGenesis
+	}
+
+	return &Chain{store: store, head: head}, nil
+}
+
+// Head returns the newest block
+func (c *Chain) Head() *Block {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return c.head
+}
+
+// Height returns the height of the newest block
+func (c *Chain) Height() uint64 {
+	return c.Head().Height()
+}
+
+// Block returns the block with the given hash
+func (c *Chain) Block(hash string) (*Block, error) {
+	return c.store.ByHash(hash)
+}
+
+// BlockAt returns the block at height
+func (c *Chain) BlockAt(height uint64) (*Block, error) {
+	return c.store.ByHeight(height)
+}
+
+// Append validates block against the head and adds it to the chain
+func (c *Chain) Append(block *Block) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := ValidateLink(c.head, block); err != nil {
+		return err
+	}
+	if err := c.store.Put(block); err != nil {
+		return err
+	}
+	c.head = block
+	return nil
+}
+
+// Reorganize replaces the blocks above height with branch, which must
+// build on the block at height. The branch has to reach at least as high as
+// the current head so that every block it replaces is overwritten.
+func (c *Chain) Reorganize(height uint64, branch []*Block) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(branch) == 0 || height+uint64(len(branch)) < c.head.Height() {
+		return ErrBadLink
+	}
+	prev, err := c.store.ByHeight(height)
+	if err != nil {
+		return err
+	}
+	for _, block := range branch {
+		if err := ValidateLink(prev, block); err != nil {
+			return err
+		}
+		prev = block
+	}
+
+	if err := c.store.PutBranch(branch); err != nil {
+		return err
+	}
+	c.head = branch[len(branch)-1]
+	return nil
+}
+
+// Verify walks the whole chain from genesis and checks every link
+func (c *Chain) Verify() error {
+	head := c.Head()
+
+	prev, err := c.store.ByHeight(0)
+	if err != nil {
+		return err
+	}
+	for height := uint64(1); height <= head.Height(); height++ {
+		block, err := c.store.ByHeight(height)
+		if err != nil {
+			return err
+		}
+		if err := ValidateLink(prev, block); err != nil {
+			return fmt.Errorf("block %d: %v", height, err)
+		}
+		prev = block
+	}
+	return nil
+}
+
+// ValidateLink checks that block can follow prev: the height and previous
+// hash line up, the Merkle root matches the transactions, time does not go
+// backwards and the proposer signed it
+func ValidateLink(prev, block *Block) error {
+	if block.Header.Height != prev.Header.Height+1 || block.Header.PrevHash != prev.Hash() {
+		return ErrBadLink
+	}
+	if block.Header.MerkleRoot != TransactionRoot(block.Transactions) {
+		return ErrBadMerkleRoot
+	}
+	if block.Header.Timestamp < prev.Header.Timestamp {
+		return ErrBadTimestamp
+	}
+	return block.VerifySignature()
+}
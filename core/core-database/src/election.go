@@ -0,0 +1,135 @@
+package coredatabase
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+
+	corehttp "github.com/jneubaum/honestvote.io/core/core-http"
+)
+
+// ErrBadElection is returned for election transactions that are malformed
+var ErrBadElection = errors.New("coredatabase: malformed election")
+
+// ElectionTransaction creates an election. It carries the whole election
+// along with the positions its ticket entries refer to, and has to be
+// signed by a voter allowed to create elections, who then manages it.
+type ElectionTransaction struct {
+	Creator   corehttp.VoterID            `json:"creator"`
+	Election  corehttp.Election           `json:"election"`
+	Positions []corehttp.ElectionPosition `json:"positions"`
+	Nonce     uint64                      `json:"nonce"`
+	Timestamp int64                       `json:"timestamp"` // unix seconds
+	Signature []byte                      `json:"signature,omitempty"`
+}
+
+func (e ElectionTransaction) signingBytes() []byte {
+	e.Signature = nil
+	data, _ := json.Marshal(e)
+	return append([]byte("honestvote election "), data...)
+}
+
+// Sign signs the transaction with the creator's key
+func (e *ElectionTransaction) Sign(key ed25519.PrivateKey) {
+	e.Signature = ed25519.Sign(key, e.signingBytes())
+}
+
+// Validate checks that the election is complete and consistent: every ID
+// is set and unique, ticket entries only use positions that are defined,
+// tickets only fill positions their entry allows, and nobody has voted yet
+func (e *ElectionTransaction) Validate() error {
+	election := e.Election
+	if e.Creator == "" || election.ID == "" || election.DisplayName == "" || len(election.TicketEntries) == 0 {
+		return ErrBadElection
+	}
+	if election.Type < corehttp.FirstPastThePost || election.Type > corehttp.MultiRunoff {
+		return ErrBadElection
+	}
+	if election.End != 0 && election.End <= election.Start {
+		return ErrBadElection
+	}
+
+	positions := make(map[corehttp.ElectionPositionID]bool)
+	for _, position := range e.Positions {
+		if position.ID == "" || position.DisplayName == "" || positions[position.ID] {
+			return ErrBadElection
+		}
+		positions[position.ID] = true
+	}
+
+	entries := make(map[corehttp.TicketEntryID]bool)
+	tickets := make(map[corehttp.TicketID]bool)
+	running := make(map[corehttp.CandidateID]bool)
+	for _, entry := range election.TicketEntries {
+		if entry.ID == "" || entry.DisplayName == "" || entries[entry.ID] {
+			return ErrBadElection
+		}
+		entries[entry.ID] = true
+
+		if len(entry.AllowedElectionPositions) == 0 || len(entry.Tickets) == 0 {
+			return ErrBadElection
+		}
+		allowed := make(map[corehttp.ElectionPositionID]bool)
+		for _, position := range entry.AllowedElectionPositions {
+			if !positions[position] {
+				return ErrBadElection
+			}
+			allowed[position] = true
+		}
+
+		for _, ticket := range entry.Tickets {
+			if ticket.ID == "" || tickets[ticket.ID] || len(ticket.ElectionPositionEntries) == 0 || len(ticket.Votes) != 0 {
+				return ErrBadElection
+			}
+			tickets[ticket.ID] = true
+
+			for _, candidate := range ticket.ElectionPositionEntries {
+				if candidate.CandidateID == "" || !allowed[candidate.ElectionPositionID] {
+					return ErrBadElection
+				}
+				if running[candidate.CandidateID] && !election.Options.CandidateCanRunForMultiple {
+					return ErrBadElection
+				}
+				running[candidate.CandidateID] = true
+			}
+		}
+	}
+	return nil
+}
+
+// Verify checks that the transaction is well formed and signed with the
+// key the creator registered
+func (e *ElectionTransaction) Verify(keys VoterKeys) error {
+	if err := e.Validate(); err != nil {
+		return err
+	}
+	key, err := keys.VoterKey(e.Creator)
+	if err != nil {
+		return err
+	}
+	if !ed25519.Verify(key, e.signingBytes(), e.Signature) {
+		return ErrBadSignature
+	}
+	return nil
+}
+
+// Transaction wraps the election for the ledger
+func (e *ElectionTransaction) Transaction() (Transaction, error) {
+	payload, err := json.Marshal(e)
+	if err != nil {
+		return Transaction{}, err
+	}
+	return Transaction{Type: TransactionElection, Payload: payload}, nil
+}
+
+// DecodeElection unwraps an election transaction
+func DecodeElection(tx Transaction) (*ElectionTransaction, error) {
+	if tx.Type != TransactionElection {
+		return nil, ErrWrongType
+	}
+	var election ElectionTransaction
+	if err := json.Unmarshal(tx.Payload, &election); err != nil {
+		return nil, err
+	}
+	return &election, nil
+}
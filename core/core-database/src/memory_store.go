@@ -0,0 +1,90 @@
+package coredatabase
+
+import "sync"
+
+// MemoryStore is a BlockStore that keeps everything in memory
+type MemoryStore struct {
+	mu       sync.RWMutex
+	byHash   map[string]*Block
+	byHeight []*Block
+}
+
+// NewMemoryStore returns an empty MemoryStore
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{byHash: make(map[string]*Block)}
+}
+
+// Put stores block, replacing any block already at its height
+func (s *MemoryStore) Put(block *Block) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.put(block)
+}
+
+// PutBranch stores every block in branch, which must be in height order
+func (s *MemoryStore) PutBranch(branch []*Block) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	//Check the whole branch fits before changing anything
+	if len(branch) > 0 && int(branch[0].Height()) > len(s.byHeight) {
+		return ErrBadLink
+	}
+	for _, block := range branch {
+		if err := s.put(block); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// put does the work of Put. The caller must hold the lock.
+func (s *MemoryStore) put(block *Block) error {
+	height := int(block.Height())
+	if height > len(s.byHeight) {
+		return ErrBadLink
+	}
+	if height < len(s.byHeight) {
+		delete(s.byHash, s.byHeight[height].Hash())
+		s.byHeight[height] = block
+	} else {
+		s.byHeight = append(s.byHeight, block)
+	}
+	s.byHash[block.Hash()] = block
+	return nil
+}
+
+// ByHash returns the block with the given hash
+func (s *MemoryStore) ByHash(hash string) (*Block, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	block, ok := s.byHash[hash]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return block, nil
+}
+
+// ByHeight returns the block at height
+func (s *MemoryStore) ByHeight(height uint64) (*Block, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if height >= uint64(len(s.byHeight)) {
+		return nil, ErrNotFound
+	}
+	return s.byHeight[height], nil
+}
+
+// Head returns the highest block
+func (s *MemoryStore) Head() (*Block, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if len(s.byHeight) == 0 {
+		return nil, ErrNotFound
+	}
+	return s.byHeight[len(s.byHeight)-1], nil
+}
@@ -0,0 +1,68 @@
+package coredatabase
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+)
+
+// These prefixes keep a leaf from ever hashing the same as an inner node,
+// so a list of leaves cannot pass for a shorter tree's inner level
+const (
+	leafPrefix  = 0x00
+	innerPrefix = 0x01
+)
+
+// TransactionRoot is the Merkle root of the transactions' hashes
+func TransactionRoot(transactions []Transaction) string {
+	leaves := make([][]byte, len(transactions))
+	for i, tx := range transactions {
+		leaves[i] = tx.sum()
+	}
+	return merkleRoot(leaves)
+}
+
+// MerkleRoot is the root of the tree over the hex encoded leaves. It fails
+// if a leaf is not hex.
+func MerkleRoot(leaves []string) (string, error) {
+	decoded := make([][]byte, len(leaves))
+	for i, leaf := range leaves {
+		var err error
+		if decoded[i], err = hex.DecodeString(leaf); err != nil {
+			return "", err
+		}
+	}
+	return merkleRoot(decoded), nil
+}
+
+// merkleRoot hashes each leaf, then hashes the nodes together in pairs
+// until one is left. A level with an odd number of nodes moves the last one
+// up as it is rather than pairing it with itself, so repeating the last
+// leaves gives a different root. An empty tree has the hash of nothing as
+// its root.
+func merkleRoot(leaves [][]byte) string {
+	if len(leaves) == 0 {
+		sum := sha256.Sum256(nil)
+		return hex.EncodeToString(sum[:])
+	}
+
+	level := make([][]byte, len(leaves))
+	for i, leaf := range leaves {
+		sum := sha256.Sum256(append([]byte{leafPrefix}, leaf...))
+		level[i] = sum[:]
+	}
+
+	for len(level) > 1 {
+		next := make([][]byte, 0, (len(level)+1)/2)
+		for i := 0; i+1 < len(level); i += 2 {
+			data := append(append([]byte{innerPrefix}, level[i]...), level[i+1]...)
+			sum := sha256.Sum256(data)
+			next = append(next, sum[:])
+		}
+		if len(level)%2 == 1 {
+			next = append(next, level[len(level)-1])
+		}
+		level = next
+	}
+
+	return hex.EncodeToString(level[0])
+}
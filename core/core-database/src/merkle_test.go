@@ -0,0 +1,72 @@
+package coredatabase
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"testing"
+)
+
+func leaf(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+func TestMerkleRoot(t *testing.T) {
+	a, b, c := leaf("a"), leaf("b"), leaf("c")
+
+	//The inner node over a and b must not pass for a leaf
+	inner := sha256.Sum256(append(append([]byte{innerPrefix}, leafHash(a)...), leafHash(b)...))
+	innerHex := hex.EncodeToString(inner[:])
+
+	roots := make(map[string]string)
+	cases := map[string][]string{
+		"one":              {a},
+		"two":              {a, b},
+		"three":            {a, b, c},
+		"last repeated":    {a, b, c, c},
+		"swapped":          {b, a},
+		"inner as leaf":    {innerHex},
+		"inner and leaves": {innerHex, c},
+	}
+	for name, leaves := range cases {
+		root, err := MerkleRoot(leaves)
+		if err != nil {
+			t.Fatal(name, err)
+		}
+		for other, seen := range roots {
+			if seen == root {
+				t.Errorf("%s and %s have the same root", name, other)
+			}
+		}
+		roots[name] = root
+	}
+
+	again, _ := MerkleRoot([]string{a, b, c})
+	if again != roots["three"] {
+		t.Error("the same leaves gave different roots")
+	}
+	if _, err := MerkleRoot([]string{a, "not hex"}); err == nil {
+		t.Error("accepted a leaf that is not hex")
+	}
+	empty, _ := MerkleRoot(nil)
+	if empty != TransactionRoot(nil) {
+		t.Error("an empty tree has two roots")
+	}
+}
+
+func TestTransactionRootRepeatedTransaction(t *testing.T) {
+	txs := []Transaction{
+		{Type: TransactionVote, Payload: []byte(`{"n":1}`)},
+		{Type: TransactionVote, Payload: []byte(`{"n":2}`)},
+		{Type: TransactionVote, Payload: []byte(`{"n":3}`)},
+	}
+	if TransactionRoot(txs) == TransactionRoot(append(txs, txs[2])) {
+		t.Fatal("repeating the last transaction kept the root")
+	}
+}
+
+func leafHash(hexLeaf string) []byte {
+	data, _ := hex.DecodeString(hexLeaf)
+	sum := sha256.Sum256(append([]byte{leafPrefix}, data...))
+	return sum[:]
+}
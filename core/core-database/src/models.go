@@ -0,0 +1,172 @@
+package coredatabase
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	corehttp "github.com/jneubaum/honestvote.io/core/core-http"
+)
+
+// ErrBadSignature is returned for blocks and transactions whose signature does not verify
+var ErrBadSignature = errors.New("coredatabase: bad signature")
+
+// TransactionType says what a transaction does to the ledger
+type TransactionType string
+
+// These constants are the kinds of transaction recorded on the chain
+const (
+	TransactionElection     TransactionType = "election"
+	TransactionVote         TransactionType = "vote"
+	TransactionRegistration TransactionType = "registration"
+)
+
+// Transaction is one change to the ledger. Payload holds the typed
+// transaction for Type, such as an election or a vote.
+type Transaction struct {
+	Type    TransactionType `json:"type"`
+	Payload json.RawMessage `json:"payload"`
+}
+
+// Hash identifies the transaction. A payload that is not valid JSON cannot
+// be marshalled, so such a transaction is hashed from its raw bytes instead,
+// which still gives it a hash of its own.
+func (tx Transaction) Hash() string {
+	return hex.EncodeToString(tx.sum())
+}
+
+// sum is the hash behind Hash
+func (tx Transaction) sum() []byte {
+	data, err := json.Marshal(tx)
+	if err != nil {
+		hash := sha256.New()
+		fmt.Fprintf(hash, "%d:%s%d:", len(tx.Type), tx.Type, len(tx.Payload))
+		hash.Write(tx.Payload)
+		return hash.Sum(nil)
+	}
+	sum := sha256.Sum256(data)
+	return sum[:]
+}
+
+// Signer returns who signed tx and the nonce they used
+func (tx Transaction) Signer() (corehttp.VoterID, uint64, error) {
+	switch tx.Type {
+	case TransactionVote:
+		vote, err := DecodeVote(tx)
+		if err != nil {
+			return "", 0, err
+		}
+		return vote.VoterID, vote.Nonce, nil
+	case TransactionElection:
+		election, err := DecodeElection(tx)
+		if err != nil {
+			return "", 0, err
+		}
+		return election.Creator, election.Nonce, nil
+	case TransactionRegistration:
+		registration, err := DecodeRegistration(tx)
+		if err != nil {
+			return "", 0, err
+		}
+		return registration.Manager, registration.Nonce, nil
+	}
+	return "", 0, ErrWrongType
+}
+
+// BlockHeader links a block to the one before it and commits to its
+// transactions and the state they lead to. The proposer signs the header hash.
+type BlockHeader struct {
+	Height     uint64            `json:"height"`
+	PrevHash   string            `json:"prevHash"`
+	MerkleRoot string            `json:"merkleRoot"`
+	StateRoot  string            `json:"stateRoot,omitempty"` // root of the state after the block, empty for genesis
+	Timestamp  int64             `json:"timestamp"`           // unix seconds
+	Proposer   ed25519.PublicKey `json:"proposer,omitempty"`
+	Signature  []byte            `json:"signature,omitempty"`
+}
+
+// Hash identifies the block. It covers every header field except the
+// signature, which is made over the hash.
+func (h BlockHeader) Hash() string {
+	h.Signature = nil
+	data, _ := json.Marshal(h)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// Block is a header and the transactions it commits to. Under BFT
+// consensus it also carries the commit that finalized it, which is not
+// covered by the block hash.
+type Block struct {
+	Header       BlockHeader   `json:"header"`
+	Transactions []Transaction `json:"transactions"`
+	Commit       *Commit       `json:"commit,omitempty"`
+}
+
+// Commit is the set of precommit signatures from validators that made a
+// block final in the given consensus round
+type Commit struct {
+	Round      uint32            `json:"round"`
+	Signatures []CommitSignature `json:"signatures"`
+}
+
+// CommitSignature is one validator's precommit for a block
+type CommitSignature struct {
+	Validator ed25519.PublicKey `json:"validator"`
+	Signature []byte            `json:"signature"`
+}
+
+// NewBlock builds the block that follows prev and signs it with the
+// proposer's key. StateRoot is the root of the state once the transactions
+// are applied.
+func NewBlock(prev *Block, transactions []Transaction, stateRoot string, timestamp int64, key ed25519.PrivateKey) *Block {
+	block := &Block{
+		Header: BlockHeader{
+			Height:     prev.Header.Height + 1,
+			PrevHash:   prev.Hash(),
+			MerkleRoot: TransactionRoot(transactions),
+			StateRoot:  stateRoot,
+			Timestamp:  timestamp,
+			Proposer:   key.Public().(ed25519.PublicKey),
+		},
+		Transactions: transactions,
+	}
+	block.Header.Signature = ed25519.Sign(key, []byte(block.Hash()))
+	return block
+}
+
+// Genesis is the first block of every chain. It is fixed so that all nodes
+// start from the same one.
+func Genesis() *Block {
+	return &Block{
+		Header: BlockHeader{
+			MerkleRoot: TransactionRoot(nil),
+		},
+		Transactions: []Transaction{},
+	}
+}
+
+// Hash identifies the block
+func (b *Block) Hash() string {
+	return b.Header.Hash()
+}
+
+// Height is the number of blocks before this one
+func (b *Block) Height() uint64 {
+	return b.Header.Height
+}
+
+// VerifySignature checks that the proposer signed the block. The genesis
+// block has no proposer and is not signed.
+func (b *Block) VerifySignature() error {
+	if b.Header.Height == 0 {
+		return nil
+	}
+	if len(b.Header.Proposer) != ed25519.PublicKeySize || !ed25519.Verify(b.Header.Proposer, []byte(b.Hash()), b.Header.Signature) {
+		return ErrBadSignature
+	}
+	return nil
+}
@@ -0,0 +1,169 @@
+package coredatabase
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// MongoTimeout bounds every MongoDB operation
+const MongoTimeout = 10 * time.Second
+
+// MongoStore is a BlockStore that keeps one document per block in a MongoDB
+// collection, keyed by height
+type MongoStore struct {
+	ctx          context.Context
+	collection   *mongo.Collection
+	transactions bool // whether the server runs multi-document transactions
+}
+
+type blockDocument struct {
+	Height uint64 `bson:"_id"`
+	Hash   string `bson:"hash"`
+	Block  []byte `bson:"block"` // JSON, so the hashes are computed over exactly what was stored
+}
+
+// NewMongoStore returns a store backed by collection. Operations are
+// cancelled when ctx is.
+func NewMongoStore(ctx context.Context, collection *mongo.Collection) (*MongoStore, error) {
+	setupCtx, cancel := context.WithTimeout(ctx, MongoTimeout)
+	defer cancel()
+
+	_, err := collection.Indexes().CreateOne(setupCtx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "hash", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	transactions, err := supportsTransactions(setupCtx, collection.Database().Client())
+	if err != nil {
+		return nil, err
+	}
+	if !transactions {
+		log.Println("MongoDB is a standalone server, so a crash while switching branches can leave the stored chain half switched. Run it as a replica set, even one of a single member, to make branch switches atomic.")
+	}
+	return &MongoStore{ctx: ctx, collection: collection, transactions: transactions}, nil
+}
+
+// supportsTransactions reports whether the server is a replica set member
+// or a sharded cluster router, the only deployments that run transactions
+func supportsTransactions(ctx context.Context, client *mongo.Client) (bool, error) {
+	var hello struct {
+		SetName string `bson:"setName"`
+		Msg     string `bson:"msg"`
+	}
+	admin := client.Database("admin")
+	err := admin.RunCommand(ctx, bson.D{{Key: "hello", Value: 1}}).Decode(&hello)
+	if err != nil {
+		//Servers before 4.4.2 only know the older name
+		err = admin.RunCommand(ctx, bson.D{{Key: "isMaster", Value: 1}}).Decode(&hello)
+	}
+	if err != nil {
+		return false, err
+	}
+	return hello.SetName != "" || hello.Msg == "isdbgrid", nil
+}
+
+// Put stores block, replacing any block already at its height
+func (s *MongoStore) Put(block *Block) error {
+	data, err := json.Marshal(block)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(s.ctx, MongoTimeout)
+	defer cancel()
+
+	document := blockDocument{Height: block.Height(), Hash: block.Hash(), Block: data}
+	_, err = s.collection.ReplaceOne(ctx, bson.M{"_id": document.Height}, document, options.Replace().SetUpsert(true))
+	return err
+}
+
+// PutBranch stores every block in branch in a single transaction. MongoDB
+// only runs transactions on a replica set, even one of a single member. On
+// a standalone server the blocks are written one at a time from the lowest,
+// which is not atomic.
+func (s *MongoStore) PutBranch(branch []*Block) error {
+	documents := make([]blockDocument, len(branch))
+	for i, block := range branch {
+		data, err := json.Marshal(block)
+		if err != nil {
+			return err
+		}
+		documents[i] = blockDocument{Height: block.Height(), Hash: block.Hash(), Block: data}
+	}
+
+	ctx, cancel := context.WithTimeout(s.ctx, MongoTimeout)
+	defer cancel()
+
+	if !s.transactions {
+		for _, document := range documents {
+			if _, err := s.collection.ReplaceOne(ctx, bson.M{"_id": document.Height}, document, options.Replace().SetUpsert(true)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	session, err := s.collection.Database().Client().StartSession()
+	if err != nil {
+		return err
+	}
+	defer session.EndSession(ctx)
+
+	_, err = session.WithTransaction(ctx, func(sc mongo.SessionContext) (interface{}, error) {
+		for _, document := range documents {
+			if _, err := s.collection.ReplaceOne(sc, bson.M{"_id": document.Height}, document, options.Replace().SetUpsert(true)); err != nil {
+				return nil, err
+			}
+		}
+		return nil, nil
+	})
+	return err
+}
+
+// ByHash returns the block with the given hash
+func (s *MongoStore) ByHash(hash string) (*Block, error) {
+	return s.find(bson.M{"hash": hash}, nil)
+}
+
+// ByHeight returns the block at height
+func (s *MongoStore) ByHeight(height uint64) (*Block, error) {
+	return s.find(bson.M{"_id": height}, nil)
+}
+
+// Head returns the highest block
+func (s *MongoStore) Head() (*Block, error) {
+	return s.find(bson.M{}, options.FindOne().SetSort(bson.D{{Key: "_id", Value: -1}}))
+}
+
+func (s *MongoStore) find(filter bson.M, findOptions *options.FindOneOptions) (*Block, error) {
+	ctx, cancel := context.WithTimeout(s.ctx, MongoTimeout)
+	defer cancel()
+
+	if findOptions == nil {
+		findOptions = options.FindOne()
+	}
+
+	var document blockDocument
+	err := s.collection.FindOne(ctx, filter, findOptions).Decode(&document)
+	if err == mongo.ErrNoDocuments {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var block Block
+	if err := json.Unmarshal(document.Block, &block); err != nil {
+		return nil, err
+	}
+	return &block, nil
+}
@@ -0,0 +1,111 @@
+package coredatabase
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+
+	corehttp "github.com/jneubaum/honestvote.io/core/core-http"
+)
+
+// ErrBadRegistration is returned for registration transactions that are malformed
+var ErrBadRegistration = errors.New("coredatabase: malformed registration")
+
+// RegistrationAction is what a registration transaction does
+type RegistrationAction string
+
+// These constants are the registration actions a manager can take
+const (
+	RegisterVoter     RegistrationAction = "registerVoter"
+	GrantVote         RegistrationAction = "grantVote"
+	RevokeVote        RegistrationAction = "revokeVote"
+	RegisterCandidate RegistrationAction = "registerCandidate"
+)
+
+// RegistrationTransaction is signed by the manager of an election to
+// register the key a voter signs with in the election, let a voter vote in
+// the election or stop them, or let a candidate run in it
+type RegistrationTransaction struct {
+	Manager    corehttp.VoterID    `json:"manager"`
+	ElectionID corehttp.ElectionID `json:"electionId"`
+	Action     RegistrationAction  `json:"action"`
+	VoterID    corehttp.VoterID    `json:"voterId,omitempty"`
+	PublicKey  []byte              `json:"publicKey,omitempty"` // registerVoter only
+	Candidate  *corehttp.Candidate `json:"candidate,omitempty"` // registerCandidate only
+	Nonce      uint64              `json:"nonce"`
+	Timestamp  int64               `json:"timestamp"` // unix seconds
+	Signature  []byte              `json:"signature,omitempty"`
+}
+
+func (r RegistrationTransaction) signingBytes() []byte {
+	r.Signature = nil
+	data, _ := json.Marshal(r)
+	return append([]byte("honestvote registration "), data...)
+}
+
+// Sign signs the transaction with the manager's key
+func (r *RegistrationTransaction) Sign(key ed25519.PrivateKey) {
+	r.Signature = ed25519.Sign(key, r.signingBytes())
+}
+
+// Validate checks that the transaction has what its action needs
+func (r *RegistrationTransaction) Validate() error {
+	if r.Manager == "" || r.ElectionID == "" {
+		return ErrBadRegistration
+	}
+
+	switch r.Action {
+	case RegisterVoter:
+		if r.VoterID == "" || len(r.PublicKey) != ed25519.PublicKeySize || r.Candidate != nil {
+			return ErrBadRegistration
+		}
+	case GrantVote, RevokeVote:
+		if r.VoterID == "" || r.PublicKey != nil || r.Candidate != nil {
+			return ErrBadRegistration
+		}
+	case RegisterCandidate:
+		if r.Candidate == nil || r.Candidate.ID == "" || r.Candidate.DisplayName == "" || r.VoterID != "" || r.PublicKey != nil {
+			return ErrBadRegistration
+		}
+	default:
+		return ErrBadRegistration
+	}
+	return nil
+}
+
+// Verify checks that the transaction is well formed and signed with the
+// key the manager registered
+func (r *RegistrationTransaction) Verify(keys VoterKeys) error {
+	if err := r.Validate(); err != nil {
+		return err
+	}
+	key, err := keys.VoterKey(r.Manager)
+	if err != nil {
+		return err
+	}
+	if !ed25519.Verify(key, r.signingBytes(), r.Signature) {
+		return ErrBadSignature
+	}
+	return nil
+}
+
+// Transaction wraps the registration for the ledger
+func (r *RegistrationTransaction) Transaction() (Transaction, error) {
+	payload, err := json.Marshal(r)
+	if err != nil {
+		return Transaction{}, err
+	}
+	return Transaction{Type: TransactionRegistration, Payload: payload}, nil
+}
+
+// DecodeRegistration unwraps a registration transaction
+func DecodeRegistration(tx Transaction) (*RegistrationTransaction, error) {
+	if tx.Type != TransactionRegistration {
+		return nil, ErrWrongType
+	}
+	var registration RegistrationTransaction
+	if err := json.Unmarshal(tx.Payload, &registration); err != nil {
+		return nil, err
+	}
+	return &registration, nil
+}
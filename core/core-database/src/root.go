@@ -0,0 +1,189 @@
+package coredatabase
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"sort"
+
+	corehttp "github.com/jneubaum/honestvote.io/core/core-http"
+)
+
+// rootBuckets is how many buckets the state root spreads its records over.
+// Each bucket keeps its leaves and root, so working out the root again only
+// rehashes the buckets whose records changed.
+const rootBuckets = 256
+
+// The kinds of record in the state root
+const (
+	recordVoter     = "voter"
+	recordKey       = "key"
+	recordElection  = "election"
+	recordPosition  = "position"
+	recordCandidate = "candidate"
+	recordNonce     = "nonce"
+	recordVoted     = "voted"
+	recordTally     = "tally"
+)
+
+// record names one leaf of the state root by its kind and IDs
+type record struct {
+	kind          string
+	first, second string
+	rank          corehttp.VotePriority
+}
+
+// String is the record's key, which the leaves of a bucket are sorted by
+func (r record) String() string {
+	switch r.kind {
+	case recordTally:
+		return fmt.Sprintf("%s %q %q %d", r.kind, r.first, r.second, r.rank)
+	case recordKey, recordVoted:
+		return fmt.Sprintf("%s %q %q", r.kind, r.first, r.second)
+	}
+	return fmt.Sprintf("%s %q", r.kind, r.first)
+}
+
+// bucket is a share of the state root's leaves and their root. Buckets are
+// never changed once made, so copies of the state share them.
+type bucket struct {
+	leaves map[string][]byte // leaf hash by record key
+	root   []byte
+}
+
+// emptyBucket is the root of a bucket without records
+var emptyBucket, _ = hex.DecodeString(merkleRoot(nil))
+
+// Root is the Merkle root of everything in the state: voters, their keys,
+// elections, positions, candidates, nonces, who has voted and the tallies.
+// Every block records the root of the state after it, so two nodes that
+// applied the same chain and ended up with different results find out at
+// that block.
+func (s *State) Root() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.root()
+}
+
+// root does the work of Root. Each record is a leaf in the bucket its key
+// hashes to, sorted by key within the bucket so the root does not depend on
+// map order, and the root is the root over the buckets' roots in order.
+// Only the buckets with records changed since the last time are rehashed.
+// The caller must hold the lock.
+func (s *State) root() string {
+	changed := make(map[int]map[string][]byte)
+	for r := range s.dirty {
+		key := r.String()
+		i := bucketOf(key)
+		if changed[i] == nil {
+			changed[i] = make(map[string][]byte)
+		}
+		changed[i][key] = nil
+		if value, ok := s.record(r); ok {
+			changed[i][key] = leafOf(key, value)
+		}
+	}
+	for i, leaves := range changed {
+		s.buckets[i] = s.buckets[i].with(leaves)
+	}
+	s.dirty = make(map[record]bool)
+
+	roots := make([][]byte, rootBuckets)
+	for i, b := range s.buckets {
+		roots[i] = emptyBucket
+		if b != nil {
+			roots[i] = b.root
+		}
+	}
+	return merkleRoot(roots)
+}
+
+// touch marks a record as changed since the root was last worked out. The
+// caller must hold the lock.
+func (s *State) touch(r record) {
+	s.dirty[r] = true
+}
+
+// record returns the current value of r, if the state has it. The caller
+// must hold the lock.
+func (s *State) record(r record) (interface{}, bool) {
+	switch r.kind {
+	case recordVoter:
+		voter, ok := s.voters[corehttp.VoterID(r.first)]
+		return voter, ok
+	case recordKey:
+		key, ok := s.keys[corehttp.ElectionID(r.first)][corehttp.VoterID(r.second)]
+		return key, ok
+	case recordElection:
+		election, ok := s.elections[corehttp.ElectionID(r.first)]
+		return election, ok
+	case recordPosition:
+		position, ok := s.positions[corehttp.ElectionPositionID(r.first)]
+		return position, ok
+	case recordCandidate:
+		candidate, ok := s.candidates[corehttp.CandidateID(r.first)]
+		return candidate, ok
+	case recordNonce:
+		nonce, ok := s.nonces[corehttp.VoterID(r.first)]
+		return nonce, ok
+	case recordVoted:
+		voted := s.voted[corehttp.ElectionID(r.first)][corehttp.VoterID(r.second)]
+		return true, voted
+	case recordTally:
+		count, ok := s.tallies[corehttp.ElectionID(r.first)][corehttp.TicketID(r.second)][r.rank]
+		return count, ok
+	}
+	return nil, false
+}
+
+// with returns a bucket with the leaves changed, where a nil leaf removes
+// the record. It returns nil once the bucket has no records left.
+func (b *bucket) with(changed map[string][]byte) *bucket {
+	leaves := make(map[string][]byte)
+	if b != nil {
+		for key, leaf := range b.leaves {
+			leaves[key] = leaf
+		}
+	}
+	for key, leaf := range changed {
+		if leaf == nil {
+			delete(leaves, key)
+		} else {
+			leaves[key] = leaf
+		}
+	}
+	if len(leaves) == 0 {
+		return nil
+	}
+
+	keys := make([]string, 0, len(leaves))
+	for key := range leaves {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	sorted := make([][]byte, len(keys))
+	for i, key := range keys {
+		sorted[i] = leaves[key]
+	}
+	root, _ := hex.DecodeString(merkleRoot(sorted))
+	return &bucket{leaves: leaves, root: root}
+}
+
+// bucketOf returns the bucket a record key goes in
+func bucketOf(key string) int {
+	hash := fnv.New32a()
+	hash.Write([]byte(key))
+	return int(hash.Sum32() % rootBuckets)
+}
+
+// leafOf hashes a record's key along with its value
+func leafOf(key string, value interface{}) []byte {
+	data, _ := json.Marshal(value)
+	hash := sha256.New()
+	fmt.Fprintf(hash, "%d:%s", len(key), key)
+	hash.Write(data)
+	return hash.Sum(nil)
+}
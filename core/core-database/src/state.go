@@ -0,0 +1,644 @@
+package coredatabase
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"sync"
+
+	corehttp "github.com/jneubaum/honestvote.io/core/core-http"
+)
+
+var (
+	// ErrUnknownVoter is returned for voters that have not registered a key
+	ErrUnknownVoter = errors.New("coredatabase: voter has no registered key")
+	// ErrNotPermitted is returned when the signer lacks the permission the transaction needs
+	ErrNotPermitted = errors.New("coredatabase: signer is not permitted to do this")
+	// ErrDuplicateElection is returned when creating an election whose ID is taken
+	ErrDuplicateElection = errors.New("coredatabase: election already exists")
+	// ErrDuplicatePosition is returned when creating an election with a position ID another election uses
+	ErrDuplicatePosition = errors.New("coredatabase: position already exists")
+	// ErrStaleNonce is returned for transactions whose nonce the signer already used
+	ErrStaleNonce = errors.New("coredatabase: nonce already used")
+	// ErrUnknownElection is returned for transactions about an election that does not exist
+	ErrUnknownElection = errors.New("coredatabase: election does not exist")
+	// ErrAlreadyRegistered is returned when registering a key for a voter that has one in the election
+	ErrAlreadyRegistered = errors.New("coredatabase: voter already has a key for this election")
+	// ErrNoChange is returned for transactions that would leave the state as it is
+	ErrNoChange = errors.New("coredatabase: transaction changes nothing")
+	// ErrElectionClosed is returned for votes cast outside an election's voting period
+	ErrElectionClosed = errors.New("coredatabase: election is not open")
+	// ErrNotEligible is returned for votes from voters without CanVote for the election
+	ErrNotEligible = errors.New("coredatabase: voter may not vote in this election")
+	// ErrAlreadyVoted is returned for a second ballot from the same voter in an election
+	ErrAlreadyVoted = errors.New("coredatabase: voter already voted in this election")
+	// ErrNotRunning is returned for votes for a ticket with a candidate not registered to run in the election
+	ErrNotRunning = errors.New("coredatabase: candidate is not registered to run in this election")
+	// ErrBadStateRoot is returned for blocks whose state root is not the one applying them gives
+	ErrBadStateRoot = errors.New("coredatabase: block state root does not match")
+)
+
+// VoterKeys looks up the public key a voter registered
+type VoterKeys interface {
+	VoterKey(id corehttp.VoterID) (ed25519.PublicKey, error)
+}
+
+// State is what the ledger currently says about voters and elections. It
+// changes only by applying transactions.
+//
+// Voters have a key for each election they registered in, set by that
+// election's manager, so one manager cannot choose the key another
+// election trusts. The admins the network starts with have a key of their
+// own that holds everywhere.
+type State struct {
+	mu         sync.RWMutex
+	voters     map[corehttp.VoterID]*corehttp.Voter
+	keys       map[corehttp.ElectionID]map[corehttp.VoterID]ed25519.PublicKey
+	elections  map[corehttp.ElectionID]*corehttp.Election
+	positions  map[corehttp.ElectionPositionID]corehttp.ElectionPosition
+	candidates map[corehttp.CandidateID]*corehttp.Candidate
+	nonces     map[corehttp.VoterID]uint64
+	voted      map[corehttp.ElectionID]map[corehttp.VoterID]bool
+	tallies    map[corehttp.ElectionID]Tally
+
+	buckets [rootBuckets]*bucket // the state root's leaves, shared between copies
+	dirty   map[record]bool      // records changed since the root was last worked out
+}
+
+// Tally is the running count of an election: how many ballots ranked each
+// ticket at each priority. First-past-the-post ballots only use priority 1.
+type Tally map[corehttp.TicketID]map[corehttp.VotePriority]uint64
+
+// NewState returns the state before the first block. Admins are the voters
+// the network starts with, typically the ones allowed to create elections.
+func NewState(admins []corehttp.Voter) *State {
+	s := &State{
+		voters:     make(map[corehttp.VoterID]*corehttp.Voter),
+		keys:       make(map[corehttp.ElectionID]map[corehttp.VoterID]ed25519.PublicKey),
+		elections:  make(map[corehttp.ElectionID]*corehttp.Election),
+		positions:  make(map[corehttp.ElectionPositionID]corehttp.ElectionPosition),
+		candidates: make(map[corehttp.CandidateID]*corehttp.Candidate),
+		nonces:     make(map[corehttp.VoterID]uint64),
+		voted:      make(map[corehttp.ElectionID]map[corehttp.VoterID]bool),
+		tallies:    make(map[corehttp.ElectionID]Tally),
+		dirty:      make(map[record]bool),
+	}
+	for _, admin := range admins {
+		admin := admin
+		s.voters[admin.ID] = &admin
+		s.touch(record{kind: recordVoter, first: string(admin.ID)})
+	}
+	return s
+}
+
+// VoterKey returns the key the voter has everywhere, which only admins have
+func (s *State) VoterKey(id corehttp.VoterID) (ed25519.PublicKey, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.voterKey(id)
+}
+
+func (s *State) voterKey(id corehttp.VoterID) (ed25519.PublicKey, error) {
+	voter, ok := s.voters[id]
+	if !ok || len(voter.PublicKey) != ed25519.PublicKeySize {
+		return nil, ErrUnknownVoter
+	}
+	return voter.PublicKey, nil
+}
+
+// ElectionKey returns the key the voter signs with in election: the one
+// registered for the election, or an admin's own key
+func (s *State) ElectionKey(election corehttp.ElectionID, id corehttp.VoterID) (ed25519.PublicKey, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return electionKeys{s, election}.VoterKey(id)
+}
+
+// Voter returns a copy of the voter
+func (s *State) Voter(id corehttp.VoterID) (corehttp.Voter, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	voter, ok := s.voters[id]
+	if !ok {
+		return corehttp.Voter{}, false
+	}
+	return *voter, true
+}
+
+// Election returns the election with the given ID
+func (s *State) Election(id corehttp.ElectionID) (corehttp.Election, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	election, ok := s.elections[id]
+	if !ok {
+		return corehttp.Election{}, false
+	}
+	return *election, true
+}
+
+// Candidate returns a copy of the candidate
+func (s *State) Candidate(id corehttp.CandidateID) (corehttp.Candidate, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	candidate, ok := s.candidates[id]
+	if !ok {
+		return corehttp.Candidate{}, false
+	}
+	return *candidate, true
+}
+
+// Tally returns a copy of the election's running count and how many voters
+// have cast a ballot in it
+func (s *State) Tally(id corehttp.ElectionID) (Tally, int, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if _, ok := s.elections[id]; !ok {
+		return nil, 0, false
+	}
+	return s.tallies[id].copy(), len(s.voted[id]), true
+}
+
+func (t Tally) copy() Tally {
+	c := make(Tally)
+	for ticket, ranks := range t {
+		c[ticket] = make(map[corehttp.VotePriority]uint64)
+		for rank, count := range ranks {
+			c[ticket][rank] = count
+		}
+	}
+	return c
+}
+
+// Check reports whether tx could be applied to the current state at time
+// at (unix seconds) without changing anything
+func (s *State) Check(tx Transaction, at int64) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	_, err := s.check(tx, at)
+	return err
+}
+
+// Apply checks tx at time at and, if it is valid, applies it to the state.
+// Blocks apply their transactions at the block's timestamp, so every node
+// reaches the same answer.
+func (s *State) Apply(tx Transaction, at int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	apply, err := s.check(tx, at)
+	if err != nil {
+		return err
+	}
+	apply()
+	return nil
+}
+
+// ApplyBlock applies the block's transactions in order at the block's
+// timestamp and checks that the state it ends up in has the block's state
+// root. Either the whole block applies or the state is left as it was.
+func (s *State) ApplyBlock(block *Block) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	next := s.copy()
+	if err := next.applyBlock(block); err != nil {
+		return err
+	}
+
+	s.swap(next)
+	return nil
+}
+
+// After returns the state the blocks lead to when applied in order, as
+// ApplyBlock would, and leaves this one as it is. It copies the state once
+// however many blocks there are.
+func (s *State) After(blocks ...*Block) (*State, error) {
+	next := s.Copy()
+	for _, block := range blocks {
+		if err := next.applyBlock(block); err != nil {
+			return nil, err
+		}
+	}
+	return next, nil
+}
+
+// applyBlock does the work of ApplyBlock in place, so on failure the state
+// is left part way through the block. The caller must hold the lock or be
+// the only one with the state.
+func (s *State) applyBlock(block *Block) error {
+	for i, tx := range block.Transactions {
+		apply, err := s.check(tx, block.Header.Timestamp)
+		if err != nil {
+			return fmt.Errorf("transaction %d: %w", i, err)
+		}
+		apply()
+	}
+	if block.Header.StateRoot != s.root() {
+		return ErrBadStateRoot
+	}
+	return nil
+}
+
+// Restore makes the state a copy of from, which is how a node rolls back to
+// an earlier block. From is left untouched.
+func (s *State) Restore(from *State) {
+	next := from.Copy()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.swap(next)
+}
+
+// Adopt makes next the state without copying it, for a state nothing else
+// holds, such as one After returned. Next must not be used afterwards.
+func (s *State) Adopt(next *State) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.swap(next)
+}
+
+// swap takes over next's maps. The caller must hold the lock and not use
+// next afterwards.
+func (s *State) swap(next *State) {
+	s.voters, s.keys, s.elections, s.positions = next.voters, next.keys, next.elections, next.positions
+	s.candidates, s.nonces = next.candidates, next.nonces
+	s.voted, s.tallies = next.voted, next.tallies
+	s.buckets, s.dirty = next.buckets, next.dirty
+}
+
+// Replay applies every block after genesis in chain, which rebuilds the
+// state a node had before it restarted. The blocks apply to a single copy,
+// and the state only changes if all of them do.
+func (s *State) Replay(chain *Chain) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	next := s.copy()
+	for height := uint64(1); height <= chain.Height(); height++ {
+		block, err := chain.BlockAt(height)
+		if err != nil {
+			return err
+		}
+		if err := next.applyBlock(block); err != nil {
+			return fmt.Errorf("block %d: %v", height, err)
+		}
+	}
+
+	s.swap(next)
+	return nil
+}
+
+// Copy returns a deep copy of the state that can be changed without
+// touching the original
+func (s *State) Copy() *State {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.copy()
+}
+
+// copy does the work of Copy. The caller must hold the lock.
+func (s *State) copy() *State {
+	c := NewState(nil)
+	for id, voter := range s.voters {
+		v := *voter
+		v.PublicKey = append(ed25519.PublicKey(nil), voter.PublicKey...)
+		v.Permissions.CanManageElection = append([]corehttp.ElectionID(nil), voter.Permissions.CanManageElection...)
+		v.Permissions.CanVote = append([]corehttp.AppID(nil), voter.Permissions.CanVote...)
+		c.voters[id] = &v
+	}
+	//Keys are never changed once registered, so they can be shared
+	for election, keys := range s.keys {
+		c.keys[election] = make(map[corehttp.VoterID]ed25519.PublicKey)
+		for id, key := range keys {
+			c.keys[election][id] = key
+		}
+	}
+	//Elections are never changed once created, so they can be shared
+	for id, election := range s.elections {
+		c.elections[id] = election
+	}
+	for id, position := range s.positions {
+		c.positions[id] = position
+	}
+	for id, candidate := range s.candidates {
+		cand := *candidate
+		cand.Permissions.CanRun = append([]corehttp.AppID(nil), candidate.Permissions.CanRun...)
+		c.candidates[id] = &cand
+	}
+	for id, nonce := range s.nonces {
+		c.nonces[id] = nonce
+	}
+	for election, voters := range s.voted {
+		c.voted[election] = make(map[corehttp.VoterID]bool)
+		for voter := range voters {
+			c.voted[election][voter] = true
+		}
+	}
+	for election, tally := range s.tallies {
+		c.tallies[election] = tally.copy()
+	}
+	c.buckets = s.buckets
+	for r := range s.dirty {
+		c.dirty[r] = true
+	}
+	return c
+}
+
+// check validates tx and returns the function that applies it. The caller
+// must hold the lock.
+func (s *State) check(tx Transaction, at int64) (func(), error) {
+	switch tx.Type {
+	case TransactionVote:
+		vote, err := DecodeVote(tx)
+		if err != nil {
+			return nil, err
+		}
+		if err := vote.Verify(electionKeys{s, vote.ElectionID}); err != nil {
+			return nil, err
+		}
+		if err := s.checkNonce(vote.VoterID, vote.Nonce); err != nil {
+			return nil, err
+		}
+		if err := s.checkBallot(vote, at); err != nil {
+			return nil, err
+		}
+		return func() {
+			s.setNonce(vote.VoterID, vote.Nonce)
+			if s.voted[vote.ElectionID] == nil {
+				s.voted[vote.ElectionID] = make(map[corehttp.VoterID]bool)
+			}
+			s.voted[vote.ElectionID][vote.VoterID] = true
+			s.touch(record{kind: recordVoted, first: string(vote.ElectionID), second: string(vote.VoterID)})
+			if s.tallies[vote.ElectionID] == nil {
+				s.tallies[vote.ElectionID] = make(Tally)
+			}
+			tally := s.tallies[vote.ElectionID]
+			for _, v := range vote.Votes {
+				if tally[v.TicketID] == nil {
+					tally[v.TicketID] = make(map[corehttp.VotePriority]uint64)
+				}
+				tally[v.TicketID][v.VotePriority]++
+				s.touch(record{kind: recordTally, first: string(vote.ElectionID), second: string(v.TicketID), rank: v.VotePriority})
+			}
+		}, nil
+	case TransactionElection:
+		election, err := DecodeElection(tx)
+		if err != nil {
+			return nil, err
+		}
+		if err := election.Verify(lockedKeys{s}); err != nil {
+			return nil, err
+		}
+		if err := s.checkNonce(election.Creator, election.Nonce); err != nil {
+			return nil, err
+		}
+		creator := s.voters[election.Creator]
+		if !creator.Permissions.CanCreateElection {
+			return nil, ErrNotPermitted
+		}
+		if _, ok := s.elections[election.Election.ID]; ok {
+			return nil, ErrDuplicateElection
+		}
+		//Positions share one namespace across elections, so a new election
+		//must not redefine one that belongs to another
+		for _, position := range election.Positions {
+			if _, ok := s.positions[position.ID]; ok {
+				return nil, ErrDuplicatePosition
+			}
+		}
+		return func() {
+			s.setNonce(election.Creator, election.Nonce)
+			s.elections[election.Election.ID] = &election.Election
+			s.touch(record{kind: recordElection, first: string(election.Election.ID)})
+			for _, position := range election.Positions {
+				s.positions[position.ID] = position
+				s.touch(record{kind: recordPosition, first: string(position.ID)})
+			}
+			//Whoever creates an election manages it
+			creator.Permissions.CanManageElection = append(creator.Permissions.CanManageElection, election.Election.ID)
+			s.touch(record{kind: recordVoter, first: string(election.Creator)})
+		}, nil
+	case TransactionRegistration:
+		registration, err := DecodeRegistration(tx)
+		if err != nil {
+			return nil, err
+		}
+		if err := registration.Verify(lockedKeys{s}); err != nil {
+			return nil, err
+		}
+		if err := s.checkNonce(registration.Manager, registration.Nonce); err != nil {
+			return nil, err
+		}
+		apply, err := s.checkRegistration(registration)
+		if err != nil {
+			return nil, err
+		}
+		return func() {
+			s.setNonce(registration.Manager, registration.Nonce)
+			apply()
+		}, nil
+	}
+	return nil, ErrWrongType
+}
+
+// checkBallot makes sure the election is open at time at, the voter may
+// vote in it and has not yet, and the ballot fits the election: every vote
+// is for one of its tickets, every candidate on those tickets is registered
+// to run in it, no ticket gets two votes, and each ticket entry gets a
+// single vote at priority 1 unless the election ranks them, in which case
+// the ranks within an entry must differ
+func (s *State) checkBallot(vote *VoteTransaction, at int64) error {
+	election, ok := s.elections[vote.ElectionID]
+	if !ok {
+		return ErrUnknownElection
+	}
+	if at < election.Start || (election.End != 0 && at >= election.End) {
+		return ErrElectionClosed
+	}
+	if !hasApp(s.voters[vote.VoterID].Permissions.CanVote, corehttp.AppID(vote.ElectionID)) {
+		return ErrNotEligible
+	}
+	if s.voted[vote.ElectionID][vote.VoterID] {
+		return ErrAlreadyVoted
+	}
+
+	entries := make(map[corehttp.TicketID]corehttp.TicketEntryID)
+	tickets := make(map[corehttp.TicketID]corehttp.Ticket)
+	for _, entry := range election.TicketEntries {
+		for _, ticket := range entry.Tickets {
+			entries[ticket.ID] = entry.ID
+			tickets[ticket.ID] = ticket
+		}
+	}
+
+	ranked := election.Type != corehttp.FirstPastThePost
+	voted := make(map[corehttp.TicketID]bool)
+	ranks := make(map[corehttp.TicketEntryID]map[corehttp.VotePriority]bool)
+	for _, v := range vote.Votes {
+		entry, ok := entries[v.TicketID]
+		if !ok || voted[v.TicketID] {
+			return ErrBadVote
+		}
+		voted[v.TicketID] = true
+
+		if ranks[entry] == nil {
+			ranks[entry] = make(map[corehttp.VotePriority]bool)
+		} else if !ranked {
+			return ErrBadVote
+		}
+		if v.VotePriority < 1 || (!ranked && v.VotePriority != 1) || ranks[entry][v.VotePriority] {
+			return ErrBadVote
+		}
+		ranks[entry][v.VotePriority] = true
+
+		for _, position := range tickets[v.TicketID].ElectionPositionEntries {
+			candidate, ok := s.candidates[position.CandidateID]
+			if !ok || !hasApp(candidate.Permissions.CanRun, corehttp.AppID(vote.ElectionID)) {
+				return ErrNotRunning
+			}
+		}
+	}
+	return nil
+}
+
+// checkRegistration makes sure the signer manages the election and that
+// the registration changes something
+func (s *State) checkRegistration(r *RegistrationTransaction) (func(), error) {
+	if _, ok := s.elections[r.ElectionID]; !ok {
+		return nil, ErrUnknownElection
+	}
+	if !hasElection(s.voters[r.Manager].Permissions.CanManageElection, r.ElectionID) {
+		return nil, ErrNotPermitted
+	}
+	election := corehttp.AppID(r.ElectionID)
+
+	voter, ok := s.voters[r.VoterID]
+	switch r.Action {
+	case RegisterVoter:
+		if _, registered := s.keys[r.ElectionID][r.VoterID]; registered {
+			return nil, ErrAlreadyRegistered
+		}
+		return func() {
+			if !ok {
+				voter = &corehttp.Voter{ID: r.VoterID}
+				s.voters[r.VoterID] = voter
+			}
+			if s.keys[r.ElectionID] == nil {
+				s.keys[r.ElectionID] = make(map[corehttp.VoterID]ed25519.PublicKey)
+			}
+			s.keys[r.ElectionID][r.VoterID] = r.PublicKey
+			s.touch(record{kind: recordVoter, first: string(r.VoterID)})
+			s.touch(record{kind: recordKey, first: string(r.ElectionID), second: string(r.VoterID)})
+		}, nil
+	case GrantVote:
+		if ok && hasApp(voter.Permissions.CanVote, election) {
+			return nil, ErrNoChange
+		}
+		return func() {
+			if !ok {
+				voter = &corehttp.Voter{ID: r.VoterID}
+				s.voters[r.VoterID] = voter
+			}
+			voter.Permissions.CanVote = append(voter.Permissions.CanVote, election)
+			s.touch(record{kind: recordVoter, first: string(r.VoterID)})
+		}, nil
+	case RevokeVote:
+		if !ok || !hasApp(voter.Permissions.CanVote, election) {
+			return nil, ErrNoChange
+		}
+		return func() {
+			voter.Permissions.CanVote = removeApp(voter.Permissions.CanVote, election)
+			s.touch(record{kind: recordVoter, first: string(r.VoterID)})
+		}, nil
+	case RegisterCandidate:
+		candidate, ok := s.candidates[r.Candidate.ID]
+		if ok && hasApp(candidate.Permissions.CanRun, election) {
+			return nil, ErrNoChange
+		}
+		return func() {
+			if !ok {
+				candidate = &corehttp.Candidate{ID: r.Candidate.ID, DisplayName: r.Candidate.DisplayName}
+				s.candidates[r.Candidate.ID] = candidate
+			}
+			candidate.Permissions.CanRun = append(candidate.Permissions.CanRun, election)
+			s.touch(record{kind: recordCandidate, first: string(r.Candidate.ID)})
+		}, nil
+	}
+	return nil, ErrBadRegistration
+}
+
+func hasElection(list []corehttp.ElectionID, id corehttp.ElectionID) bool {
+	for _, e := range list {
+		if e == id {
+			return true
+		}
+	}
+	return false
+}
+
+func hasApp(list []corehttp.AppID, id corehttp.AppID) bool {
+	for _, a := range list {
+		if a == id {
+			return true
+		}
+	}
+	return false
+}
+
+// removeApp returns list without id, leaving list itself untouched
+func removeApp(list []corehttp.AppID, id corehttp.AppID) []corehttp.AppID {
+	var kept []corehttp.AppID
+	for _, a := range list {
+		if a != id {
+			kept = append(kept, a)
+		}
+	}
+	return kept
+}
+
+// checkNonce makes sure the signer has not used nonce before
+func (s *State) checkNonce(id corehttp.VoterID, nonce uint64) error {
+	if last, ok := s.nonces[id]; ok && nonce <= last {
+		return ErrStaleNonce
+	}
+	return nil
+}
+
+// setNonce records the last nonce id used. The caller must hold the lock.
+func (s *State) setNonce(id corehttp.VoterID, nonce uint64) {
+	s.nonces[id] = nonce
+	s.touch(record{kind: recordNonce, first: string(id)})
+}
+
+// lockedKeys looks up keys while the state's lock is already held
+type lockedKeys struct {
+	s *State
+}
+
+func (k lockedKeys) VoterKey(id corehttp.VoterID) (ed25519.PublicKey, error) {
+	return k.s.voterKey(id)
+}
+
+// electionKeys looks up the keys voters sign with in one election while
+// the state's lock is already held
+type electionKeys struct {
+	s        *State
+	election corehttp.ElectionID
+}
+
+func (k electionKeys) VoterKey(id corehttp.VoterID) (ed25519.PublicKey, error) {
+	if key, ok := k.s.keys[k.election][id]; ok {
+		return key, nil
+	}
+	return k.s.voterKey(id)
+}
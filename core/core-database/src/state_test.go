@@ -0,0 +1,249 @@
+package coredatabase
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"testing"
+
+	corehttp "github.com/jneubaum/honestvote.io/core/core-http"
+)
+
+// newKey makes a signing key
+func newKey(t *testing.T) (ed25519.PublicKey, ed25519.PrivateKey) {
+	t.Helper()
+
+	public, private, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return public, private
+}
+
+// newAdmins makes an administrator that may create elections
+func newAdmins(t *testing.T) ([]corehttp.Voter, ed25519.PrivateKey) {
+	t.Helper()
+
+	public, private := newKey(t)
+	return []corehttp.Voter{{ID: "admin", PublicKey: public, Permissions: corehttp.VoterPermissions{CanCreateElection: true}}}, private
+}
+
+// electionTx makes the admin's transaction creating election id, with one
+// entry whose tickets t1 and t2 run candidates c1 and c2
+func electionTx(t *testing.T, key ed25519.PrivateKey, id corehttp.ElectionID, kind corehttp.ElectionType, nonce uint64) Transaction {
+	t.Helper()
+
+	position := corehttp.ElectionPositionID(id + "-p")
+	ticket := func(ticket corehttp.TicketID, candidate corehttp.CandidateID) corehttp.Ticket {
+		return corehttp.Ticket{ID: ticket, ElectionPositionEntries: []corehttp.ElectionPositionEntry{{CandidateID: candidate, ElectionPositionID: position}}}
+	}
+	election := &ElectionTransaction{
+		Creator: "admin",
+		Election: corehttp.Election{
+			ID:          id,
+			DisplayName: "Election",
+			Type:        kind,
+			TicketEntries: []corehttp.TicketEntry{{
+				ID:                       "president",
+				DisplayName:              "President",
+				AllowedElectionPositions: []corehttp.ElectionPositionID{position},
+				Tickets:                  []corehttp.Ticket{ticket("t1", "c1"), ticket("t2", "c2")},
+			}},
+		},
+		Positions: []corehttp.ElectionPosition{{ID: position, DisplayName: "President"}},
+		Nonce:     nonce,
+	}
+	election.Sign(key)
+	tx, err := election.Transaction()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tx
+}
+
+// registrationTx signs r with key, as its manager
+func registrationTx(t *testing.T, key ed25519.PrivateKey, r RegistrationTransaction) Transaction {
+	t.Helper()
+
+	if r.Manager == "" {
+		r.Manager = "admin"
+	}
+	r.Sign(key)
+	tx, err := r.Transaction()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tx
+}
+
+// voteTx makes voter's ballot in election, signed with key
+func voteTx(t *testing.T, key ed25519.PrivateKey, voter corehttp.VoterID, election corehttp.ElectionID, nonce uint64, votes ...corehttp.Vote) Transaction {
+	t.Helper()
+
+	for i := range votes {
+		votes[i].VoterID = voter
+	}
+	vote := &VoteTransaction{VoterID: voter, ElectionID: election, Votes: votes, Nonce: nonce}
+	vote.Sign(key)
+	tx, err := vote.Transaction()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tx
+}
+
+func TestStateTransitions(t *testing.T) {
+	admins, adminKey := newAdmins(t)
+	voterPublic, voterKey := newKey(t)
+	otherPublic, otherKey := newKey(t)
+	state := NewState(admins)
+
+	first := corehttp.Vote{TicketID: "t1", VotePriority: 1}
+	second := corehttp.Vote{TicketID: "t2", VotePriority: 2}
+	steps := []struct {
+		name string
+		tx   Transaction
+		err  error
+	}{
+		{"create election", electionTx(t, adminKey, "e1", corehttp.FirstPastThePost, 1), nil},
+		{"create it again", electionTx(t, adminKey, "e1", corehttp.FirstPastThePost, 2), ErrDuplicateElection},
+		{"reuse a nonce", electionTx(t, adminKey, "e2", corehttp.InstantRunoff, 1), ErrStaleNonce},
+		{"create ranked election", electionTx(t, adminKey, "e2", corehttp.InstantRunoff, 3), nil},
+		{"register voter", registrationTx(t, adminKey, RegistrationTransaction{ElectionID: "e1", Action: RegisterVoter, VoterID: "v1", PublicKey: voterPublic, Nonce: 4}), nil},
+		{"register voter again", registrationTx(t, adminKey, RegistrationTransaction{ElectionID: "e1", Action: RegisterVoter, VoterID: "v1", PublicKey: otherPublic, Nonce: 5}), ErrAlreadyRegistered},
+		{"register voter in another election", registrationTx(t, adminKey, RegistrationTransaction{ElectionID: "e2", Action: RegisterVoter, VoterID: "v1", PublicKey: otherPublic, Nonce: 6}), nil},
+		{"registration by a voter", registrationTx(t, voterKey, RegistrationTransaction{Manager: "v1", ElectionID: "e1", Action: GrantVote, VoterID: "v1", Nonce: 1}), ErrUnknownVoter},
+		{"vote before being allowed", voteTx(t, voterKey, "v1", "e1", 1, first), ErrNotEligible},
+		{"allow voting", registrationTx(t, adminKey, RegistrationTransaction{ElectionID: "e1", Action: GrantVote, VoterID: "v1", Nonce: 7}), nil},
+		{"allow voting again", registrationTx(t, adminKey, RegistrationTransaction{ElectionID: "e1", Action: GrantVote, VoterID: "v1", Nonce: 8}), ErrNoChange},
+		{"vote for a candidate not running", voteTx(t, voterKey, "v1", "e1", 1, first), ErrNotRunning},
+		{"register candidate", registrationTx(t, adminKey, RegistrationTransaction{ElectionID: "e1", Action: RegisterCandidate, Candidate: &corehttp.Candidate{ID: "c1", DisplayName: "One"}, Nonce: 9}), nil},
+		{"rank in an unranked election", voteTx(t, voterKey, "v1", "e1", 1, corehttp.Vote{TicketID: "t1", VotePriority: 2}), ErrBadVote},
+		{"vote twice in one entry", voteTx(t, voterKey, "v1", "e1", 1, first, second), ErrBadVote},
+		{"vote for an unknown ticket", voteTx(t, voterKey, "v1", "e1", 1, corehttp.Vote{TicketID: "t3", VotePriority: 1}), ErrBadVote},
+		{"vote with another election's key", voteTx(t, otherKey, "v1", "e1", 1, first), ErrBadSignature},
+		{"vote", voteTx(t, voterKey, "v1", "e1", 1, first), nil},
+		{"vote again", voteTx(t, voterKey, "v1", "e1", 2, first), ErrAlreadyVoted},
+		{"revoke voting", registrationTx(t, adminKey, RegistrationTransaction{ElectionID: "e1", Action: RevokeVote, VoterID: "v1", Nonce: 10}), nil},
+		{"revoke voting again", registrationTx(t, adminKey, RegistrationTransaction{ElectionID: "e1", Action: RevokeVote, VoterID: "v1", Nonce: 11}), ErrNoChange},
+	}
+	for _, step := range steps {
+		if err := state.Apply(step.tx, 0); !errors.Is(err, step.err) {
+			t.Fatalf("%s: expected %v, got %v", step.name, step.err, err)
+		}
+	}
+
+	tally, voters, ok := state.Tally("e1")
+	if !ok || voters != 1 || tally["t1"][1] != 1 || len(tally) != 1 {
+		t.Fatalf("unexpected tally %v from %d voters", tally, voters)
+	}
+	if key, err := state.ElectionKey("e2", "v1"); err != nil || !key.Equal(otherPublic) {
+		t.Fatal("the second election's key is not the one registered for it")
+	}
+	if _, err := state.VoterKey("v1"); err == nil {
+		t.Fatal("registering in an election gave the voter a key everywhere")
+	}
+	if voter, _ := state.Voter("admin"); len(voter.Permissions.CanManageElection) != 2 {
+		t.Fatal("the creator does not manage both elections")
+	}
+}
+
+func TestStateRoot(t *testing.T) {
+	admins, adminKey := newAdmins(t)
+	voterPublic, voterKey := newKey(t)
+	txs := []Transaction{
+		electionTx(t, adminKey, "e1", corehttp.FirstPastThePost, 1),
+		registrationTx(t, adminKey, RegistrationTransaction{ElectionID: "e1", Action: RegisterVoter, VoterID: "v1", PublicKey: voterPublic, Nonce: 2}),
+		registrationTx(t, adminKey, RegistrationTransaction{ElectionID: "e1", Action: GrantVote, VoterID: "v1", Nonce: 3}),
+		registrationTx(t, adminKey, RegistrationTransaction{ElectionID: "e1", Action: RegisterCandidate, Candidate: &corehttp.Candidate{ID: "c1", DisplayName: "One"}, Nonce: 4}),
+		voteTx(t, voterKey, "v1", "e1", 1, corehttp.Vote{TicketID: "t1", VotePriority: 1}),
+	}
+
+	if NewState(admins).Root() != NewState(admins).Root() {
+		t.Fatal("the same admins gave different roots")
+	}
+	if NewState(admins).Root() == NewState(nil).Root() {
+		t.Fatal("the admins are not part of the root")
+	}
+
+	//Working out the root along the way must not change where it ends up
+	stepwise, batched := NewState(admins), NewState(admins)
+	roots := make(map[string]bool)
+	for _, tx := range txs {
+		if err := stepwise.Apply(tx, 0); err != nil {
+			t.Fatal(err)
+		}
+		root := stepwise.Root()
+		if roots[root] {
+			t.Fatal("a transaction left the root as it was")
+		}
+		roots[root] = true
+
+		if err := batched.Apply(tx, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if stepwise.Root() != batched.Root() {
+		t.Fatal("the same transactions gave different roots")
+	}
+
+	//Copies share the root's buckets, which changing one must not touch
+	copied := stepwise.Copy()
+	if copied.Root() != stepwise.Root() {
+		t.Fatal("a copy has a different root")
+	}
+	before := stepwise.Root()
+	if err := copied.Apply(registrationTx(t, adminKey, RegistrationTransaction{ElectionID: "e1", Action: RevokeVote, VoterID: "v1", Nonce: 5}), 0); err != nil {
+		t.Fatal(err)
+	}
+	if copied.Root() == before || stepwise.Root() != before {
+		t.Fatal("changing a copy changed the original's root")
+	}
+}
+
+func TestApplyBlock(t *testing.T) {
+	admins, adminKey := newAdmins(t)
+	_, proposer := newKey(t)
+	txs := []Transaction{
+		electionTx(t, adminKey, "e1", corehttp.FirstPastThePost, 1),
+		electionTx(t, adminKey, "e2", corehttp.FirstPastThePost, 2),
+	}
+	expected := NewState(admins)
+	for _, tx := range txs {
+		expected.Apply(tx, 1)
+	}
+	genesis := Genesis()
+	block := NewBlock(genesis, txs, expected.Root(), 1, proposer)
+
+	state := NewState(admins)
+	root := state.Root()
+	if after, err := state.After(block); err != nil || after.Root() != expected.Root() {
+		t.Fatal("After did not reach the block's state:", err)
+	}
+	if state.Root() != root {
+		t.Fatal("After changed the state it started from")
+	}
+
+	cases := []struct {
+		name  string
+		block *Block
+		err   error
+	}{
+		{"wrong root", NewBlock(genesis, txs, root, 1, proposer), ErrBadStateRoot},
+		{"transaction that fails", NewBlock(genesis, []Transaction{txs[0], txs[0]}, expected.Root(), 1, proposer), ErrStaleNonce},
+	}
+	for _, c := range cases {
+		if err := state.ApplyBlock(c.block); !errors.Is(err, c.err) {
+			t.Errorf("%s: expected %v, got %v", c.name, c.err, err)
+		}
+		if state.Root() != root {
+			t.Errorf("%s: applied part of a rejected block", c.name)
+		}
+	}
+
+	if err := state.ApplyBlock(block); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := state.Election("e2"); !ok || state.Root() != expected.Root() {
+		t.Fatal("did not apply the block")
+	}
+}
@@ -0,0 +1,91 @@
+package coredatabase
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+
+	corehttp "github.com/jneubaum/honestvote.io/core/core-http"
+)
+
+var (
+	// ErrBadVote is returned for vote transactions that are malformed
+	ErrBadVote = errors.New("coredatabase: malformed vote transaction")
+	// ErrWrongType is returned when decoding a transaction as the wrong type
+	ErrWrongType = errors.New("coredatabase: wrong transaction type")
+)
+
+// VoteTransaction is a voter's signed ballot for one election. The nonce
+// increases with every transaction the voter sends, so a captured
+// transaction cannot be replayed.
+type VoteTransaction struct {
+	VoterID    corehttp.VoterID    `json:"voterId"`
+	ElectionID corehttp.ElectionID `json:"electionId"`
+	Votes      []corehttp.Vote     `json:"votes"`
+	Nonce      uint64              `json:"nonce"`
+	Timestamp  int64               `json:"timestamp"` // unix seconds
+	Signature  []byte              `json:"signature,omitempty"`
+}
+
+// signingBytes is what the voter signs: the transaction without its signature
+func (v VoteTransaction) signingBytes() []byte {
+	v.Signature = nil
+	data, _ := json.Marshal(v)
+	return append([]byte("honestvote vote "), data...)
+}
+
+// Sign signs the transaction with the voter's key
+func (v *VoteTransaction) Sign(key ed25519.PrivateKey) {
+	v.Signature = ed25519.Sign(key, v.signingBytes())
+}
+
+// Validate checks that the transaction is well formed. Every vote has to be
+// cast by the voter who signs the transaction.
+func (v *VoteTransaction) Validate() error {
+	if v.VoterID == "" || v.ElectionID == "" || len(v.Votes) == 0 {
+		return ErrBadVote
+	}
+	for _, vote := range v.Votes {
+		if vote.VoterID != v.VoterID || vote.TicketID == "" {
+			return ErrBadVote
+		}
+	}
+	return nil
+}
+
+// Verify checks that the transaction is well formed and signed with the
+// key the voter registered
+func (v *VoteTransaction) Verify(keys VoterKeys) error {
+	if err := v.Validate(); err != nil {
+		return err
+	}
+	key, err := keys.VoterKey(v.VoterID)
+	if err != nil {
+		return err
+	}
+	if !ed25519.Verify(key, v.signingBytes(), v.Signature) {
+		return ErrBadSignature
+	}
+	return nil
+}
+
+// Transaction wraps the vote for the ledger
+func (v *VoteTransaction) Transaction() (Transaction, error) {
+	payload, err := json.Marshal(v)
+	if err != nil {
+		return Transaction{}, err
+	}
+	return Transaction{Type: TransactionVote, Payload: payload}, nil
+}
+
+// DecodeVote unwraps a vote transaction
+func DecodeVote(tx Transaction) (*VoteTransaction, error) {
+	if tx.Type != TransactionVote {
+		return nil, ErrWrongType
+	}
+	var vote VoteTransaction
+	if err := json.Unmarshal(tx.Payload, &vote); err != nil {
+		return nil, err
+	}
+	return &vote, nil
+}
@@ -0,0 +1,27 @@
+package corehttp
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// BannedPeer is a node that has been banned for misbehaving
+type BannedPeer struct {
+	Address     string    `json:"address"`
+	NodeID      string    `json:"nodeId,omitempty"`
+	BannedUntil time.Time `json:"bannedUntil"`
+}
+
+// BannedPeers returns the node's current ban list. The node sets it on startup.
+var BannedPeers func() []BannedPeer
+
+func GetBansHandler(w http.ResponseWriter, r *http.Request) {
+	bans := []BannedPeer{}
+	if BannedPeers != nil {
+		bans = BannedPeers()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(bans)
+}
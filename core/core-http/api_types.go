@@ -12,6 +12,9 @@ type CandidateID AppID
 // ElectionID is an identifier for an Election
 type ElectionID AppID
 
+// TicketID is an identifier for a Ticket
+type TicketID AppID
+
 // TicketEntryID is an identifier for a TicketEntry
 type TicketEntryID AppID
 
@@ -37,6 +40,8 @@ type Election struct {
 	Type          ElectionType    `json:"type"`
 	TicketEntries []TicketEntry   `json:"ballotEntries"`
 	Options       ElectionOptions `json:"options,omitempty"`
+	Start         int64           `json:"start,omitempty"` // unix seconds voting opens, zero for right away
+	End           int64           `json:"end,omitempty"`   // unix seconds voting closes, zero for never
 }
 
 // ElectionOptions are options that apply to a given Election
@@ -71,6 +76,7 @@ type TicketEntry struct {
 // running for this TicketEntry. For instance, you may have one ElectionPositionEntry
 // for a President, and another ElectionPositionEntry for a Vice-President
 type Ticket struct {
+	ID                      TicketID                `json:"id,omitempty"`
 	ElectionPositionEntries []ElectionPositionEntry `json:"electionPositionEntries"`
 	Votes                   []Vote                  `json:"votes"`
 }
@@ -90,12 +96,14 @@ type ElectionPosition struct {
 // Vote is a vote that can go toward a particular candidate
 type Vote struct {
 	VoterID      VoterID      `json:"voterId"`
+	TicketID     TicketID     `json:"ticketId"`
 	VotePriority VotePriority `json:"votePriority"` // used in rank based voting. for now always 1
 }
 
 // Voter is a user that is able to vote
 type Voter struct {
 	ID          VoterID          `json:"id"`
+	PublicKey   []byte           `json:"publicKey,omitempty"` // ed25519 key the voter signs transactions with
 	Permissions VoterPermissions `json:"permissions"`
 }
 
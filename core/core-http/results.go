@@ -0,0 +1,40 @@
+package corehttp
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// TicketResult is the count for one ticket. Votes maps each priority to how
+// many ballots ranked the ticket there.
+type TicketResult struct {
+	TicketID TicketID                `json:"ticketId"`
+	Votes    map[VotePriority]uint64 `json:"votes"`
+}
+
+// ElectionResults is the running count of an election at the head of the chain
+type ElectionResults struct {
+	ElectionID ElectionID     `json:"electionId"`
+	Voted      int            `json:"voted"`
+	Tickets    []TicketResult `json:"tickets"`
+}
+
+// Results returns the running count of an election, or false if there is
+// no such election. The node sets it on startup.
+var Results func(id ElectionID) (ElectionResults, bool)
+
+func GetResultsHandler(w http.ResponseWriter, r *http.Request) {
+	if Results == nil {
+		http.Error(w, "this node does not keep results", http.StatusServiceUnavailable)
+		return
+	}
+
+	results, ok := Results(ElectionID(r.URL.Query().Get("electionId")))
+	if !ok {
+		http.Error(w, "unknown election", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(results)
+}
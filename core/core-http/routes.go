@@ -25,5 +25,11 @@ func HandleRoutes() {
 	Router.HandleFunc("/getElections", GetElectionsHandler).Methods("GET")   // located in elections.go
 	Router.HandleFunc("/verifyCode", VerifyEmailHandler).Methods("GET")      // located in verification.go
 	Router.HandleFunc("/registerElection", RegisterHandler).Methods("POST")  // located in register_election.go
+	Router.HandleFunc("/admin/bans", GetBansHandler).Methods("GET")         // located in admin.go
+	Router.HandleFunc("/status", GetStatusHandler).Methods("GET")           // located in status.go
+	Router.HandleFunc("/vote", SubmitVoteHandler).Methods("POST")           // located in transactions.go
+	Router.HandleFunc("/createElection", SubmitElectionHandler).Methods("POST") // located in transactions.go
+	Router.HandleFunc("/registration", SubmitRegistrationHandler).Methods("POST") // located in transactions.go
+	Router.HandleFunc("/results", GetResultsHandler).Methods("GET")         // located in results.go
 	http.Handle("/", Router)
 }
@@ -0,0 +1,53 @@
+package corehttp
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// PeerStatus describes one connected peer
+type PeerStatus struct {
+	NodeID       string    `json:"nodeId"`
+	Address      string    `json:"address"`
+	Role         string    `json:"role"`
+	Inbound      bool      `json:"inbound"`
+	Height       uint64    `json:"height"`
+	LatencyMs    float64   `json:"latencyMs"`
+	Score        int       `json:"score"`
+	LastReceived time.Time `json:"lastReceived"`
+}
+
+// SyncStatus describes how far the node has got catching up with the chain
+type SyncStatus struct {
+	StartHeight  uint64 `json:"startHeight"`
+	Height       uint64 `json:"height"`
+	HeaderHeight uint64 `json:"headerHeight"`
+	TargetHeight uint64 `json:"targetHeight"`
+	Peers        int    `json:"peers"`
+}
+
+// NodeStatus describes this node and its peers. Sync is only filled in
+// while the node is syncing.
+type NodeStatus struct {
+	NodeID  string       `json:"nodeId"`
+	Address string       `json:"address"`
+	Role    string       `json:"role"`
+	Height  uint64       `json:"height"`
+	Syncing bool         `json:"syncing"`
+	Sync    *SyncStatus  `json:"sync,omitempty"`
+	Peers   []PeerStatus `json:"peers"`
+}
+
+// Status returns the node's current status. The node sets it on startup.
+var Status func() NodeStatus
+
+func GetStatusHandler(w http.ResponseWriter, r *http.Request) {
+	status := NodeStatus{Peers: []PeerStatus{}}
+	if Status != nil {
+		status = Status()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
@@ -0,0 +1,52 @@
+package corehttp
+
+import (
+	"io/ioutil"
+	"net/http"
+)
+
+// MaxTransactionSize bounds the body of a submitted transaction
+const MaxTransactionSize = 64 << 10
+
+// SubmitVote takes a signed vote transaction as JSON and adds it to the
+// node's mempool. The node sets it on startup.
+var SubmitVote func(body []byte) error
+
+func SubmitVoteHandler(w http.ResponseWriter, r *http.Request) {
+	submit(w, r, SubmitVote)
+}
+
+func submit(w http.ResponseWriter, r *http.Request, handle func(body []byte) error) {
+	if handle == nil {
+		http.Error(w, "this node does not take transactions", http.StatusServiceUnavailable)
+		return
+	}
+
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, MaxTransactionSize))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := handle(body); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// SubmitElection takes a signed election transaction as JSON and adds it to
+// the node's mempool. The node sets it on startup.
+var SubmitElection func(body []byte) error
+
+func SubmitElectionHandler(w http.ResponseWriter, r *http.Request) {
+	submit(w, r, SubmitElection)
+}
+
+// SubmitRegistration takes a signed voter or candidate registration as JSON
+// and adds it to the node's mempool. The node sets it on startup.
+var SubmitRegistration func(body []byte) error
+
+func SubmitRegistrationHandler(w http.ResponseWriter, r *http.Request) {
+	submit(w, r, SubmitRegistration)
+}
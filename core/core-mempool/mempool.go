@@ -0,0 +1,295 @@
+package coremempool
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	coredatabase "github.com/jneubaum/honestvote.io/core/core-database/src"
+	corehttp "github.com/jneubaum/honestvote.io/core/core-http"
+)
+
+// These are the limits used when none are configured
+const (
+	DefaultMaxSize = 10000
+	DefaultMaxAge  = time.Hour
+)
+
+// ExpireInterval is how often Run drops transactions that are too old
+const ExpireInterval = time.Minute
+
+var (
+	// ErrDuplicate is returned for transactions that are already in the pool
+	ErrDuplicate = errors.New("coremempool: transaction already in the pool")
+	// ErrFull is returned when the pool has no room left
+	ErrFull = errors.New("coremempool: pool is full")
+	// ErrNonceTaken is returned when the signer already has a transaction with that nonce waiting
+	ErrNonceTaken = errors.New("coremempool: nonce already used by a pending transaction")
+	// ErrDuplicateVote is returned when the voter already has a ballot for the election waiting
+	ErrDuplicateVote = errors.New("coremempool: voter already has a pending ballot for this election")
+)
+
+// Verifier decides whether a transaction may enter the pool at time at
+// (unix seconds). It is called again for every pending transaction when
+// the pool is revalidated after a block.
+type Verifier func(tx coredatabase.Transaction, at int64) error
+
+type entry struct {
+	tx     coredatabase.Transaction
+	hash   string
+	signer corehttp.VoterID
+	nonce  uint64
+	ballot string // voter and election of a vote, empty for other transactions
+	size   int
+	added  time.Time
+}
+
+// Mempool holds verified transactions until they are put in a block. Besides
+// what the verifier checks against the ledger it makes sure no two pending
+// transactions share a signer and nonce, and that a voter has at most one
+// pending ballot per election.
+type Mempool struct {
+	mu      sync.Mutex
+	entries map[string]*entry
+	order   []*entry // arrival order
+	nonces  map[corehttp.VoterID]map[uint64]bool
+	ballots map[string]bool
+	verify  Verifier
+	maxSize int
+	maxAge  time.Duration
+}
+
+// NewMempool returns an empty pool that admits transactions verify accepts,
+// holds at most maxSize of them and drops any older than maxAge
+func NewMempool(verify Verifier, maxSize int, maxAge time.Duration) *Mempool {
+	if maxSize <= 0 {
+		maxSize = DefaultMaxSize
+	}
+	if maxAge <= 0 {
+		maxAge = DefaultMaxAge
+	}
+	return &Mempool{
+		entries: make(map[string]*entry),
+		nonces:  make(map[corehttp.VoterID]map[uint64]bool),
+		ballots: make(map[string]bool),
+		verify:  verify,
+		maxSize: maxSize,
+		maxAge:  maxAge,
+	}
+}
+
+// Add verifies tx and puts it in the pool
+func (m *Mempool) Add(tx coredatabase.Transaction) error {
+	e, err := newEntry(tx)
+	if err != nil {
+		return err
+	}
+	if m.Has(e.hash) {
+		return ErrDuplicate
+	}
+	if err := m.verify(tx, time.Now().Unix()); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.entries[e.hash]; ok {
+		return ErrDuplicate
+	}
+	if m.nonces[e.signer][e.nonce] {
+		return ErrNonceTaken
+	}
+	if e.ballot != "" && m.ballots[e.ballot] {
+		return ErrDuplicateVote
+	}
+	if len(m.entries) >= m.maxSize {
+		m.expire()
+		if len(m.entries) >= m.maxSize {
+			return ErrFull
+		}
+	}
+
+	m.add(e)
+	return nil
+}
+
+func newEntry(tx coredatabase.Transaction) (*entry, error) {
+	signer, nonce, err := tx.Signer()
+	if err != nil {
+		return nil, err
+	}
+	e := &entry{
+		tx:     tx,
+		hash:   tx.Hash(),
+		signer: signer,
+		nonce:  nonce,
+		size:   len(tx.Payload),
+		added:  time.Now(),
+	}
+	if tx.Type == coredatabase.TransactionVote {
+		vote, err := coredatabase.DecodeVote(tx)
+		if err != nil {
+			return nil, err
+		}
+		e.ballot = string(vote.VoterID) + "/" + string(vote.ElectionID)
+	}
+	return e, nil
+}
+
+func (m *Mempool) add(e *entry) {
+	m.entries[e.hash] = e
+	m.order = append(m.order, e)
+	if m.nonces[e.signer] == nil {
+		m.nonces[e.signer] = make(map[uint64]bool)
+	}
+	m.nonces[e.signer][e.nonce] = true
+	if e.ballot != "" {
+		m.ballots[e.ballot] = true
+	}
+}
+
+// Has reports whether the transaction with hash is in the pool
+func (m *Mempool) Has(hash string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	_, ok := m.entries[hash]
+	return ok
+}
+
+// Transactions returns everything in the pool in the order it arrived
+func (m *Mempool) Transactions() []coredatabase.Transaction {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	transactions := make([]coredatabase.Transaction, 0, len(m.order))
+	for _, e := range m.order {
+		transactions = append(transactions, e.tx)
+	}
+	return transactions
+}
+
+// Batch picks the next transactions for a block, at most maxCount of them
+// with payloads adding up to at most maxBytes (zero means no limit). Older
+// transactions go first, except that each signer's transactions come out in
+// nonce order so they apply one after the other.
+func (m *Mempool) Batch(maxCount, maxBytes int) []coredatabase.Transaction {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	//Each signer's transactions wait in a queue sorted by nonce
+	queues := make(map[corehttp.VoterID][]*entry)
+	for _, e := range m.order {
+		queue := append(queues[e.signer], e)
+		for i := len(queue) - 1; i > 0 && queue[i].nonce < queue[i-1].nonce; i-- {
+			queue[i], queue[i-1] = queue[i-1], queue[i]
+		}
+		queues[e.signer] = queue
+	}
+
+	var batch []coredatabase.Transaction
+	size := 0
+	for len(queues) > 0 && (maxCount <= 0 || len(batch) < maxCount) {
+		//Take the head that arrived first, ties go to the lower hash so the
+		//order does not depend on map iteration
+		var next *entry
+		for _, queue := range queues {
+			head := queue[0]
+			if next == nil || head.added.Before(next.added) || (head.added.Equal(next.added) && head.hash < next.hash) {
+				next = head
+			}
+		}
+
+		queue := queues[next.signer][1:]
+		if maxBytes > 0 && size+next.size > maxBytes {
+			//Nothing after this one from the same signer can go in either
+			delete(queues, next.signer)
+			continue
+		}
+		if len(queue) == 0 {
+			delete(queues, next.signer)
+		} else {
+			queues[next.signer] = queue
+		}
+
+		batch = append(batch, next.tx)
+		size += next.size
+	}
+	return batch
+}
+
+// Remove drops the transactions with the given hashes, usually because they
+// made it into a block
+func (m *Mempool) Remove(hashes ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	drop := make(map[string]bool)
+	for _, hash := range hashes {
+		drop[hash] = true
+	}
+	m.filter(func(e *entry) bool { return !drop[e.hash] })
+}
+
+// Revalidate runs every pending transaction through the verifier again and
+// drops the ones that no longer pass, such as ballots from voters whose vote
+// was just included in a block
+func (m *Mempool) Revalidate() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now().Unix()
+	m.filter(func(e *entry) bool { return m.verify(e.tx, now) == nil })
+}
+
+// Expire drops transactions that have waited longer than the maximum age
+func (m *Mempool) Expire() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.expire()
+}
+
+func (m *Mempool) expire() {
+	cutoff := time.Now().Add(-m.maxAge)
+	m.filter(func(e *entry) bool { return e.added.After(cutoff) })
+}
+
+// filter keeps only the entries keep returns true for. The caller must hold the lock.
+func (m *Mempool) filter(keep func(e *entry) bool) {
+	order := m.order
+	m.entries = make(map[string]*entry)
+	m.order = nil
+	m.nonces = make(map[corehttp.VoterID]map[uint64]bool)
+	m.ballots = make(map[string]bool)
+	for _, e := range order {
+		if keep(e) {
+			m.add(e)
+		}
+	}
+}
+
+// Run expires old transactions every interval until ctx is cancelled
+func (m *Mempool) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		m.Expire()
+	}
+}
+
+// Len returns the number of transactions in the pool
+func (m *Mempool) Len() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return len(m.entries)
+}
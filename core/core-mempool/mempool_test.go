@@ -0,0 +1,152 @@
+package coremempool
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	coredatabase "github.com/jneubaum/honestvote.io/core/core-database/src"
+	corehttp "github.com/jneubaum/honestvote.io/core/core-http"
+)
+
+var errRejected = errors.New("rejected")
+
+// vote makes an unsigned ballot, which is all the pool looks at
+func vote(t *testing.T, voter corehttp.VoterID, election corehttp.ElectionID, nonce uint64) coredatabase.Transaction {
+	t.Helper()
+
+	v := &coredatabase.VoteTransaction{
+		VoterID:    voter,
+		ElectionID: election,
+		Votes:      []corehttp.Vote{{VoterID: voter, TicketID: "t1", VotePriority: 1}},
+		Nonce:      nonce,
+	}
+	tx, err := v.Transaction()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tx
+}
+
+// rejecting is a verifier that turns down the transactions in reject
+func rejecting(reject map[string]bool) Verifier {
+	return func(tx coredatabase.Transaction, at int64) error {
+		if reject[tx.Hash()] {
+			return errRejected
+		}
+		return nil
+	}
+}
+
+func TestMempoolAdd(t *testing.T) {
+	refused := vote(t, "v3", "e1", 1)
+	m := NewMempool(rejecting(map[string]bool{refused.Hash(): true}), 3, 0)
+
+	steps := []struct {
+		name string
+		tx   coredatabase.Transaction
+		err  error
+	}{
+		{"first ballot", vote(t, "v1", "e1", 1), nil},
+		{"same transaction", vote(t, "v1", "e1", 1), ErrDuplicate},
+		{"nonce taken", vote(t, "v1", "e2", 1), ErrNonceTaken},
+		{"second ballot in an election", vote(t, "v1", "e1", 2), ErrDuplicateVote},
+		{"ballot in another election", vote(t, "v1", "e2", 2), nil},
+		{"rejected by the verifier", refused, errRejected},
+		{"another voter", vote(t, "v2", "e1", 1), nil},
+		{"no room", vote(t, "v4", "e1", 1), ErrFull},
+	}
+	for _, step := range steps {
+		if err := m.Add(step.tx); err != step.err {
+			t.Errorf("%s: expected %v, got %v", step.name, step.err, err)
+		}
+	}
+	if err := m.Add(coredatabase.Transaction{Type: coredatabase.TransactionVote, Payload: []byte("{")}); err == nil {
+		t.Error("admitted a transaction that does not decode")
+	}
+	if m.Len() != 3 {
+		t.Fatal("expected 3 transactions, got", m.Len())
+	}
+}
+
+func TestMempoolEviction(t *testing.T) {
+	reject := make(map[string]bool)
+	m := NewMempool(rejecting(reject), 2, 50*time.Millisecond)
+	first, second := vote(t, "v1", "e1", 1), vote(t, "v2", "e1", 1)
+	for _, tx := range []coredatabase.Transaction{first, second} {
+		if err := m.Add(tx); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	//Removing a transaction frees its nonce and ballot
+	m.Remove(first.Hash())
+	if m.Has(first.Hash()) || m.Len() != 1 {
+		t.Fatal("did not remove the transaction")
+	}
+	if err := m.Add(vote(t, "v1", "e1", 1)); err != nil {
+		t.Fatal("could not add the removed transaction again:", err)
+	}
+
+	//Revalidating drops what the verifier turns down now
+	reject[second.Hash()] = true
+	m.Revalidate()
+	if m.Has(second.Hash()) || m.Len() != 1 {
+		t.Fatal("kept a transaction that no longer verifies")
+	}
+
+	//A full pool makes room by dropping transactions past the maximum age
+	if err := m.Add(vote(t, "v3", "e1", 1)); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Add(vote(t, "v4", "e1", 1)); err != ErrFull {
+		t.Fatal("expected ErrFull, got", err)
+	}
+	time.Sleep(60 * time.Millisecond)
+	if err := m.Add(vote(t, "v4", "e1", 1)); err != nil {
+		t.Fatal("old transactions did not make room:", err)
+	}
+	if m.Len() != 1 {
+		t.Fatal("expected only the new transaction, got", m.Len())
+	}
+	time.Sleep(60 * time.Millisecond)
+	m.Expire()
+	if m.Len() != 0 {
+		t.Fatal("Expire kept an old transaction")
+	}
+}
+
+func TestMempoolBatch(t *testing.T) {
+	m := NewMempool(rejecting(nil), 0, 0)
+	//The later nonce arrives first, but must come out after the earlier
+	//one, which waits behind the other voter's older ballot
+	txs := []coredatabase.Transaction{vote(t, "v1", "e2", 2), vote(t, "v2", "e1", 1), vote(t, "v1", "e1", 1)}
+	for _, tx := range txs {
+		if err := m.Add(tx); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cases := []struct {
+		name     string
+		count    int
+		bytes    int
+		expected []coredatabase.Transaction
+	}{
+		{"everything", 0, 0, []coredatabase.Transaction{txs[1], txs[2], txs[0]}},
+		{"count limit", 2, 0, []coredatabase.Transaction{txs[1], txs[2]}},
+		{"byte limit stops the signer", 0, len(txs[1].Payload) + len(txs[2].Payload) - 1, []coredatabase.Transaction{txs[1]}},
+	}
+	for _, c := range cases {
+		batch := m.Batch(c.count, c.bytes)
+		if len(batch) != len(c.expected) {
+			t.Errorf("%s: expected %d transactions, got %d", c.name, len(c.expected), len(batch))
+			continue
+		}
+		for i := range batch {
+			if batch[i].Hash() != c.expected[i].Hash() {
+				t.Errorf("%s: transaction %d out of order", c.name, i)
+			}
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package corenetwork
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// ErrBadAddress is returned for node addresses that are not a usable host:port
+var ErrBadAddress = errors.New("corenetwork: malformed address")
+
+// NormalizeAddress checks that address is a host:port pair and returns it in
+// a canonical form, so the same node is never stored under two spellings.
+// The host may be an IPv4 or IPv6 address or a hostname, IPv6 addresses must
+// be bracketed ("[::1]:7000"). An empty host is allowed, it means the host
+// has to be filled in from the connection (see ResolveAddress).
+func NormalizeAddress(address string) (string, error) {
+	host, port, err := net.SplitHostPort(strings.TrimSpace(address))
+	if err != nil {
+		return "", ErrBadAddress
+	}
+
+	number, err := strconv.Atoi(port)
+	if err != nil || number < 1 || number > 65535 {
+		return "", ErrBadAddress
+	}
+
+	if ip := net.ParseIP(host); ip != nil {
+		host = ip.String()
+	} else if host != "" {
+		if !validHostname(host) {
+			return "", ErrBadAddress
+		}
+		host = strings.ToLower(strings.TrimSuffix(host, "."))
+	}
+
+	return net.JoinHostPort(host, strconv.Itoa(number)), nil
+}
+
+// DialableAddress is like NormalizeAddress but also requires a host that can
+// actually be dialed, which rules out empty and unspecified hosts
+func DialableAddress(address string) (string, error) {
+	address, err := NormalizeAddress(address)
+	if err != nil {
+		return "", err
+	}
+
+	host, _, _ := net.SplitHostPort(address)
+	if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+		return "", ErrBadAddress
+	}
+	return address, nil
+}
+
+// AdvertiseAddress returns the address to announce to other nodes. If no
+// advertised address is configured the port of the listen address is used
+// with an empty host, the registry and peers then fill in the host our
+// connections come from.
+func AdvertiseAddress(advertise, listen string) (string, error) {
+	if advertise != "" {
+		return NormalizeAddress(advertise)
+	}
+
+	_, port, err := net.SplitHostPort(listen)
+	if err != nil {
+		return "", ErrBadAddress
+	}
+	return NormalizeAddress(net.JoinHostPort("", port))
+}
+
+func validHostname(host string) bool {
+	host = strings.TrimSuffix(host, ".")
+	if host == "" || len(host) > 253 {
+		return false
+	}
+
+	for _, label := range strings.Split(host, ".") {
+		if label == "" || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+				return false
+			}
+		}
+	}
+	return true
+}
@@ -0,0 +1,208 @@
+package corenetwork
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// MaxAddresses is how many addresses an address book holds. Past it the
+// ones seen longest ago are forgotten.
+const MaxAddresses = 1000
+
+// KnownAddress is a node address we have heard of, the last time we heard of
+// it or were connected to it, and whether it is banned
+type KnownAddress struct {
+	Address     string    `json:"address"`
+	NodeID      string    `json:"nodeId,omitempty"`
+	LastSeen    time.Time `json:"lastSeen"`
+	LastSuccess time.Time `json:"lastSuccess"`
+	BannedUntil time.Time `json:"bannedUntil"`
+}
+
+// Banned reports whether the address is banned at time now
+func (k KnownAddress) Banned(now time.Time) bool {
+	return now.Before(k.BannedUntil)
+}
+
+// AddressBook is every node address this node knows about, whether or not
+// it is connected to it right now
+type AddressBook struct {
+	mu        sync.RWMutex
+	addresses map[string]*KnownAddress
+	path      string
+}
+
+// NewAddressBook returns an empty address book
+func NewAddressBook() *AddressBook {
+	return &AddressBook{addresses: make(map[string]*KnownAddress)}
+}
+
+// Add records an address that another node or the registry told us about.
+// Hearing about an address again does not make it look any fresher, only
+// connecting to it does, so dead addresses are the first to go once the
+// book is full, even if peers keep passing them around.
+func (b *AddressBook) Add(address string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if _, ok := b.addresses[address]; !ok {
+		b.addresses[address] = &KnownAddress{Address: address, LastSeen: time.Now()}
+		b.evict()
+	}
+}
+
+// MarkSeen records that we are connected to the node at address right now
+func (b *AddressBook) MarkSeen(address, nodeID string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	known, ok := b.addresses[address]
+	if !ok {
+		known = &KnownAddress{Address: address}
+		b.addresses[address] = known
+	}
+	known.NodeID = nodeID
+	known.LastSeen = time.Now()
+	known.LastSuccess = known.LastSeen
+	b.evict()
+}
+
+// evict forgets the addresses seen longest ago until the book holds no
+// more than MaxAddresses. Banned addresses stay, so a banned node cannot
+// clear its ban by sending us lots of addresses. The caller must hold the
+// lock.
+func (b *AddressBook) evict() {
+	excess := len(b.addresses) - MaxAddresses
+	if excess <= 0 {
+		return
+	}
+
+	now := time.Now()
+	var candidates []*KnownAddress
+	for _, known := range b.addresses {
+		if !known.Banned(now) {
+			candidates = append(candidates, known)
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].LastSeen.Before(candidates[j].LastSeen)
+	})
+	if excess > len(candidates) {
+		excess = len(candidates)
+	}
+	for _, known := range candidates[:excess] {
+		delete(b.addresses, known.Address)
+	}
+}
+
+// Ban keeps the node at address from connecting until the given time
+func (b *AddressBook) Ban(address, nodeID string, until time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	known, ok := b.addresses[address]
+	if !ok {
+		known = &KnownAddress{Address: address, LastSeen: time.Now()}
+		b.addresses[address] = known
+	}
+	if nodeID != "" {
+		known.NodeID = nodeID
+	}
+	known.BannedUntil = until
+}
+
+// Unban lifts a ban on address
+func (b *AddressBook) Unban(address string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if known, ok := b.addresses[address]; ok {
+		known.BannedUntil = time.Time{}
+	}
+}
+
+// Banned reports whether address is currently banned
+func (b *AddressBook) Banned(address string) bool {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	known, ok := b.addresses[address]
+	return ok && known.Banned(time.Now())
+}
+
+// BannedNode reports whether any address of the node with nodeID is currently banned
+func (b *AddressBook) BannedNode(nodeID string) bool {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	now := time.Now()
+	for _, known := range b.addresses {
+		if known.NodeID == nodeID && known.Banned(now) {
+			return true
+		}
+	}
+	return false
+}
+
+// Bans returns the entries that are currently banned
+func (b *AddressBook) Bans() []KnownAddress {
+	now := time.Now()
+	bans := []KnownAddress{}
+	for _, known := range b.Known() {
+		if known.Banned(now) {
+			bans = append(bans, known)
+		}
+	}
+	return bans
+}
+
+// Remove forgets an address
+func (b *AddressBook) Remove(address string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	delete(b.addresses, address)
+}
+
+// Known returns a copy of every entry. Nodes we have actually been connected
+// to come first, most recent first, followed by the ones we only heard of.
+func (b *AddressBook) Known() []KnownAddress {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	known := make([]KnownAddress, 0, len(b.addresses))
+	for _, entry := range b.addresses {
+		known = append(known, *entry)
+	}
+	sort.Slice(known, func(i, j int) bool {
+		if !known[i].LastSuccess.Equal(known[j].LastSuccess) {
+			return known[i].LastSuccess.After(known[j].LastSuccess)
+		}
+		return known[i].LastSeen.After(known[j].LastSeen)
+	})
+	return known
+}
+
+// Addresses returns up to limit addresses that are not banned, best first
+func (b *AddressBook) Addresses(limit int) []string {
+	now := time.Now()
+	addresses := []string{}
+	for _, known := range b.Known() {
+		if len(addresses) == limit {
+			break
+		}
+		if !known.Banned(now) {
+			addresses = append(addresses, known.Address)
+		}
+	}
+	return addresses
+}
+
+// Len returns the number of known addresses
+func (b *AddressBook) Len() int {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	return len(b.addresses)
+}
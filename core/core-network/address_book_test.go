@@ -0,0 +1,38 @@
+package corenetwork
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestAddressBookEvictsStalest(t *testing.T) {
+	b := NewAddressBook()
+	start := time.Now().Add(-time.Hour)
+	for i := 0; i < MaxAddresses; i++ {
+		address := fmt.Sprintf("10.0.0.%d:7000", i)
+		b.Add(address)
+		b.addresses[address].LastSeen = start.Add(time.Duration(i) * time.Second)
+	}
+	//The stalest address is banned and the next one connected, so both stay
+	b.Ban("10.0.0.0:7000", "", time.Now().Add(time.Hour))
+	b.MarkSeen("10.0.0.1:7000", "node1")
+
+	b.Add("10.0.1.0:7000")
+	b.Add("10.0.1.1:7000")
+	if b.Len() != MaxAddresses {
+		t.Fatal("expected", MaxAddresses, "addresses, got", b.Len())
+	}
+	for address, kept := range map[string]bool{
+		"10.0.0.0:7000": true,
+		"10.0.0.1:7000": true,
+		"10.0.0.2:7000": false,
+		"10.0.0.3:7000": false,
+		"10.0.0.4:7000": true,
+		"10.0.1.1:7000": true,
+	} {
+		if _, ok := b.addresses[address]; ok != kept {
+			t.Errorf("%s: expected kept to be %v", address, kept)
+		}
+	}
+}
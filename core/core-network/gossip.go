@@ -0,0 +1,158 @@
+package corenetwork
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"sync"
+	"time"
+
+	corecodec "github.com/jneubaum/honestvote.io/core/core-codec"
+)
+
+// DefaultMaxHops is how many times a gossiped message is relayed before it is dropped
+const DefaultMaxHops = 8
+
+// SeenTTL is how long a message ID is remembered after it was first seen
+const SeenTTL = 10 * time.Minute
+
+// ErrBadEnvelope is returned when a gossiped message's ID does not match its content
+var ErrBadEnvelope = errors.New("corenetwork: gossip envelope does not match its ID")
+
+// Envelope wraps a message that is relayed across the whole network
+type Envelope struct {
+	ID      string                `json:"id"`
+	Hops    int                   `json:"hops"`
+	Type    corecodec.MessageType `json:"type"`
+	Payload []byte                `json:"payload"`
+}
+
+// MessageID is the content hash that identifies a gossiped message
+func MessageID(t corecodec.MessageType, payload []byte) string {
+	hash := sha256.New()
+	hash.Write([]byte{byte(t)})
+	hash.Write(payload)
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// SeenCache remembers message IDs for a while so a message that comes back
+// around a loop in the network is not handled or relayed twice
+type SeenCache struct {
+	mu        sync.Mutex
+	entries   map[string]time.Time
+	ttl       time.Duration
+	lastPrune time.Time
+}
+
+// NewSeenCache returns a cache that forgets IDs ttl after they were added
+func NewSeenCache(ttl time.Duration) *SeenCache {
+	return &SeenCache{entries: make(map[string]time.Time), ttl: ttl, lastPrune: time.Now()}
+}
+
+// Add records id and reports whether it was new
+func (c *SeenCache) Add(id string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(c.lastPrune) > c.ttl {
+		for seen, expires := range c.entries {
+			if now.After(expires) {
+				delete(c.entries, seen)
+			}
+		}
+		c.lastPrune = now
+	}
+
+	if expires, ok := c.entries[id]; ok && now.Before(expires) {
+		return false
+	}
+	c.entries[id] = now.Add(c.ttl)
+	return true
+}
+
+// Remove forgets id, so the message is handled again the next time it arrives
+func (c *SeenCache) Remove(id string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.entries, id)
+}
+
+// Gossip relays messages to every node on the network, not just the ones we
+// are directly connected to. Each message is delivered locally once and
+// passed on to every other peer until it runs out of hops.
+type Gossip struct {
+	manager *PeerManager
+	seen    *SeenCache
+	maxHops int
+	deliver Handler
+}
+
+// NewGossip returns a gossip layer on top of manager. deliver is called once
+// for every new message with the frame that was wrapped in the envelope.
+func NewGossip(manager *PeerManager, maxHops int, deliver Handler) *Gossip {
+	if maxHops <= 0 {
+		maxHops = DefaultMaxHops
+	}
+	return &Gossip{
+		manager: manager,
+		seen:    NewSeenCache(SeenTTL),
+		maxHops: maxHops,
+		deliver: deliver,
+	}
+}
+
+// Publish sends a message that originated on this node to the network
+func (g *Gossip) Publish(t corecodec.MessageType, payload []byte) error {
+	envelope := Envelope{ID: MessageID(t, payload), Type: t, Payload: payload}
+	g.seen.Add(envelope.ID)
+	return g.relay(envelope, nil)
+}
+
+// Receive handles a Gossip frame sent by peer
+func (g *Gossip) Receive(peer *Peer, frame corecodec.Frame) error {
+	var envelope Envelope
+	if err := frame.Unmarshal(&envelope); err != nil {
+		return err
+	}
+
+	//Don't trust the sender's ID, otherwise one message could shadow another
+	if envelope.Type == corecodec.Gossip || envelope.ID != MessageID(envelope.Type, envelope.Payload) {
+		return ErrBadEnvelope
+	}
+	//Hops only ever count up, a negative count would let the message go round forever
+	if envelope.Hops < 0 {
+		return ErrBadEnvelope
+	}
+	if !g.seen.Add(envelope.ID) {
+		return nil
+	}
+
+	//A message the local handler rejects is not passed on to anyone else.
+	//One rejected through no fault of its own, say because it depends on a
+	//block we do not have yet, is forgotten so it is taken when it comes again.
+	if err := g.deliver(peer, corecodec.Frame{Type: envelope.Type, Payload: envelope.Payload}); err != nil {
+		if m, ok := err.(*Misbehavior); ok && m.retry {
+			g.seen.Remove(envelope.ID)
+		}
+		return err
+	}
+
+	//A sender with a higher hop limit than ours may hand us a message that
+	//is already past it, which we take but do not pass on
+	envelope.Hops++
+	if envelope.Hops >= g.maxHops {
+		return nil
+	}
+	return g.relay(envelope, peer)
+}
+
+func (g *Gossip) relay(envelope Envelope, from *Peer) error {
+	frame, err := corecodec.NewFrame(corecodec.Gossip, envelope)
+	if err != nil {
+		return err
+	}
+	g.manager.BroadcastExcept(frame, from)
+	return nil
+}
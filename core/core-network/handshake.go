@@ -0,0 +1,255 @@
+package corenetwork
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	corecodec "github.com/jneubaum/honestvote.io/core/core-codec"
+	corecrypto "github.com/jneubaum/honestvote.io/core/core-crypto"
+)
+
+// ProtocolVersion is the version of the wire protocol this node speaks
+const ProtocolVersion = 1
+
+// MinProtocolVersion is the oldest version this node can still talk to
+const MinProtocolVersion = 1
+
+// HandshakeTimeout bounds how long the whole handshake may take
+const HandshakeTimeout = 10 * time.Second
+
+// Role describes what a node does on the network
+type Role string
+
+// These constants are the roles a node can run as
+const (
+	RoleFull     Role = "full"
+	RolePeer     Role = "peer"
+	RoleObserver Role = "observer"
+)
+
+// ErrBadProof is returned when a peer cannot prove it owns its identity key
+var ErrBadProof = errors.New("corenetwork: handshake signature does not match identity")
+
+// RejectError is returned when the remote node refused the handshake
+type RejectError struct {
+	Reason string
+}
+
+func (e *RejectError) Error() string {
+	return "corenetwork: peer refused handshake: " + e.Reason
+}
+
+// Identity is what a node tells other nodes about itself when it connects
+type Identity struct {
+	Key     ed25519.PrivateKey
+	Address string
+	Role    Role
+	Height  func() uint64
+}
+
+// NodeID returns the identifier derived from the identity key
+func (id *Identity) NodeID() string {
+	return corecrypto.NodeID(id.Key.Public().(ed25519.PublicKey))
+}
+
+// HandshakeMessage is the first message each side sends on a new connection
+type HandshakeMessage struct {
+	Version    uint32 `json:"version"`
+	MinVersion uint32 `json:"minVersion"`
+	NodeID     string `json:"nodeId"`
+	PublicKey  []byte `json:"publicKey"`
+	Address    string `json:"address"`
+	Role       Role   `json:"role"`
+	Height     uint64 `json:"height"`
+	Nonce      []byte `json:"nonce"`
+}
+
+// ProofMessage carries a signature over the other side's nonce
+type ProofMessage struct {
+	Signature []byte `json:"signature"`
+}
+
+// RejectMessage tells the other side why the connection is being refused
+type RejectMessage struct {
+	Reason string `json:"reason"`
+}
+
+func (id *Identity) hello() (HandshakeMessage, error) {
+	nonce, err := corecrypto.NewNonce()
+	if err != nil {
+		return HandshakeMessage{}, err
+	}
+
+	var height uint64
+	if id.Height != nil {
+		height = id.Height()
+	}
+
+	return HandshakeMessage{
+		Version:    ProtocolVersion,
+		MinVersion: MinProtocolVersion,
+		NodeID:     id.NodeID(),
+		PublicKey:  id.Key.Public().(ed25519.PublicKey),
+		Address:    id.Address,
+		Role:       id.Role,
+		Height:     height,
+		Nonce:      nonce,
+	}, nil
+}
+
+func proofPayload(nonce []byte) []byte {
+	return append([]byte("honestvote handshake "), nonce...)
+}
+
+// checkHello makes sure the remote node speaks a compatible version and that
+// its node ID really belongs to the key it sent
+func (id *Identity) checkHello(remote HandshakeMessage) error {
+	if remote.Version < MinProtocolVersion || remote.MinVersion > ProtocolVersion {
+		return fmt.Errorf("incompatible protocol version %d (minimum %d), this node speaks %d (minimum %d)",
+			remote.Version, remote.MinVersion, ProtocolVersion, MinProtocolVersion)
+	}
+	if len(remote.PublicKey) != ed25519.PublicKeySize {
+		return errors.New("malformed public key")
+	}
+	if corecrypto.NodeID(remote.PublicKey) != remote.NodeID {
+		return errors.New("node ID does not match public key")
+	}
+	if remote.NodeID == id.NodeID() {
+		return ErrSelf
+	}
+	if len(remote.Nonce) != corecrypto.NonceSize {
+		return errors.New("malformed nonce")
+	}
+	if _, err := NormalizeAddress(remote.Address); err != nil {
+		return fmt.Errorf("malformed address %q", remote.Address)
+	}
+	if remote.Role != RoleFull && remote.Role != RolePeer && remote.Role != RoleObserver {
+		return fmt.Errorf("unknown role %q", remote.Role)
+	}
+	return nil
+}
+
+func reject(conn net.Conn, reason string) {
+	frame, err := corecodec.NewFrame(corecodec.Reject, RejectMessage{Reason: reason})
+	if err == nil {
+		corecodec.WriteFrame(conn, frame)
+	}
+}
+
+func readMessage(decoder *corecodec.Decoder, want corecodec.MessageType, v interface{}) error {
+	frame, err := decoder.Decode()
+	if err != nil {
+		return err
+	}
+	if frame.Type == corecodec.Reject {
+		var msg RejectMessage
+		frame.Unmarshal(&msg)
+		return &RejectError{Reason: msg.Reason}
+	}
+	if frame.Type != want {
+		return fmt.Errorf("corenetwork: expected message %d during handshake, got %d", want, frame.Type)
+	}
+	return frame.Unmarshal(v)
+}
+
+func writeMessage(conn net.Conn, t corecodec.MessageType, v interface{}) error {
+	frame, err := corecodec.NewFrame(t, v)
+	if err != nil {
+		return err
+	}
+	return corecodec.WriteFrame(conn, frame)
+}
+
+// verifyProof checks that the remote signed our nonce with the key it announced
+func verifyProof(remote HandshakeMessage, nonce []byte, proof ProofMessage) error {
+	if !ed25519.Verify(remote.PublicKey, proofPayload(nonce), proof.Signature) {
+		return ErrBadProof
+	}
+	return nil
+}
+
+// handshakeOutbound runs the dialing side of the handshake:
+//
+//	dialer    -> hello
+//	listener  -> hello, proof of dialer nonce
+//	dialer    -> proof of listener nonce
+//
+// The sides take turns writing so it also works over unbuffered pipes.
+func (id *Identity) handshakeOutbound(conn net.Conn, decoder *corecodec.Decoder) (HandshakeMessage, error) {
+	conn.SetDeadline(time.Now().Add(HandshakeTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	local, err := id.hello()
+	if err != nil {
+		return HandshakeMessage{}, err
+	}
+	if err := writeMessage(conn, corecodec.Handshake, local); err != nil {
+		return HandshakeMessage{}, err
+	}
+
+	var remote HandshakeMessage
+	if err := readMessage(decoder, corecodec.Handshake, &remote); err != nil {
+		return HandshakeMessage{}, err
+	}
+	if err := id.checkHello(remote); err != nil {
+		reject(conn, err.Error())
+		return HandshakeMessage{}, err
+	}
+
+	var proof ProofMessage
+	if err := readMessage(decoder, corecodec.HandshakeProof, &proof); err != nil {
+		return HandshakeMessage{}, err
+	}
+	if err := verifyProof(remote, local.Nonce, proof); err != nil {
+		reject(conn, err.Error())
+		return HandshakeMessage{}, err
+	}
+
+	signature := ed25519.Sign(id.Key, proofPayload(remote.Nonce))
+	if err := writeMessage(conn, corecodec.HandshakeProof, ProofMessage{Signature: signature}); err != nil {
+		return HandshakeMessage{}, err
+	}
+
+	return remote, nil
+}
+
+// handshakeInbound runs the listening side of the handshake
+func (id *Identity) handshakeInbound(conn net.Conn, decoder *corecodec.Decoder) (HandshakeMessage, error) {
+	conn.SetDeadline(time.Now().Add(HandshakeTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	var remote HandshakeMessage
+	if err := readMessage(decoder, corecodec.Handshake, &remote); err != nil {
+		return HandshakeMessage{}, err
+	}
+	if err := id.checkHello(remote); err != nil {
+		reject(conn, err.Error())
+		return HandshakeMessage{}, err
+	}
+
+	local, err := id.hello()
+	if err != nil {
+		return HandshakeMessage{}, err
+	}
+	if err := writeMessage(conn, corecodec.Handshake, local); err != nil {
+		return HandshakeMessage{}, err
+	}
+	signature := ed25519.Sign(id.Key, proofPayload(remote.Nonce))
+	if err := writeMessage(conn, corecodec.HandshakeProof, ProofMessage{Signature: signature}); err != nil {
+		return HandshakeMessage{}, err
+	}
+
+	var proof ProofMessage
+	if err := readMessage(decoder, corecodec.HandshakeProof, &proof); err != nil {
+		return HandshakeMessage{}, err
+	}
+	if err := verifyProof(remote, local.Nonce, proof); err != nil {
+		reject(conn, err.Error())
+		return HandshakeMessage{}, err
+	}
+
+	return remote, nil
+}
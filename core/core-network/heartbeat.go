@@ -0,0 +1,128 @@
+package corenetwork
+
+import (
+	"context"
+	"math/rand"
+	"time"
+
+	corecodec "github.com/jneubaum/honestvote.io/core/core-codec"
+)
+
+// PingInterval is how often every peer is pinged
+const PingInterval = 15 * time.Second
+
+// IdleTimeout is how long a peer may go without sending anything before it
+// is considered dead and disconnected
+const IdleTimeout = 60 * time.Second
+
+// PingMessage is answered with a PongMessage carrying the same nonce
+type PingMessage struct {
+	Nonce uint64 `json:"nonce"`
+}
+
+// PongMessage answers a PingMessage
+type PongMessage struct {
+	Nonce uint64 `json:"nonce"`
+}
+
+type heartbeat struct {
+	lastReceived time.Time
+	pingNonce    uint64
+	pingSent     time.Time
+	latency      time.Duration
+}
+
+// LastReceived returns when the peer last sent us anything
+func (p *Peer) LastReceived() time.Time {
+	p.heartbeatMu.Lock()
+	defer p.heartbeatMu.Unlock()
+
+	return p.heartbeat.lastReceived
+}
+
+// Latency returns the round trip time of the last answered ping, zero if
+// there has not been one yet
+func (p *Peer) Latency() time.Duration {
+	p.heartbeatMu.Lock()
+	defer p.heartbeatMu.Unlock()
+
+	return p.heartbeat.latency
+}
+
+func (p *Peer) received() {
+	p.heartbeatMu.Lock()
+	defer p.heartbeatMu.Unlock()
+
+	p.heartbeat.lastReceived = time.Now()
+}
+
+// ping sends a new ping, replacing any that is still unanswered
+func (p *Peer) ping() error {
+	p.heartbeatMu.Lock()
+	nonce := rand.Uint64()
+	p.heartbeat.pingNonce = nonce
+	p.heartbeat.pingSent = time.Now()
+	p.heartbeatMu.Unlock()
+
+	frame, err := corecodec.NewFrame(corecodec.Ping, PingMessage{Nonce: nonce})
+	if err != nil {
+		return err
+	}
+	return p.Send(frame)
+}
+
+// receiveHeartbeat answers pings and times pongs. It reports whether frame
+// was a heartbeat message.
+func (p *Peer) receiveHeartbeat(frame corecodec.Frame) (bool, error) {
+	switch frame.Type {
+	case corecodec.Ping:
+		var ping PingMessage
+		if err := frame.Unmarshal(&ping); err != nil {
+			return true, err
+		}
+		pong, err := corecodec.NewFrame(corecodec.Pong, PongMessage{Nonce: ping.Nonce})
+		if err != nil {
+			return true, err
+		}
+		p.Send(pong)
+		return true, nil
+	case corecodec.Pong:
+		var pong PongMessage
+		if err := frame.Unmarshal(&pong); err != nil {
+			return true, err
+		}
+		p.heartbeatMu.Lock()
+		if pong.Nonce == p.heartbeat.pingNonce && !p.heartbeat.pingSent.IsZero() {
+			p.heartbeat.latency = time.Since(p.heartbeat.pingSent)
+			p.heartbeat.pingSent = time.Time{}
+		}
+		p.heartbeatMu.Unlock()
+		return true, nil
+	}
+	return false, nil
+}
+
+// Heartbeat pings every peer each interval and disconnects the ones that
+// have not sent anything for idleTimeout. It runs until ctx is cancelled.
+func (pm *PeerManager) Heartbeat(ctx context.Context, interval, idleTimeout time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		for _, peer := range pm.Peers() {
+			if time.Since(peer.LastReceived()) > idleTimeout {
+				peer.Close()
+				continue
+			}
+			if err := peer.ping(); err != nil {
+				peer.Close()
+			}
+		}
+	}
+}
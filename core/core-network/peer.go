@@ -0,0 +1,66 @@
+package corenetwork
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	corecodec "github.com/jneubaum/honestvote.io/core/core-codec"
+)
+
+// WriteTimeout bounds how long a single frame write may block on a slow peer
+const WriteTimeout = 10 * time.Second
+
+// Peer is an open connection to another node that has completed the handshake
+type Peer struct {
+	NodeID  string
+	Address string
+	Role    Role
+	Version uint32
+	Height  uint64
+	Socket  net.Conn
+	Inbound bool
+
+	score     *score
+	writeMu   sync.Mutex
+	closeOnce sync.Once
+
+	heartbeatMu sync.Mutex
+	heartbeat   heartbeat
+}
+
+// NewPeer wraps a connection to the node that introduced itself with hello
+// and is reachable at address
+func NewPeer(hello HandshakeMessage, address string, socket net.Conn, inbound bool) *Peer {
+	return &Peer{
+		NodeID:  hello.NodeID,
+		Address: address,
+		Role:    hello.Role,
+		Version: hello.Version,
+		Height:  hello.Height,
+		Socket:  socket,
+		Inbound: inbound,
+		score:   newScore(),
+		heartbeat: heartbeat{
+			lastReceived: time.Now(),
+		},
+	}
+}
+
+// Send writes a frame to the peer. It is safe to call from several goroutines.
+func (p *Peer) Send(f corecodec.Frame) error {
+	p.writeMu.Lock()
+	defer p.writeMu.Unlock()
+
+	p.Socket.SetWriteDeadline(time.Now().Add(WriteTimeout))
+	return corecodec.WriteFrame(p.Socket, f)
+}
+
+// Close shuts the connection down. Calling it more than once is harmless.
+func (p *Peer) Close() error {
+	var err error
+	p.closeOnce.Do(func() {
+		err = p.Socket.Close()
+	})
+	return err
+}
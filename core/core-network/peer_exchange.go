@@ -0,0 +1,122 @@
+package corenetwork
+
+import (
+	"context"
+	"log"
+	"time"
+
+	corecodec "github.com/jneubaum/honestvote.io/core/core-codec"
+)
+
+// DefaultTargetOutbound is how many outbound connections a node tries to keep open
+const DefaultTargetOutbound = 8
+
+// PeerExchangeInterval is how often a node asks its peers for more addresses
+const PeerExchangeInterval = 30 * time.Second
+
+// MaxPeerExchange is the most addresses sent in one Peers message
+const MaxPeerExchange = 100
+
+// PeerExchange grows the mesh: it asks connected peers which nodes they know
+// about, keeps what it learns in the address book and dials new addresses
+// until the node has enough outbound connections
+type PeerExchange struct {
+	manager        *PeerManager
+	book           *AddressBook
+	targetOutbound int
+}
+
+// NewPeerExchange returns a peer exchange that fills manager from book
+func NewPeerExchange(manager *PeerManager, book *AddressBook, targetOutbound int) *PeerExchange {
+	if targetOutbound <= 0 {
+		targetOutbound = DefaultTargetOutbound
+	}
+	return &PeerExchange{manager: manager, book: book, targetOutbound: targetOutbound}
+}
+
+// Receive handles GetPeers and Peers frames
+func (x *PeerExchange) Receive(peer *Peer, frame corecodec.Frame) error {
+	switch frame.Type {
+	case corecodec.GetPeers:
+		var addresses []string
+		for _, address := range x.book.Addresses(MaxPeerExchange + 1) {
+			if address != peer.Address && len(addresses) < MaxPeerExchange {
+				addresses = append(addresses, address)
+			}
+		}
+		reply, err := corecodec.NewFrame(corecodec.Peers, PeerList{Addresses: addresses})
+		if err != nil {
+			return err
+		}
+		return peer.Send(reply)
+	case corecodec.Peers:
+		var list PeerList
+		if err := frame.Unmarshal(&list); err != nil {
+			return err
+		}
+		for i, address := range list.Addresses {
+			if i == MaxPeerExchange {
+				break
+			}
+			//Skip anything we could not dial rather than filling the book with it
+			address, err := DialableAddress(address)
+			if err != nil {
+				continue
+			}
+			x.book.Add(address)
+		}
+		x.Fill()
+	}
+	return nil
+}
+
+// Connected records a peer that just finished the handshake in the address book
+func (x *PeerExchange) Connected(peer *Peer) {
+	x.book.MarkSeen(peer.Address, peer.NodeID)
+}
+
+// Fill dials addresses from the book until the outbound target is reached
+func (x *PeerExchange) Fill() {
+	need := x.targetOutbound - x.manager.OutboundLen()
+	if need <= 0 {
+		return
+	}
+
+	for _, address := range x.book.Addresses(x.book.Len()) {
+		if need == 0 {
+			return
+		}
+		if x.manager.Connected(address) {
+			continue
+		}
+		need--
+		go func(address string) {
+			err := x.manager.Connect(address)
+			if err == ErrSelf || err == ErrBadAddress {
+				x.book.Remove(address)
+			} else if _, ok := err.(*RejectError); ok {
+				log.Println(address, err)
+			}
+		}(address)
+	}
+}
+
+// Run asks peers for addresses and tops up outbound connections until ctx
+// is cancelled
+func (x *PeerExchange) Run(ctx context.Context) {
+	ticker := time.NewTicker(PeerExchangeInterval)
+	defer ticker.Stop()
+
+	for {
+		if x.manager.OutboundLen() < x.targetOutbound {
+			x.manager.Broadcast(corecodec.Frame{Type: corecodec.GetPeers})
+		}
+		x.Fill()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,435 @@
+package corenetwork
+
+import (
+	"errors"
+	"log"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	corecodec "github.com/jneubaum/honestvote.io/core/core-codec"
+)
+
+// DefaultMaxPeers is the peer limit used when none is configured
+const DefaultMaxPeers = 25
+
+// These bound the exponential backoff between attempts to reach a peer
+const (
+	BackoffBase          = 1 * time.Second
+	BackoffMax           = 5 * time.Minute
+	MaxReconnectAttempts = 8
+)
+
+var (
+	// ErrTooManyPeers is returned when the peer limit has been reached
+	ErrTooManyPeers = errors.New("corenetwork: peer limit reached")
+	// ErrAlreadyConnected is returned when there is already a connection to the address
+	ErrAlreadyConnected = errors.New("corenetwork: already connected to peer")
+	// ErrBackoff is returned when a peer failed recently and should not be dialed yet
+	ErrBackoff = errors.New("corenetwork: peer is backing off")
+	// ErrSelf is returned when asked to connect to this node
+	ErrSelf = errors.New("corenetwork: refusing to connect to self")
+	// ErrClosed is returned once the manager has been shut down
+	ErrClosed = errors.New("corenetwork: peer manager is shut down")
+)
+
+// Handler is called for every frame a connected peer sends. An error means
+// the peer sent something it should not have and costs it score.
+type Handler func(peer *Peer, frame corecodec.Frame) error
+
+type backoff struct {
+	attempts int
+	next     time.Time
+}
+
+func (b *backoff) delay() time.Duration {
+	delay := BackoffMax
+	if b.attempts < 20 {
+		delay = BackoffBase << uint(b.attempts)
+	}
+	if delay > BackoffMax {
+		delay = BackoffMax
+	}
+	//Jitter keeps two nodes that dropped each other from redialing in lockstep
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// PeerManager owns the set of connected peers. Every goroutine that needs to
+// look at or talk to peers goes through it instead of sharing a map.
+type PeerManager struct {
+	mu       sync.RWMutex
+	peers    map[string]*Peer // keyed by node ID
+	dialing  map[string]bool
+	backoff  map[string]*backoff
+	self     map[string]bool
+	maxPeers int
+	identity *Identity
+	handler  Handler
+	closed   bool
+
+	// handling is held for reading while a frame is being handled, so
+	// Shutdown can wait for in-flight messages by taking it for writing
+	handling sync.RWMutex
+
+	// These are optional and must be set before the manager starts
+	// accepting or dialing. OnConnect is called after a peer completes the
+	// handshake, Book records bans and BanDuration is how long they last.
+	// Transport defaults to plain TCP.
+	OnConnect   func(peer *Peer)
+	Book        *AddressBook
+	BanDuration time.Duration
+	Transport   Transport
+}
+
+// NewPeerManager returns a manager that introduces itself to peers with
+// identity, keeps at most maxPeers connections and passes incoming frames
+// to handler
+func NewPeerManager(identity *Identity, maxPeers int, handler Handler) *PeerManager {
+	if maxPeers <= 0 {
+		maxPeers = DefaultMaxPeers
+	}
+	return &PeerManager{
+		peers:    make(map[string]*Peer),
+		dialing:  make(map[string]bool),
+		backoff:  make(map[string]*backoff),
+		self:     make(map[string]bool),
+		maxPeers: maxPeers,
+		identity: identity,
+		handler:  handler,
+	}
+}
+
+// Identity returns the identity this node presents to peers
+func (pm *PeerManager) Identity() *Identity {
+	return pm.identity
+}
+
+// SetSelf records an address that belongs to this node so it is never dialed
+func (pm *PeerManager) SetSelf(address string) {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	pm.self[address] = true
+}
+
+// Connected reports whether there is an open connection to address
+func (pm *PeerManager) Connected(address string) bool {
+	pm.mu.RLock()
+	defer pm.mu.RUnlock()
+
+	return pm.connected(address)
+}
+
+func (pm *PeerManager) connected(address string) bool {
+	for _, peer := range pm.peers {
+		if peer.Address == address {
+			return true
+		}
+	}
+	return false
+}
+
+// Len returns the number of connected peers
+func (pm *PeerManager) Len() int {
+	pm.mu.RLock()
+	defer pm.mu.RUnlock()
+
+	return len(pm.peers)
+}
+
+// OutboundLen returns the number of connected peers that this node dialed
+func (pm *PeerManager) OutboundLen() int {
+	pm.mu.RLock()
+	defer pm.mu.RUnlock()
+
+	outbound := 0
+	for _, peer := range pm.peers {
+		if !peer.Inbound {
+			outbound++
+		}
+	}
+	return outbound
+}
+
+// Peers returns a snapshot of the connected peers
+func (pm *PeerManager) Peers() []*Peer {
+	pm.mu.RLock()
+	defer pm.mu.RUnlock()
+
+	peers := make([]*Peer, 0, len(pm.peers))
+	for _, peer := range pm.peers {
+		peers = append(peers, peer)
+	}
+	return peers
+}
+
+// Broadcast sends frame to every connected peer. A peer whose socket fails is
+// closed, which removes it from the manager once its read loop exits.
+func (pm *PeerManager) Broadcast(frame corecodec.Frame) {
+	pm.BroadcastExcept(frame, nil)
+}
+
+// BroadcastExcept sends frame to every connected peer other than except
+func (pm *PeerManager) BroadcastExcept(frame corecodec.Frame, except *Peer) {
+	for _, peer := range pm.Peers() {
+		if peer == except {
+			continue
+		}
+		if err := peer.Send(frame); err != nil {
+			peer.Close()
+		}
+	}
+}
+
+// Connect dials address and starts serving the connection in the background.
+// Nothing happens if the address is this node, is already connected or being
+// dialed, or is still backing off from an earlier failure.
+func (pm *PeerManager) Connect(address string) error {
+	address, err := DialableAddress(address)
+	if err != nil {
+		return err
+	}
+
+	pm.mu.Lock()
+	if pm.closed {
+		pm.mu.Unlock()
+		return ErrClosed
+	}
+	if pm.self[address] {
+		pm.mu.Unlock()
+		return ErrSelf
+	}
+	if pm.connected(address) || pm.dialing[address] {
+		pm.mu.Unlock()
+		return ErrAlreadyConnected
+	}
+	if b, ok := pm.backoff[address]; ok && time.Now().Before(b.next) {
+		pm.mu.Unlock()
+		return ErrBackoff
+	}
+	if pm.banned(address, "") {
+		pm.mu.Unlock()
+		return ErrBanned
+	}
+	if len(pm.peers) >= pm.maxPeers {
+		pm.mu.Unlock()
+		return ErrTooManyPeers
+	}
+	pm.dialing[address] = true
+	pm.mu.Unlock()
+
+	peer, decoder, err := pm.dial(address)
+
+	pm.mu.Lock()
+	delete(pm.dialing, address)
+	if err == ErrSelf {
+		pm.self[address] = true
+	} else if err != nil {
+		b, ok := pm.backoff[address]
+		if !ok {
+			b = &backoff{}
+			pm.backoff[address] = b
+		}
+		b.next = time.Now().Add(b.delay())
+		b.attempts++
+	} else {
+		delete(pm.backoff, address)
+	}
+	pm.mu.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	go pm.serve(peer, decoder)
+	return nil
+}
+
+func (pm *PeerManager) dial(address string) (*Peer, *corecodec.Decoder, error) {
+	transport := pm.Transport
+	if transport == nil {
+		transport = TCPTransport{}
+	}
+	conn, err := transport.Dial(address)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	decoder := corecodec.NewDecoder(conn)
+	hello, err := pm.identity.handshakeOutbound(conn, decoder)
+	if err != nil {
+		conn.Close()
+		//Our own listener is the one that notices we dialed ourselves
+		if reject, ok := err.(*RejectError); ok && reject.Reason == ErrSelf.Error() {
+			err = ErrSelf
+		}
+		return nil, nil, err
+	}
+	if err := checkTransportKey(conn, hello); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+
+	if pm.banned(address, hello.NodeID) {
+		reject(conn, "banned")
+		conn.Close()
+		return nil, nil, ErrBanned
+	}
+
+	peer := NewPeer(hello, address, conn, false)
+	if err := pm.add(peer); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+
+	return peer, decoder, nil
+}
+
+// Accept serves an inbound connection once the remote node has completed the handshake
+func (pm *PeerManager) Accept(conn net.Conn) {
+	decoder := corecodec.NewDecoder(conn)
+
+	hello, err := pm.identity.handshakeInbound(conn, decoder)
+	if err == nil {
+		err = checkTransportKey(conn, hello)
+	}
+	if err != nil {
+		log.Println("Handshake with", conn.RemoteAddr(), "failed:", err)
+		conn.Close()
+		return
+	}
+
+	address, err := ResolveAddress(hello.Address, conn.RemoteAddr())
+	if err != nil {
+		conn.Close()
+		return
+	}
+
+	if pm.banned(address, hello.NodeID) {
+		reject(conn, "banned")
+		conn.Close()
+		return
+	}
+
+	peer := NewPeer(hello, address, conn, true)
+	if err := pm.add(peer); err != nil {
+		conn.Close()
+		return
+	}
+
+	pm.serve(peer, decoder)
+}
+
+// add registers a peer that finished the handshake. When two nodes dial each
+// other at the same time both connections get this far, so both sides keep
+// the connection opened by the node with the lower ID and drop the other.
+func (pm *PeerManager) add(peer *Peer) error {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	if pm.closed {
+		return ErrClosed
+	}
+	if existing, ok := pm.peers[peer.NodeID]; ok {
+		if pm.initiator(peer) >= pm.initiator(existing) {
+			return ErrAlreadyConnected
+		}
+		existing.Close()
+	} else if len(pm.peers) >= pm.maxPeers {
+		return ErrTooManyPeers
+	}
+	pm.peers[peer.NodeID] = peer
+	return nil
+}
+
+// initiator returns the ID of the node that opened the connection to peer
+func (pm *PeerManager) initiator(peer *Peer) string {
+	if peer.Inbound {
+		return peer.NodeID
+	}
+	return pm.identity.NodeID()
+}
+
+func (pm *PeerManager) remove(peer *Peer) {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	if pm.peers[peer.NodeID] == peer {
+		delete(pm.peers, peer.NodeID)
+	}
+}
+
+// serve reads frames from the peer until the connection drops, then removes
+// the peer and, if we dialed it, tries to get the connection back
+func (pm *PeerManager) serve(peer *Peer, decoder *corecodec.Decoder) {
+	if pm.OnConnect != nil {
+		pm.OnConnect(peer)
+	}
+
+	//A peer that told us it is leaving is not redialed
+	redial := !peer.Inbound
+	defer func() {
+		pm.remove(peer)
+		peer.Close()
+		if redial {
+			go pm.reconnect(peer.Address)
+		}
+	}()
+
+	for {
+		frame, err := decoder.Decode()
+		if err == corecodec.ErrFrameTooLarge {
+			pm.Penalize(peer, PenaltyOversizedFrame, err.Error())
+			return
+		}
+		if err != nil {
+			return
+		}
+		peer.received()
+
+		if frame.Type == corecodec.Disconnect {
+			var msg DisconnectMessage
+			frame.Unmarshal(&msg)
+			log.Println(peer.Address, "disconnected:", msg.Reason)
+			redial = false
+			return
+		}
+
+		if !peer.score.allow() {
+			pm.Penalize(peer, PenaltySpam, "sending too many messages")
+			continue
+		}
+		if !pm.handle(peer, frame) {
+			return
+		}
+	}
+}
+
+// reconnect redials a dropped outbound peer, waiting out the exponential
+// backoff that Connect records after every failed attempt. It gives up on
+// a peer that got banned, which will not be any less banned next time.
+func (pm *PeerManager) reconnect(address string) {
+	for attempt := 0; attempt < MaxReconnectAttempts; attempt++ {
+		time.Sleep(pm.retryIn(address))
+
+		switch pm.Connect(address) {
+		case nil, ErrAlreadyConnected, ErrSelf, ErrTooManyPeers, ErrClosed, ErrBanned:
+			return
+		}
+	}
+}
+
+// retryIn returns how long to wait before address may be dialed again
+func (pm *PeerManager) retryIn(address string) time.Duration {
+	pm.mu.RLock()
+	defer pm.mu.RUnlock()
+
+	if b, ok := pm.backoff[address]; ok {
+		if wait := time.Until(b.next); wait > 0 {
+			return wait
+		}
+		return 0
+	}
+	return BackoffBase
+}
@@ -0,0 +1,87 @@
+package corenetwork
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// PeerstoreInterval is how often the address book is written to disk
+const PeerstoreInterval = time.Minute
+
+// LoadAddressBook reads the peerstore at path so a restarted node can go
+// straight back to its previous neighbours. A missing file gives an empty
+// book that will be saved to path.
+func LoadAddressBook(path string) (*AddressBook, error) {
+	book := NewAddressBook()
+	book.path = path
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return book, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var known []KnownAddress
+	if err := json.Unmarshal(data, &known); err != nil {
+		return nil, err
+	}
+	for i := range known {
+		book.addresses[known[i].Address] = &known[i]
+	}
+	book.evict()
+
+	return book, nil
+}
+
+// Save writes the address book to its peerstore file. The file is replaced
+// in one rename so a crash halfway through never leaves it truncated.
+func (b *AddressBook) Save() error {
+	if b.path == "" {
+		return nil
+	}
+
+	data, err := json.MarshalIndent(b.Known(), "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(b.path), ".peers-")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	return os.Rename(tmp.Name(), b.path)
+}
+
+// Persist saves the address book every interval until ctx is cancelled
+func (b *AddressBook) Persist(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := b.Save(); err != nil {
+			log.Println("Saving peerstore failed:", err)
+		}
+	}
+}
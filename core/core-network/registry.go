@@ -0,0 +1,193 @@
+package corenetwork
+
+import (
+	"errors"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	corecodec "github.com/jneubaum/honestvote.io/core/core-codec"
+)
+
+// RegistryTTL is how long a registration is kept without being renewed
+const RegistryTTL = 2 * time.Minute
+
+// RegistryInterval is how often nodes renew their registration and refresh their peer list
+const RegistryInterval = 5 * time.Second
+
+// DialTimeout bounds how long a node waits when opening a connection
+const DialTimeout = 5 * time.Second
+
+// RegisterMessage is sent by a node to announce the address other nodes can reach it on
+type RegisterMessage struct {
+	Address string `json:"address"`
+}
+
+// PeerList is the answer to a GetPeers message
+type PeerList struct {
+	Self      string   `json:"self,omitempty"`
+	Addresses []string `json:"addresses"`
+}
+
+// Registry is the bootstrap service nodes register with to find each other
+type Registry struct {
+	mu    sync.Mutex
+	nodes map[string]time.Time
+	ttl   time.Duration
+}
+
+// NewRegistry returns an empty registry whose entries expire after ttl
+func NewRegistry(ttl time.Duration) *Registry {
+	return &Registry{nodes: make(map[string]time.Time), ttl: ttl}
+}
+
+// Register records address as a live node
+func (r *Registry) Register(address string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.nodes[address] = time.Now().Add(r.ttl)
+}
+
+// List returns the live addresses other than exclude, dropping expired entries
+func (r *Registry) List(exclude string) []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	addresses := []string{}
+	for address, expires := range r.nodes {
+		if now.After(expires) {
+			delete(r.nodes, address)
+			continue
+		}
+		if address != exclude {
+			addresses = append(addresses, address)
+		}
+	}
+	sort.Strings(addresses)
+
+	return addresses
+}
+
+// Serve accepts registry connections on listener until it is closed
+func (r *Registry) Serve(listener net.Listener) error {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		go r.handleConn(conn)
+	}
+}
+
+func (r *Registry) handleConn(conn net.Conn) {
+	defer conn.Close()
+
+	decoder := corecodec.NewDecoder(conn)
+	self := ""
+
+	for {
+		conn.SetReadDeadline(time.Now().Add(RegistryTTL))
+		frame, err := decoder.Decode()
+		if err != nil {
+			return
+		}
+
+		switch frame.Type {
+		case corecodec.Register:
+			var msg RegisterMessage
+			if err := frame.Unmarshal(&msg); err != nil {
+				return
+			}
+			address, err := ResolveAddress(msg.Address, conn.RemoteAddr())
+			if err != nil {
+				return
+			}
+			self = address
+			r.Register(address)
+		case corecodec.GetPeers:
+			reply, err := corecodec.NewFrame(corecodec.Peers, PeerList{Self: self, Addresses: r.List(self)})
+			if err != nil {
+				return
+			}
+			if err := corecodec.WriteFrame(conn, reply); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// Bootstrap registers address with the registry at registryAddress and returns
+// the address the registry recorded for this node along with every other node
+// it knows about
+func Bootstrap(registryAddress, address string) (string, []string, error) {
+	conn, err := net.DialTimeout("tcp", registryAddress, DialTimeout)
+	if err != nil {
+		return "", nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(DialTimeout))
+
+	register, err := corecodec.NewFrame(corecodec.Register, RegisterMessage{Address: address})
+	if err != nil {
+		return "", nil, err
+	}
+	if err := corecodec.WriteFrame(conn, register); err != nil {
+		return "", nil, err
+	}
+	if err := corecodec.WriteFrame(conn, corecodec.Frame{Type: corecodec.GetPeers}); err != nil {
+		return "", nil, err
+	}
+
+	frame, err := corecodec.NewDecoder(conn).Decode()
+	if err != nil {
+		return "", nil, err
+	}
+	if frame.Type != corecodec.Peers {
+		return "", nil, errors.New("corenetwork: unexpected reply from registry")
+	}
+
+	var list PeerList
+	if err := frame.Unmarshal(&list); err != nil {
+		return "", nil, err
+	}
+
+	return list.Self, list.Addresses, nil
+}
+
+// ResolveAddress turns an advertised address into one that can be dialed.
+// Nodes that do not know their public host advertise just ":port" (or an
+// unspecified host like 0.0.0.0), in which case the host the connection
+// came from is used instead.
+func ResolveAddress(advertised string, remote net.Addr) (string, error) {
+	advertised, err := NormalizeAddress(advertised)
+	if err != nil {
+		return "", err
+	}
+	host, port, _ := net.SplitHostPort(advertised)
+
+	if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+		remoteHost, _, err := net.SplitHostPort(remote.String())
+		if err != nil {
+			return "", err
+		}
+		host = remoteHost
+	}
+
+	return NormalizeAddress(net.JoinHostPort(host, port))
+}
+
+// ParseBootstrap splits a comma separated list of registry addresses
+func ParseBootstrap(list string) []string {
+	var addresses []string
+	for _, address := range strings.Split(list, ",") {
+		address = strings.TrimSpace(address)
+		if address != "" {
+			addresses = append(addresses, address)
+		}
+	}
+	return addresses
+}
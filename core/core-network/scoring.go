@@ -0,0 +1,180 @@
+package corenetwork
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"time"
+)
+
+// DefaultBanDuration is how long a misbehaving peer is banned when no duration is configured
+const DefaultBanDuration = 24 * time.Hour
+
+// BanThreshold is the score at which a peer is disconnected and banned
+const BanThreshold = -100
+
+// These are the score penalties for each kind of misbehaviour
+const (
+	PenaltyUnknownMessage   = 2
+	PenaltySpam             = 5
+	PenaltyMalformed        = 10
+	PenaltyInvalidSignature = 50
+	PenaltyOversizedFrame   = 100
+)
+
+// ScoreRecovery is how long it takes a peer to win back one point of score
+const ScoreRecovery = 10 * time.Second
+
+// These limit how many frames a peer may send before it counts as spam
+const (
+	MessagesPerSecond = 100
+	MessageBurst      = 200
+)
+
+var (
+	// ErrUnknownMessage is returned by handlers for message types they do not understand
+	ErrUnknownMessage = errors.New("corenetwork: unknown message type")
+	// ErrBanned is returned when asked to connect to a banned node
+	ErrBanned = errors.New("corenetwork: node is banned")
+)
+
+// Misbehavior is an error from handling a peer's message that says how much
+// score the peer should lose for it. Handlers return any other error for a
+// message that could not be decoded, which costs PenaltyMalformed.
+type Misbehavior struct {
+	Penalty int
+	Reason  string
+
+	//retry is set for messages that may be taken if they arrive again later
+	retry bool
+}
+
+func (m *Misbehavior) Error() string {
+	return m.Reason
+}
+
+// InvalidSignature returns the misbehaviour for a message whose signature does not verify
+func InvalidSignature(err error) error {
+	return &Misbehavior{Penalty: PenaltyInvalidSignature, Reason: err.Error()}
+}
+
+// Rejected returns the error for a message that is refused without it being
+// the peer's fault, for example one that depends on state this node does
+// not have yet. It is not relayed but costs no score.
+func Rejected(err error) error {
+	return &Misbehavior{Penalty: 0, Reason: err.Error(), retry: true}
+}
+
+// Ignored returns the error for a message that is dropped because there is
+// nothing new in it, for example a block we already have that arrived under
+// another gossip ID. It is not relayed and costs no score.
+func Ignored(err error) error {
+	return &Misbehavior{Penalty: 0, Reason: err.Error()}
+}
+
+func penaltyFor(err error) int {
+	if m, ok := err.(*Misbehavior); ok {
+		return m.Penalty
+	}
+	if err == ErrUnknownMessage {
+		return PenaltyUnknownMessage
+	}
+	return PenaltyMalformed
+}
+
+// score tracks how well a peer has behaved along with its message rate
+type score struct {
+	mu      sync.Mutex
+	value   int
+	updated time.Time
+	tokens  float64
+	refill  time.Time
+}
+
+func newScore() *score {
+	now := time.Now()
+	return &score{updated: now, tokens: MessageBurst, refill: now}
+}
+
+// add applies delta after crediting back whatever the peer has recovered
+// since the last change and returns the new value
+func (s *score) add(delta int) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	if recovered := int(now.Sub(s.updated) / ScoreRecovery); recovered > 0 {
+		s.value += recovered
+		if s.value > 0 {
+			s.value = 0
+		}
+		s.updated = s.updated.Add(time.Duration(recovered) * ScoreRecovery)
+	}
+	if s.value == 0 {
+		s.updated = now
+	}
+	s.value += delta
+	return s.value
+}
+
+// allow takes one token from the rate limiter
+func (s *score) allow() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	s.tokens += now.Sub(s.refill).Seconds() * MessagesPerSecond
+	if s.tokens > MessageBurst {
+		s.tokens = MessageBurst
+	}
+	s.refill = now
+
+	if s.tokens < 1 {
+		return false
+	}
+	s.tokens--
+	return true
+}
+
+// Score returns the peer's current misbehaviour score, zero being a clean record
+func (p *Peer) Score() int {
+	return p.score.add(0)
+}
+
+// Penalize lowers the peer's score. A peer that falls to BanThreshold is
+// disconnected and banned from reconnecting for the manager's BanDuration.
+func (pm *PeerManager) Penalize(peer *Peer, penalty int, reason string) {
+	value := peer.score.add(-penalty)
+	if value > BanThreshold {
+		return
+	}
+
+	duration := pm.BanDuration
+	if duration <= 0 {
+		duration = DefaultBanDuration
+	}
+	log.Printf("Banning %s (%s) for %s: %s", peer.NodeID, peer.Address, duration, reason)
+	pm.Ban(peer.Address, peer.NodeID, duration)
+	peer.Close()
+}
+
+// Ban records a ban for the node and disconnects it if it is connected
+func (pm *PeerManager) Ban(address, nodeID string, duration time.Duration) {
+	if pm.Book != nil {
+		pm.Book.Ban(address, nodeID, time.Now().Add(duration))
+	}
+
+	pm.mu.RLock()
+	peer, ok := pm.peers[nodeID]
+	pm.mu.RUnlock()
+	if ok {
+		peer.Close()
+	}
+}
+
+func (pm *PeerManager) banned(address, nodeID string) bool {
+	if pm.Book == nil {
+		return false
+	}
+	return pm.Book.Banned(address) || (nodeID != "" && pm.Book.BannedNode(nodeID))
+}
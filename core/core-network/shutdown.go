@@ -0,0 +1,88 @@
+package corenetwork
+
+import (
+	"context"
+	"sync"
+
+	corecodec "github.com/jneubaum/honestvote.io/core/core-codec"
+)
+
+// DisconnectMessage tells a peer the connection is being closed on purpose,
+// so it does not try to redial
+type DisconnectMessage struct {
+	Reason string `json:"reason"`
+}
+
+// handle passes frame to the handler unless the manager is shutting down.
+// It reports whether the peer should keep being served.
+func (pm *PeerManager) handle(peer *Peer, frame corecodec.Frame) bool {
+	pm.handling.RLock()
+	defer pm.handling.RUnlock()
+
+	pm.mu.RLock()
+	closed := pm.closed
+	pm.mu.RUnlock()
+	if closed {
+		return false
+	}
+
+	handled, err := peer.receiveHeartbeat(frame)
+	if !handled {
+		err = pm.handler(peer, frame)
+	}
+	if err != nil {
+		pm.Penalize(peer, penaltyFor(err), err.Error())
+	}
+	return true
+}
+
+// Shutdown stops the manager from dialing or accepting peers, waits for the
+// frames that are being handled to finish, then tells every peer we are
+// leaving and closes the connections. If ctx expires before the in-flight
+// frames are done the peers are closed anyway and ctx's error is returned.
+func (pm *PeerManager) Shutdown(ctx context.Context, reason string) error {
+	pm.mu.Lock()
+	pm.closed = true
+	pm.mu.Unlock()
+
+	drained := make(chan struct{})
+	go func() {
+		pm.handling.Lock()
+		close(drained)
+		pm.handling.Unlock()
+	}()
+
+	var err error
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	//Say goodbye to every peer at once so one slow peer does not hold up the rest
+	frame, _ := corecodec.NewFrame(corecodec.Disconnect, DisconnectMessage{Reason: reason})
+	var wg sync.WaitGroup
+	for _, peer := range pm.Peers() {
+		wg.Add(1)
+		go func(peer *Peer) {
+			defer wg.Done()
+			peer.Send(frame)
+			peer.Close()
+		}(peer)
+	}
+
+	sent := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(sent)
+	}()
+	select {
+	case <-sent:
+	case <-ctx.Done():
+		err = ctx.Err()
+		for _, peer := range pm.Peers() {
+			peer.Close()
+		}
+	}
+	return err
+}
@@ -0,0 +1,307 @@
+package corenetwork
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	corecodec "github.com/jneubaum/honestvote.io/core/core-codec"
+	corecrypto "github.com/jneubaum/honestvote.io/core/core-crypto"
+)
+
+// These bound the size of a sync batch
+const (
+	DefaultSyncBatch  = 100
+	MaxSyncBatch      = 1000
+	MaxSyncBatchBytes = 1 << 20
+)
+
+// SyncWindow is how many batches a requester lets the sender stream before it asks again
+const SyncWindow = 4
+
+// SyncTimeout is how long a requester waits for the next batch before giving up
+const SyncTimeout = 30 * time.Second
+
+var (
+	// ErrSyncTimeout is returned when a peer stops sending batches in the middle of a sync
+	ErrSyncTimeout = errors.New("corenetwork: sync timed out")
+	// ErrBadBatch is returned when a batch does not match its hash, which
+	// means it was damaged on the way
+	ErrBadBatch = errors.New("corenetwork: sync batch does not match its hash")
+)
+
+// SyncItem is one record in a sync stream. Cursor is the position right
+// after the item, so it can be used to resume.
+type SyncItem struct {
+	Cursor string          `json:"cursor"`
+	Data   json.RawMessage `json:"data"`
+}
+
+// SyncRequestMessage asks a peer to stream a collection starting after Cursor.
+// The peer sends at most Window batches of at most Limit items, then waits
+// for the requester to ask again, which is how the requester keeps the
+// sender from running ahead of it.
+type SyncRequestMessage struct {
+	Stream     string `json:"stream"`
+	Collection string `json:"collection"`
+	Cursor     string `json:"cursor"`
+	Limit      int    `json:"limit"`
+	Window     int    `json:"window"`
+}
+
+// SyncBatchMessage is one batch of a sync stream
+type SyncBatchMessage struct {
+	Stream string     `json:"stream"`
+	Items  []SyncItem `json:"items"`
+	Done   bool       `json:"done"`
+	Hash   string     `json:"hash"`
+	Error  string     `json:"error,omitempty"`
+}
+
+// Cursor returns the resume token for the batch, which is the cursor of its
+// last item or from if it is empty
+func (b SyncBatchMessage) Cursor(from string) string {
+	if len(b.Items) == 0 {
+		return from
+	}
+	return b.Items[len(b.Items)-1].Cursor
+}
+
+// BatchHash is the hash a batch is sent with. The sender computes it, so
+// it only catches batches damaged on the way, not a peer that lies about
+// the data. Checking the items themselves is up to the SyncSink.
+func BatchHash(items []SyncItem) string {
+	hash := sha256.New()
+	for _, item := range items {
+		fmt.Fprintf(hash, "%d:%s%d:", len(item.Cursor), item.Cursor, len(item.Data))
+		hash.Write(item.Data)
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// SyncSource is the data a node serves to peers that sync from it
+type SyncSource interface {
+	// Batch returns up to limit items of collection that come after cursor,
+	// in a stable order, and whether there is nothing after them
+	Batch(collection, cursor string, limit int) ([]SyncItem, bool, error)
+}
+
+// SyncSink stores what a node syncs from its peers
+type SyncSink interface {
+	// Apply checks every item against what this node trusts, not what the
+	// peer says about it, and stores the batch. An error means the batch was
+	// invalid and the peer that sent it is penalized.
+	Apply(collection string, items []SyncItem) error
+}
+
+type syncStream struct {
+	peer    *Peer
+	batches chan SyncBatchMessage
+}
+
+// Syncer runs the pull based sync protocol. The requester asks for a
+// collection from a cursor, the sender streams batches of it, and the
+// requester hands each batch to its sink to check and store before asking
+// for more. Resume tokens are kept per peer so a broken sync picks up where
+// it left off.
+type Syncer struct {
+	manager *PeerManager
+	source  SyncSource
+	sink    SyncSink
+
+	mu      sync.Mutex
+	streams map[string]*syncStream
+	cursors map[string]string
+	running map[string]bool // peer and collection pairs being synced
+}
+
+// NewSyncer returns a syncer that serves from source and applies to sink.
+// Either may be nil for a node that only sends or only receives. Peers that
+// send bad batches are penalized through manager.
+func NewSyncer(manager *PeerManager, source SyncSource, sink SyncSink) *Syncer {
+	return &Syncer{
+		manager: manager,
+		source:  source,
+		sink:    sink,
+		streams: make(map[string]*syncStream),
+		cursors: make(map[string]string),
+		running: make(map[string]bool),
+	}
+}
+
+// Receive handles SyncRequest and SyncBatch frames
+func (s *Syncer) Receive(peer *Peer, frame corecodec.Frame) error {
+	switch frame.Type {
+	case corecodec.SyncRequest:
+		var request SyncRequestMessage
+		if err := frame.Unmarshal(&request); err != nil {
+			return err
+		}
+		return s.serve(peer, request)
+	case corecodec.SyncBatch:
+		var batch SyncBatchMessage
+		if err := frame.Unmarshal(&batch); err != nil {
+			return err
+		}
+
+		s.mu.Lock()
+		stream, ok := s.streams[batch.Stream]
+		s.mu.Unlock()
+		if !ok || stream.peer != peer {
+			return &Misbehavior{Penalty: PenaltyUnknownMessage, Reason: "sync batch for unknown stream"}
+		}
+
+		select {
+		case stream.batches <- batch:
+		default:
+			return &Misbehavior{Penalty: PenaltySpam, Reason: "sync batch outside the requested window"}
+		}
+	}
+	return nil
+}
+
+func (s *Syncer) serve(peer *Peer, request SyncRequestMessage) error {
+	if request.Limit <= 0 || request.Limit > MaxSyncBatch {
+		request.Limit = DefaultSyncBatch
+	}
+	if request.Window <= 0 || request.Window > SyncWindow {
+		request.Window = SyncWindow
+	}
+
+	cursor := request.Cursor
+	for i := 0; i < request.Window; i++ {
+		batch := SyncBatchMessage{Stream: request.Stream}
+		if s.source == nil {
+			batch.Done = true
+			batch.Error = "node does not serve " + request.Collection
+		} else {
+			items, done, err := s.source.Batch(request.Collection, cursor, request.Limit)
+			if err != nil {
+				batch.Done = true
+				batch.Error = err.Error()
+			} else {
+				batch.Items, batch.Done = trimBatch(items, done)
+				if len(batch.Items) == 0 {
+					batch.Done = true
+				}
+			}
+		}
+		batch.Hash = BatchHash(batch.Items)
+
+		//A batch that cannot be sent, because an item is not valid JSON or
+		//is too big for a frame on its own, ends the stream with an error
+		//so the requester does not wait out SyncTimeout
+		frame, err := corecodec.NewFrame(corecodec.SyncBatch, batch)
+		if err == nil && len(frame.Payload) > corecodec.MaxFrameSize {
+			err = corecodec.ErrFrameTooLarge
+		}
+		if err != nil {
+			batch = SyncBatchMessage{Stream: request.Stream, Done: true, Error: err.Error(), Hash: BatchHash(nil)}
+			if frame, err = corecodec.NewFrame(corecodec.SyncBatch, batch); err != nil {
+				return err
+			}
+		}
+		if err := peer.Send(frame); err != nil {
+			//The connection is broken, so drop it rather than keep serving
+			peer.Close()
+			return nil
+		}
+		if batch.Done {
+			break
+		}
+		cursor = batch.Cursor(cursor)
+	}
+	return nil
+}
+
+// trimBatch drops items from the end until the batch fits in a frame
+func trimBatch(items []SyncItem, done bool) ([]SyncItem, bool) {
+	size := 0
+	for i, item := range items {
+		size += len(item.Cursor) + len(item.Data) + 32
+		if size > MaxSyncBatchBytes && i > 0 {
+			return items[:i], false
+		}
+	}
+	return items, done
+}
+
+// Sync pulls collection from peer until the peer has nothing more or ctx is
+// cancelled, resuming from wherever the last sync with that peer stopped.
+// If collection is already being synced from peer it returns straight away.
+func (s *Syncer) Sync(ctx context.Context, peer *Peer, collection string) error {
+	nonce, err := corecrypto.NewNonce()
+	if err != nil {
+		return err
+	}
+	stream := &syncStream{peer: peer, batches: make(chan SyncBatchMessage, SyncWindow)}
+	id := hex.EncodeToString(nonce[:8])
+
+	s.mu.Lock()
+	resume := peer.NodeID + "/" + collection
+	if s.running[resume] {
+		s.mu.Unlock()
+		return nil
+	}
+	s.running[resume] = true
+	s.streams[id] = stream
+	cursor := s.cursors[resume]
+	s.mu.Unlock()
+
+	defer func() {
+		s.mu.Lock()
+		delete(s.streams, id)
+		delete(s.running, resume)
+		s.mu.Unlock()
+	}()
+
+	for {
+		request := SyncRequestMessage{Stream: id, Collection: collection, Cursor: cursor, Limit: DefaultSyncBatch, Window: SyncWindow}
+		frame, err := corecodec.NewFrame(corecodec.SyncRequest, request)
+		if err != nil {
+			return err
+		}
+		if err := peer.Send(frame); err != nil {
+			return err
+		}
+
+		for i := 0; i < SyncWindow; i++ {
+			var batch SyncBatchMessage
+			select {
+			case batch = <-stream.batches:
+			case <-time.After(SyncTimeout):
+				return ErrSyncTimeout
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+
+			if batch.Error != "" {
+				return errors.New("corenetwork: peer could not sync: " + batch.Error)
+			}
+			if batch.Hash != BatchHash(batch.Items) {
+				s.manager.Penalize(peer, PenaltyMalformed, ErrBadBatch.Error())
+				return ErrBadBatch
+			}
+			if len(batch.Items) > 0 && s.sink != nil {
+				if err := s.sink.Apply(collection, batch.Items); err != nil {
+					s.manager.Penalize(peer, penaltyFor(err), err.Error())
+					return err
+				}
+			}
+
+			cursor = batch.Cursor(cursor)
+			s.mu.Lock()
+			s.cursors[resume] = cursor
+			s.mu.Unlock()
+
+			if batch.Done {
+				return nil
+			}
+		}
+	}
+}
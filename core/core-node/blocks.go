@@ -0,0 +1,103 @@
+package corenode
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	corecodec "github.com/jneubaum/honestvote.io/core/core-codec"
+	coreconsensus "github.com/jneubaum/honestvote.io/core/core-consensus"
+	coredatabase "github.com/jneubaum/honestvote.io/core/core-database/src"
+	corenetwork "github.com/jneubaum/honestvote.io/core/core-network"
+)
+
+// publishBlock gossips a block this node produced
+func (n *Node) publishBlock(block *coredatabase.Block) error {
+	payload, err := json.Marshal(block)
+	if err != nil {
+		return err
+	}
+	fmt.Println("Produced block", block.Height(), "with", len(block.Transactions), "transactions")
+	return n.Gossip.Publish(corecodec.Block, payload)
+}
+
+// broadcastConsensus gossips this node's proposals and votes
+func (n *Node) broadcastConsensus(message *coreconsensus.Message) error {
+	payload, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+	return n.Gossip.Publish(corecodec.Consensus, payload)
+}
+
+// receiveBlock adds a gossiped block to the chain. Only blocks that are
+// added are relayed.
+func (n *Node) receiveBlock(frame corecodec.Frame) error {
+	var block coredatabase.Block
+	if err := frame.Unmarshal(&block); err != nil {
+		return err
+	}
+
+	err := n.Consensus.Accept(&block)
+	switch err {
+	case nil:
+		return nil
+	case coreconsensus.ErrKnownBlock:
+		//Validators each publish a final block with the precommits they
+		//saw, so the same block can turn up under several gossip IDs.
+		//Only the first copy is passed on.
+		return corenetwork.Ignored(err)
+	case coreconsensus.ErrSideBlock:
+		//Side branches are relayed too so every node can weigh them up
+		return nil
+	case coreconsensus.ErrMissingParent:
+		//We are missing blocks, go and fetch them
+		go n.syncBlocks()
+		return corenetwork.Rejected(err)
+	case coreconsensus.ErrStaleBlock, coreconsensus.ErrFutureBlock, coreconsensus.ErrConflictingCommit:
+		//The peer may be ahead of us, behind us or have a different clock
+		return corenetwork.Rejected(err)
+	case coredatabase.ErrBadSignature, coreconsensus.ErrNotValidator, coreconsensus.ErrWrongTurn, coreconsensus.ErrBadCommit:
+		return corenetwork.InvalidSignature(err)
+	}
+	if errors.Is(err, coredatabase.ErrBadSignature) {
+		return corenetwork.InvalidSignature(err)
+	}
+	return err
+}
+
+// receiveConsensus passes a gossiped proposal or vote to the BFT engine.
+// Correctly signed messages from validators are relayed whatever height
+// they are for, so validators a height behind or ahead still get them.
+func (n *Node) receiveConsensus(frame corecodec.Frame) error {
+	bft, ok := n.Consensus.(*coreconsensus.BFT)
+	if !ok {
+		return corenetwork.ErrUnknownMessage
+	}
+	var message coreconsensus.Message
+	if err := frame.Unmarshal(&message); err != nil {
+		return err
+	}
+
+	err := bft.Receive(&message)
+	switch err {
+	case nil:
+		return nil
+	case coreconsensus.ErrConflictingVote:
+		//A validator voting twice is its own fault rather than the relaying peer's
+		return corenetwork.Ignored(err)
+	case coreconsensus.ErrFutureBlock:
+		//Clocks differ between nodes, the proposal may be fine a moment later
+		return corenetwork.Rejected(err)
+	case coreconsensus.ErrBadProposalTime:
+		//Nodes move on to a height at slightly different times, so one that
+		//relayed the proposal may well have taken it
+		return corenetwork.Ignored(err)
+	case coredatabase.ErrBadSignature, coreconsensus.ErrNotValidator, coreconsensus.ErrNotProposer:
+		return corenetwork.InvalidSignature(err)
+	}
+	if errors.Is(err, coredatabase.ErrBadSignature) {
+		return corenetwork.InvalidSignature(err)
+	}
+	return err
+}
@@ -0,0 +1,193 @@
+package corenode
+
+import (
+	"crypto/ed25519"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	coreconsensus "github.com/jneubaum/honestvote.io/core/core-consensus"
+	corehttp "github.com/jneubaum/honestvote.io/core/core-http"
+	corenetwork "github.com/jneubaum/honestvote.io/core/core-network"
+)
+
+// RoleRegistry runs the bootstrap registry instead of a node. It is not a
+// network role, registries never take part in the peer handshake.
+const RoleRegistry corenetwork.Role = "registry"
+
+// DefaultShutdownTimeout is how long a node gets to shut down cleanly when
+// SHUTDOWN_TIMEOUT is not set
+const DefaultShutdownTimeout = 10 * time.Second
+
+// Config is everything a node reads from its environment
+type Config struct {
+	Role              corenetwork.Role
+	Listen            string
+	Advertise         string
+	Bootstrap         []string
+	MaxPeers          int
+	TargetOutbound    int
+	KeyFile           string
+	Peerstore         string
+	BanDuration       time.Duration
+	HTTPPort          string
+	InsecureTransport bool
+	Allowlist         []string
+	MongoURI          string
+	LedgerDatabase    string
+	BlockCollection   string
+	ShutdownTimeout   time.Duration
+	Admins            []corehttp.Voter
+	MempoolSize       int
+	MempoolMaxAge     time.Duration
+	Consensus         coreconsensus.Mode
+	Validators        coreconsensus.Validators
+	BlockInterval     time.Duration
+	BlockTransactions int
+}
+
+// LoadConfig reads the configuration for role from the environment, filling
+// in defaults for anything that is not set
+func LoadConfig(role corenetwork.Role) (*Config, error) {
+	switch role {
+	case corenetwork.RoleFull, corenetwork.RolePeer, corenetwork.RoleObserver, RoleRegistry:
+	default:
+		return nil, fmt.Errorf("corenode: unknown role %q", role)
+	}
+
+	config := &Config{
+		Role:              role,
+		Listen:            os.Getenv("LISTEN"),
+		Advertise:         os.Getenv("ADVERTISE"),
+		Bootstrap:         corenetwork.ParseBootstrap(os.Getenv("BOOTSTRAP")),
+		KeyFile:           getenv("KEY_FILE", "node.key"),
+		Peerstore:         getenv("PEERSTORE", "peers.json"),
+		HTTPPort:          os.Getenv("HTTP_PORT"),
+		InsecureTransport: os.Getenv("INSECURE_TRANSPORT") == "true",
+		Allowlist:         corenetwork.ParseAllowlist(os.Getenv("ALLOWLIST")),
+		MongoURI:          getenv("MONGO_URI", "mongodb://localhost:27017"),
+		LedgerDatabase:    getenv("LEDGER_DATABASE", DefaultLedgerDatabase),
+		BlockCollection:   getenv("BLOCK_COLLECTION", DefaultBlockCollection),
+		ShutdownTimeout:   DefaultShutdownTimeout,
+	}
+
+	if config.Listen == "" {
+		config.Listen = ":" + os.Getenv("PORT")
+	}
+
+	var err error
+	if config.Admins, err = ParseAdmins(os.Getenv("ADMINS")); err != nil {
+		return nil, err
+	}
+	if config.Consensus, err = coreconsensus.ParseMode(os.Getenv("CONSENSUS")); err != nil {
+		return nil, err
+	}
+	if config.Validators, err = ParseValidators(os.Getenv("VALIDATORS")); err != nil {
+		return nil, err
+	}
+
+	//Zero means use the package default for all of these
+	if config.MaxPeers, err = getint("MAX_PEERS"); err != nil {
+		return nil, err
+	}
+	if config.TargetOutbound, err = getint("TARGET_OUTBOUND"); err != nil {
+		return nil, err
+	}
+	if config.MempoolSize, err = getint("MEMPOOL_SIZE"); err != nil {
+		return nil, err
+	}
+	if config.BlockTransactions, err = getint("BLOCK_TRANSACTIONS"); err != nil {
+		return nil, err
+	}
+	if maxAge := os.Getenv("MEMPOOL_MAX_AGE"); maxAge != "" {
+		if config.MempoolMaxAge, err = time.ParseDuration(maxAge); err != nil {
+			return nil, fmt.Errorf("corenode: MEMPOOL_MAX_AGE: %v", err)
+		}
+	}
+	if blockInterval := os.Getenv("BLOCK_INTERVAL"); blockInterval != "" {
+		if config.BlockInterval, err = time.ParseDuration(blockInterval); err != nil {
+			return nil, fmt.Errorf("corenode: BLOCK_INTERVAL: %v", err)
+		}
+	}
+	if banDuration := os.Getenv("BAN_DURATION"); banDuration != "" {
+		if config.BanDuration, err = time.ParseDuration(banDuration); err != nil {
+			return nil, fmt.Errorf("corenode: BAN_DURATION: %v", err)
+		}
+	}
+
+	if shutdownTimeout := os.Getenv("SHUTDOWN_TIMEOUT"); shutdownTimeout != "" {
+		if config.ShutdownTimeout, err = time.ParseDuration(shutdownTimeout); err != nil {
+			return nil, fmt.Errorf("corenode: SHUTDOWN_TIMEOUT: %v", err)
+		}
+	}
+
+	return config, nil
+}
+
+// ParseAdmins reads a comma separated list of voterID:publickey pairs, the
+// key in hex. Admins are the voters the ledger starts with and may create
+// elections, every node on a network must be given the same list.
+func ParseAdmins(list string) ([]corehttp.Voter, error) {
+	var admins []corehttp.Voter
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		parts := strings.SplitN(entry, ":", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("corenode: ADMINS entry %q is not voterID:publickey", entry)
+		}
+		key, err := hex.DecodeString(parts[1])
+		if err != nil || len(key) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("corenode: ADMINS entry %q has a malformed key", entry)
+		}
+		admins = append(admins, corehttp.Voter{
+			ID:          corehttp.VoterID(parts[0]),
+			PublicKey:   key,
+			Permissions: corehttp.VoterPermissions{CanCreateElection: true},
+		})
+	}
+	return admins, nil
+}
+
+// ParseValidators reads a comma separated list of validator public keys in
+// hex. A validator's key is the identity key of its full node, and the order
+// of the list decides whose turn it is to propose.
+func ParseValidators(list string) (coreconsensus.Validators, error) {
+	var validators coreconsensus.Validators
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		key, err := hex.DecodeString(entry)
+		if err != nil || len(key) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("corenode: VALIDATORS entry %q is not a public key", entry)
+		}
+		validators = append(validators, key)
+	}
+	return validators, nil
+}
+
+func getenv(key, fallback string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return fallback
+}
+
+func getint(key string) (int, error) {
+	value := os.Getenv(key)
+	if value == "" {
+		return 0, nil
+	}
+	number, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("corenode: %s: %v", key, err)
+	}
+	return number, nil
+}
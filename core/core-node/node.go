@@ -0,0 +1,423 @@
+package corenode
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"time"
+
+	coreblocksync "github.com/jneubaum/honestvote.io/core/core-blocksync"
+	corecodec "github.com/jneubaum/honestvote.io/core/core-codec"
+	coreconsensus "github.com/jneubaum/honestvote.io/core/core-consensus"
+	corecrypto "github.com/jneubaum/honestvote.io/core/core-crypto"
+	coredatabase "github.com/jneubaum/honestvote.io/core/core-database/src"
+	corehttp "github.com/jneubaum/honestvote.io/core/core-http"
+	coremempool "github.com/jneubaum/honestvote.io/core/core-mempool"
+	corenetwork "github.com/jneubaum/honestvote.io/core/core-network"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Node is a running full, peer or observer node. The role decides what it
+// does with candidate data:
+//
+//	full      pulls candidates from peer nodes and stores them
+//	peer      serves the candidates in its database to full nodes
+//	observer  relays gossip and reports status but stores nothing
+//
+// Every role follows the chain of blocks, and full nodes whose identity
+// key is one of the validators take part in producing them.
+type Node struct {
+	Config     *Config
+	Identity   *corenetwork.Identity
+	Manager    *corenetwork.PeerManager
+	Gossip     *corenetwork.Gossip
+	Book       *corenetwork.AddressBook
+	Exchange   *corenetwork.PeerExchange
+	Syncer     *corenetwork.Syncer
+	Chain      *coredatabase.Chain
+	State      *coredatabase.State
+	Mempool    *coremempool.Mempool
+	Consensus  coreconsensus.Engine
+	Downloader *coreblocksync.Downloader
+	Mongo      *mongo.Client
+
+	ctx context.Context
+}
+
+// NewNode sets up a node from config without starting any networking. The
+// node lives until ctx is cancelled, which is what starts its shutdown.
+func NewNode(ctx context.Context, config *Config) (*Node, error) {
+	n := &Node{Config: config, ctx: ctx}
+
+	var err error
+	if config.Role != corenetwork.RoleObserver {
+		n.Mongo, err = mongoConnect(ctx, config.MongoURI)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	//Nodes with a database keep the ledger there, observers only keep it in memory
+	var store coredatabase.BlockStore = coredatabase.NewMemoryStore()
+	if n.Mongo != nil {
+		store, err = coredatabase.NewMongoStore(ctx, n.Mongo.Database(config.LedgerDatabase).Collection(config.BlockCollection))
+		if err != nil {
+			return nil, err
+		}
+	}
+	n.Chain, err = coredatabase.NewChain(store)
+	if err != nil {
+		return nil, err
+	}
+
+	//Transactions only enter the mempool once they check out against the
+	//ledger: signed by a registered key, permitted and not a duplicate
+	n.State = coredatabase.NewState(config.Admins)
+	if err := n.State.Replay(n.Chain); err != nil {
+		return nil, err
+	}
+	n.Mempool = coremempool.NewMempool(n.State.Check, config.MempoolSize, config.MempoolMaxAge)
+
+	//LISTEN is the address we bind to and ADVERTISE the address other nodes
+	//should dial, which is the one sent in the handshake. If ADVERTISE is left
+	//out the registry and our peers fill in the host our connections come from.
+	advertised, err := corenetwork.AdvertiseAddress(config.Advertise, config.Listen)
+	if err != nil {
+		return nil, err
+	}
+
+	//The identity key proves who this node is during the handshake
+	key, err := corecrypto.LoadKey(config.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	n.Identity = &corenetwork.Identity{Key: key, Address: advertised, Role: config.Role, Height: n.Chain.Height}
+
+	//Blocks are accepted from the validators, and full nodes whose identity
+	//key is on the list take part in producing them
+	var validator ed25519.PrivateKey
+	if config.Role == corenetwork.RoleFull {
+		validator = key
+	}
+	switch config.Consensus {
+	case coreconsensus.ModeBFT:
+		bft := coreconsensus.NewBFT(config.Validators, config.BlockInterval, n.Chain, n.State, n.Mempool)
+		bft.Key = validator
+		bft.Broadcast = n.broadcastConsensus
+		bft.Publish = n.publishBlock
+		if config.BlockTransactions > 0 {
+			bft.MaxTransactions = config.BlockTransactions
+		}
+		n.Consensus = bft
+	default:
+		poa := coreconsensus.NewPoA(config.Validators, config.BlockInterval, n.Chain, n.State, n.Mempool)
+		poa.Key = validator
+		poa.Publish = n.publishBlock
+		if config.BlockTransactions > 0 {
+			poa.MaxTransactions = config.BlockTransactions
+		}
+		n.Consensus = poa
+	}
+
+	n.Manager = corenetwork.NewPeerManager(n.Identity, config.MaxPeers, n.handle)
+	n.Gossip = corenetwork.NewGossip(n.Manager, corenetwork.DefaultMaxHops, n.handle)
+
+	//Known peers survive restarts so we can reconnect without the registry
+	n.Book, err = corenetwork.LoadAddressBook(config.Peerstore)
+	if err != nil {
+		return nil, err
+	}
+
+	//Peer connections are encrypted with the identity key, and can be limited
+	//to the node IDs on ALLOWLIST for a permissioned network
+	n.Manager.Transport = corenetwork.TCPTransport{}
+	if !config.InsecureTransport {
+		n.Manager.Transport, err = corenetwork.NewSecureTransport(key, config.Allowlist)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	//Misbehaving peers are banned for BAN_DURATION
+	n.Manager.Book = n.Book
+	n.Manager.BanDuration = config.BanDuration
+
+	n.Exchange = corenetwork.NewPeerExchange(n.Manager, n.Book, config.TargetOutbound)
+
+	switch config.Role {
+	case corenetwork.RoleFull:
+		n.Syncer = corenetwork.NewSyncer(n.Manager, nil, candidateSink{ctx, n.Mongo, n.State})
+	case corenetwork.RolePeer:
+		n.Syncer = corenetwork.NewSyncer(n.Manager, candidateSource{ctx, n.Mongo}, nil)
+	default:
+		n.Syncer = corenetwork.NewSyncer(n.Manager, nil, nil)
+	}
+	//Nodes that join behind the rest download the blocks they are missing
+	n.Downloader = coreblocksync.NewDownloader(n.Manager, n.Chain, n.Consensus)
+	n.Manager.OnConnect = n.connected
+
+	return n, nil
+}
+
+// Run starts listening, joins the network through the bootstrap registries
+// and keeps the node's connections topped up. Once the node's context is
+// cancelled it stops accepting connections, lets the messages being handled
+// finish, tells its peers it is leaving and flushes storage, giving up after
+// the configured shutdown timeout.
+func (n *Node) Run() error {
+	fmt.Println("Node ID:", n.Identity.NodeID())
+	fmt.Println("Public key:", hex.EncodeToString(n.Identity.Key.Public().(ed25519.PublicKey)))
+	fmt.Println("Listening on", n.Config.Listen, "advertising", n.Identity.Address, "as", n.Config.Role)
+
+	listener, err := n.Manager.Transport.Listen(n.Config.Listen)
+	if err != nil {
+		return err
+	}
+	go n.accept(listener)
+
+	//Serve the HTTP API, which includes the ban list and peer status
+	var server *http.Server
+	if n.Config.HTTPPort != "" {
+		corehttp.BannedPeers = n.BannedPeers
+		corehttp.Status = n.Status
+		corehttp.SubmitVote = n.submitVote
+		corehttp.SubmitElection = n.submitElection
+		corehttp.SubmitRegistration = n.submitRegistration
+		corehttp.Results = n.Results
+		corehttp.HandleRoutes()
+		server = &http.Server{Addr: ":" + n.Config.HTTPPort}
+		go func() {
+			if err := server.ListenAndServe(); err != http.ErrServerClosed {
+				log.Println("HTTP server failed:", err)
+			}
+		}()
+	}
+
+	go n.Book.Persist(n.ctx, corenetwork.PeerstoreInterval)
+
+	//Dial the peers we knew before the restart, then keep asking connected
+	//peers for more nodes so enough outbound connections stay open
+	go n.Exchange.Run(n.ctx)
+
+	go n.Mempool.Run(n.ctx, coremempool.ExpireInterval)
+	go n.Consensus.Run(n.ctx)
+
+	//Ping peers and drop the ones that have gone quiet
+	go n.Manager.Heartbeat(n.ctx, corenetwork.PingInterval, corenetwork.IdleTimeout)
+
+	n.bootstrap()
+
+	//Stop taking new connections before winding down the ones we have
+	listener.Close()
+	return n.shutdown(server)
+}
+
+// bootstrap registers with the registries and dials the nodes they know
+// about every RegistryInterval until the node's context is cancelled
+func (n *Node) bootstrap() {
+	ticker := time.NewTicker(corenetwork.RegistryInterval)
+	defer ticker.Stop()
+
+	for {
+		for _, registry := range n.Config.Bootstrap {
+			self, addresses, err := corenetwork.Bootstrap(registry, n.Identity.Address)
+			if err != nil {
+				fmt.Println("Registry unreachable:", registry)
+				continue
+			}
+
+			//Ignore the address that is used by this node
+			n.Manager.SetSelf(self)
+
+			for _, address := range addresses {
+				if address != self {
+					n.Book.Add(address)
+				}
+			}
+		}
+		n.Exchange.Fill()
+
+		select {
+		case <-n.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (n *Node) shutdown(server *http.Server) error {
+	fmt.Println("Shutting down")
+
+	//The root context is already cancelled, the deadline gets a fresh one
+	ctx, cancel := context.WithTimeout(context.Background(), n.Config.ShutdownTimeout)
+	defer cancel()
+
+	var errs []error
+	if server != nil {
+		errs = append(errs, server.Shutdown(ctx))
+	}
+	errs = append(errs, n.Manager.Shutdown(ctx, "shutting down"))
+	errs = append(errs, n.Book.Save())
+	if n.Mongo != nil {
+		errs = append(errs, n.Mongo.Disconnect(ctx))
+	}
+
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (n *Node) accept(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			//Running out of file descriptors and the like clears up on its own
+			log.Println("Accept failed:", err)
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+		go n.Manager.Accept(conn)
+	}
+}
+
+func (n *Node) connected(peer *corenetwork.Peer) {
+	n.Exchange.Connected(peer)
+
+	//Full nodes pull the candidate data from every peer node they connect to
+	if n.Config.Role == corenetwork.RoleFull && peer.Role == corenetwork.RolePeer {
+		go n.syncCandidates(peer)
+	}
+
+	if n.Downloader.Behind(peer) {
+		go n.syncBlocks()
+	}
+}
+
+// syncCandidates pulls the candidates peer has that we do not
+func (n *Node) syncCandidates(peer *corenetwork.Peer) {
+	if err := n.Syncer.Sync(n.ctx, peer, CandidateCollection); err != nil {
+		fmt.Println("Sync with", peer.Address, "failed:", err)
+	}
+}
+
+// syncBlocks downloads the blocks peers have that we do not. It does
+// nothing if a download is already running.
+func (n *Node) syncBlocks() {
+	if err := n.Downloader.Sync(n.ctx); err != nil && n.ctx.Err() == nil {
+		fmt.Println("Block sync failed:", err)
+	}
+}
+
+func (n *Node) handle(peer *corenetwork.Peer, frame corecodec.Frame) error {
+	switch frame.Type {
+	case corecodec.Gossip:
+		return n.Gossip.Receive(peer, frame)
+	case corecodec.GetPeers, corecodec.Peers:
+		return n.Exchange.Receive(peer, frame)
+	case corecodec.SyncRequest, corecodec.SyncBatch:
+		return n.Syncer.Receive(peer, frame)
+	case corecodec.Transaction:
+		return n.receiveTransaction(frame)
+	case corecodec.Block:
+		return n.receiveBlock(frame)
+	case corecodec.Consensus:
+		return n.receiveConsensus(frame)
+	case corecodec.GetHeaders, corecodec.Headers, corecodec.GetBlocks, corecodec.Blocks:
+		return n.Downloader.Receive(peer, frame)
+	case corecodec.ReceiveData:
+		//Pushed candidates are only a hint that there is something new.
+		//Nothing is stored from them, full nodes pull from their peer nodes
+		//instead, which is where candidates get checked against the chain.
+		tmpArray := new([]Candidate)
+		err := frame.Unmarshal(tmpArray)
+		if err != nil {
+			return err
+		}
+		if n.Config.Role == corenetwork.RoleFull {
+			for _, peer := range n.Manager.Peers() {
+				if peer.Role == corenetwork.RolePeer {
+					go n.syncCandidates(peer)
+				}
+			}
+		}
+	default:
+		return corenetwork.ErrUnknownMessage
+	}
+	return nil
+}
+
+// BannedPeers lists the nodes that are currently banned
+func (n *Node) BannedPeers() []corehttp.BannedPeer {
+	var bans []corehttp.BannedPeer
+	for _, known := range n.Book.Bans() {
+		bans = append(bans, corehttp.BannedPeer{Address: known.Address, NodeID: known.NodeID, BannedUntil: known.BannedUntil})
+	}
+	return bans
+}
+
+// Status describes the node and every peer it is connected to
+func (n *Node) Status() corehttp.NodeStatus {
+	status := corehttp.NodeStatus{
+		NodeID:  n.Identity.NodeID(),
+		Address: n.Identity.Address,
+		Role:    string(n.Identity.Role),
+		Height:  n.Chain.Height(),
+		Peers:   []corehttp.PeerStatus{},
+	}
+	if progress := n.Downloader.Progress(); progress.Syncing {
+		status.Syncing = true
+		status.Sync = &corehttp.SyncStatus{
+			StartHeight:  progress.StartHeight,
+			Height:       progress.Height,
+			HeaderHeight: progress.HeaderHeight,
+			TargetHeight: progress.TargetHeight,
+			Peers:        progress.Peers,
+		}
+	}
+	for _, peer := range n.Manager.Peers() {
+		status.Peers = append(status.Peers, corehttp.PeerStatus{
+			NodeID:       peer.NodeID,
+			Address:      peer.Address,
+			Role:         string(peer.Role),
+			Inbound:      peer.Inbound,
+			Height:       peer.Height,
+			LatencyMs:    float64(peer.Latency()) / float64(time.Millisecond),
+			Score:        peer.Score(),
+			LastReceived: peer.LastReceived(),
+		})
+	}
+	return status
+}
+
+// Results is the running count of an election, with every ticket on the
+// ballot listed in order whether or not it has votes yet
+func (n *Node) Results(id corehttp.ElectionID) (corehttp.ElectionResults, bool) {
+	election, ok := n.State.Election(id)
+	if !ok {
+		return corehttp.ElectionResults{}, false
+	}
+	tally, voted, _ := n.State.Tally(id)
+
+	results := corehttp.ElectionResults{ElectionID: id, Voted: voted, Tickets: []corehttp.TicketResult{}}
+	for _, entry := range election.TicketEntries {
+		for _, ticket := range entry.Tickets {
+			votes := tally[ticket.ID]
+			if votes == nil {
+				votes = map[corehttp.VotePriority]uint64{}
+			}
+			results.Tickets = append(results.Tickets, corehttp.TicketResult{TicketID: ticket.ID, Votes: votes})
+		}
+	}
+	return results, true
+}
@@ -0,0 +1,33 @@
+package corenode
+
+import (
+	"context"
+	"fmt"
+	"net"
+
+	corenetwork "github.com/jneubaum/honestvote.io/core/core-network"
+)
+
+// RunRegistry serves the bootstrap registry on the configured listen address
+// until ctx is cancelled
+func RunRegistry(ctx context.Context, config *Config) error {
+	listen, err := net.Listen("tcp", config.Listen)
+
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		<-ctx.Done()
+		listen.Close()
+	}()
+
+	fmt.Println("Registry listening on", config.Listen)
+
+	registry := corenetwork.NewRegistry(corenetwork.RegistryTTL)
+	err = registry.Serve(listen)
+	if ctx.Err() != nil {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,229 @@
+package corenode
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+
+	coredatabase "github.com/jneubaum/honestvote.io/core/core-database/src"
+	corehttp "github.com/jneubaum/honestvote.io/core/core-http"
+	corenetwork "github.com/jneubaum/honestvote.io/core/core-network"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// CandidateCollection is the sync collection candidates are exchanged under
+const CandidateCollection = "candidates"
+
+// MongoTimeout bounds every MongoDB operation
+const MongoTimeout = 10 * time.Second
+
+// DefaultLedgerDatabase and DefaultBlockCollection are where the chain is
+// stored when LEDGER_DATABASE and BLOCK_COLLECTION are not set
+const (
+	DefaultLedgerDatabase  = "honestvote"
+	DefaultBlockCollection = "blocks"
+)
+
+type Candidate struct {
+	Name     string `json:"name"`
+	Key      string `json:"key"`
+	Election string `json:"election"`
+	Votes    int32  `json:"votes"`
+}
+
+func mongoConnect(ctx context.Context, uri string) (*mongo.Client, error) {
+	ctx, cancel := context.WithTimeout(ctx, MongoTimeout)
+	defer cancel()
+
+	clientOptions := options.Client().ApplyURI(uri)
+	client, err := mongo.Connect(ctx, clientOptions)
+
+	if err != nil {
+		return nil, err
+	}
+	err = client.Ping(ctx, nil)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return client, nil
+}
+
+// updateMongo stores candidates, replacing the one with the same key in the
+// same election, so syncing the same candidates again after a restart or
+// from another peer does not store them twice
+func updateMongo(ctx context.Context, client *mongo.Client, data []Candidate) error {
+	if len(data) == 0 {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, MongoTimeout)
+	defer cancel()
+
+	collection := client.Database("new_database").Collection("new_collection")
+
+	var models []mongo.WriteModel
+	for _, candidate := range data {
+		filter := bson.M{"key": candidate.Key, "election": candidate.Election}
+		models = append(models, mongo.NewReplaceOneModel().SetFilter(filter).SetReplacement(candidate).SetUpsert(true))
+	}
+
+	_, err := collection.BulkWrite(ctx, models)
+	return err
+}
+
+// candidateSource serves test_collection to syncing full nodes in _id order,
+// using the _id of the last candidate sent as the resume token. Queries are
+// cancelled with ctx when the node shuts down.
+type candidateSource struct {
+	ctx    context.Context
+	client *mongo.Client
+}
+
+func (s candidateSource) Batch(collection, cursor string, limit int) ([]corenetwork.SyncItem, bool, error) {
+	if collection != CandidateCollection {
+		return nil, true, errors.New("unknown collection " + collection)
+	}
+
+	filter := bson.M{}
+	if cursor != "" {
+		after, err := primitive.ObjectIDFromHex(cursor)
+		if err != nil {
+			return nil, true, err
+		}
+		filter = bson.M{"_id": bson.M{"$gt": after}}
+	}
+
+	//Ask for one extra document to find out whether this is the last batch
+	findOptions := options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}).SetLimit(int64(limit + 1))
+	return gatherMongoData(s.ctx, s.client, filter, findOptions, limit)
+}
+
+func gatherMongoData(ctx context.Context, client *mongo.Client, filter bson.M, findOptions *options.FindOptions, limit int) ([]corenetwork.SyncItem, bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, MongoTimeout)
+	defer cancel()
+
+	var items []corenetwork.SyncItem
+	collection := client.Database("test_database").Collection("test_collection")
+
+	cur, err := collection.Find(ctx, filter, findOptions)
+
+	if err != nil {
+		return nil, true, err
+	}
+	defer cur.Close(ctx)
+
+	for cur.Next(ctx) {
+		if len(items) == limit {
+			return items, false, nil
+		}
+
+		var document struct {
+			ID        primitive.ObjectID `bson:"_id"`
+			Candidate `bson:",inline"`
+		}
+		err = cur.Decode(&document)
+		if err != nil {
+			return nil, true, err
+		}
+
+		data, err := json.Marshal(document.Candidate)
+		if err != nil {
+			return nil, true, err
+		}
+		items = append(items, corenetwork.SyncItem{Cursor: document.ID.Hex(), Data: data})
+	}
+
+	return items, true, cur.Err()
+}
+
+var (
+	// errUnknownCandidate is returned for a synced candidate the chain has not registered for its election
+	errUnknownCandidate = errors.New("corenode: candidate is not registered for the election")
+	// errCandidateMismatch is returned for a synced candidate that differs from its registration
+	errCandidateMismatch = errors.New("corenode: candidate does not match its registration")
+)
+
+// candidateSink stores the candidates synced from peer nodes. Peers are
+// not trusted for any of it: a candidate is only stored if the chain
+// registered it to run in its election under the same name, and its vote
+// count is taken from the chain.
+type candidateSink struct {
+	ctx    context.Context
+	client *mongo.Client
+	state  *coredatabase.State
+}
+
+// check makes sure the chain registered candidate to run in its election
+// and sets its votes to the chain's count
+func (s candidateSink) check(candidate *Candidate) error {
+	registered, ok := s.state.Candidate(corehttp.CandidateID(candidate.Key))
+	if !ok || !hasApp(registered.Permissions.CanRun, corehttp.AppID(candidate.Election)) {
+		//The registration may be in blocks we have not got yet, so the sync
+		//stops without blaming the peer and starts over from here next time
+		return corenetwork.Ignored(errUnknownCandidate)
+	}
+	if registered.DisplayName != candidate.Name {
+		return errCandidateMismatch
+	}
+
+	//Votes go to tickets, so a candidate has the first choice votes of every
+	//ticket they are on
+	election, _ := s.state.Election(corehttp.ElectionID(candidate.Election))
+	tally, _, _ := s.state.Tally(election.ID)
+	candidate.Votes = 0
+	for _, entry := range election.TicketEntries {
+		for _, ticket := range entry.Tickets {
+			for _, position := range ticket.ElectionPositionEntries {
+				if position.CandidateID == registered.ID {
+					candidate.Votes += int32(tally[ticket.ID][1])
+					break
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func hasApp(list []corehttp.AppID, id corehttp.AppID) bool {
+	for _, a := range list {
+		if a == id {
+			return true
+		}
+	}
+	return false
+}
+
+func (s candidateSink) Apply(collection string, items []corenetwork.SyncItem) error {
+	if collection != CandidateCollection {
+		return errors.New("unknown collection " + collection)
+	}
+
+	var candidates []Candidate
+	for _, item := range items {
+		var candidate Candidate
+		if err := json.Unmarshal(item.Data, &candidate); err != nil {
+			return err
+		}
+		if candidate.Name == "" || candidate.Key == "" || candidate.Election == "" {
+			return errors.New("candidate is missing a name, key or election")
+		}
+		if err := s.check(&candidate); err != nil {
+			return err
+		}
+		candidates = append(candidates, candidate)
+	}
+
+	//A storage failure is not the peer's fault, so it must not cost it
+	//score, but the sync has to stop so the cursor does not move past
+	//candidates we never stored
+	if err := updateMongo(s.ctx, s.client, candidates); err != nil {
+		return corenetwork.Rejected(err)
+	}
+	return nil
+}
@@ -0,0 +1,89 @@
+package corenode
+
+import (
+	"encoding/json"
+
+	corecodec "github.com/jneubaum/honestvote.io/core/core-codec"
+	coredatabase "github.com/jneubaum/honestvote.io/core/core-database/src"
+	coremempool "github.com/jneubaum/honestvote.io/core/core-mempool"
+	corenetwork "github.com/jneubaum/honestvote.io/core/core-network"
+)
+
+// SubmitTransaction adds a transaction created on this node to the mempool
+// and gossips it to the rest of the network
+func (n *Node) SubmitTransaction(tx coredatabase.Transaction) error {
+	if err := n.Mempool.Add(tx); err != nil {
+		return err
+	}
+
+	payload, err := json.Marshal(tx)
+	if err != nil {
+		return err
+	}
+	return n.Gossip.Publish(corecodec.Transaction, payload)
+}
+
+func (n *Node) submitVote(body []byte) error {
+	var vote coredatabase.VoteTransaction
+	if err := json.Unmarshal(body, &vote); err != nil {
+		return err
+	}
+	tx, err := vote.Transaction()
+	if err != nil {
+		return err
+	}
+	return n.SubmitTransaction(tx)
+}
+
+func (n *Node) submitElection(body []byte) error {
+	var election coredatabase.ElectionTransaction
+	if err := json.Unmarshal(body, &election); err != nil {
+		return err
+	}
+	tx, err := election.Transaction()
+	if err != nil {
+		return err
+	}
+	return n.SubmitTransaction(tx)
+}
+
+func (n *Node) submitRegistration(body []byte) error {
+	var registration coredatabase.RegistrationTransaction
+	if err := json.Unmarshal(body, &registration); err != nil {
+		return err
+	}
+	tx, err := registration.Transaction()
+	if err != nil {
+		return err
+	}
+	return n.SubmitTransaction(tx)
+}
+
+// receiveTransaction puts a gossiped transaction in the mempool. Only
+// transactions that make it in are relayed.
+func (n *Node) receiveTransaction(frame corecodec.Frame) error {
+	var tx coredatabase.Transaction
+	if err := frame.Unmarshal(&tx); err != nil {
+		return err
+	}
+
+	err := n.Mempool.Add(tx)
+	switch err {
+	case nil:
+		return nil
+	case coremempool.ErrDuplicate:
+		//Another peer got it to us first
+		return nil
+	case coremempool.ErrFull, coremempool.ErrNonceTaken, coremempool.ErrDuplicateVote:
+		return corenetwork.Rejected(err)
+	case coredatabase.ErrBadSignature:
+		return corenetwork.InvalidSignature(err)
+	case coredatabase.ErrUnknownVoter, coredatabase.ErrNotPermitted, coredatabase.ErrDuplicateElection, coredatabase.ErrDuplicatePosition, coredatabase.ErrStaleNonce,
+		coredatabase.ErrUnknownElection, coredatabase.ErrAlreadyRegistered, coredatabase.ErrNoChange,
+		coredatabase.ErrElectionClosed, coredatabase.ErrNotEligible, coredatabase.ErrAlreadyVoted:
+		//These depend on the ledger, which the peer may see differently
+		//until we have caught up with the same blocks
+		return corenetwork.Rejected(err)
+	}
+	return err
+}
@@ -0,0 +1,132 @@
+package coresim
+
+import (
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+// simAddr is the net.Addr of a simulated node
+type simAddr string
+
+func (a simAddr) Network() string { return "sim" }
+func (a simAddr) String() string  { return string(a) }
+
+type packet struct {
+	data      []byte
+	deliverAt time.Time
+}
+
+// conn is one end of an in-memory connection. Every Write is a whole frame,
+// which lets the network drop or delay frames without corrupting the stream.
+// Bytes are carried by a net.Pipe so reads and deadlines behave like a socket.
+type conn struct {
+	net.Conn
+	network *Network
+	local   simAddr
+	remote  simAddr
+
+	//Each direction of each link has its own random source so the faults
+	//it sees do not depend on how goroutines on other links were scheduled
+	rngMu sync.Mutex
+	rng   *rand.Rand
+
+	outbox    chan packet
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+func newConn(network *Network, pipe net.Conn, local, remote string, seed int64) *conn {
+	c := &conn{
+		Conn:    pipe,
+		network: network,
+		local:   simAddr(local),
+		remote:  simAddr(remote),
+		rng:     rand.New(rand.NewSource(seed)),
+		outbox:  make(chan packet, 1024),
+		done:    make(chan struct{}),
+	}
+	go c.deliver()
+	return c
+}
+
+func (c *conn) LocalAddr() net.Addr  { return c.local }
+func (c *conn) RemoteAddr() net.Addr { return c.remote }
+
+// Write queues the frame for delivery after the network latency, unless the
+// network decides to lose it
+func (c *conn) Write(b []byte) (int, error) {
+	select {
+	case <-c.done:
+		return 0, net.ErrClosed
+	default:
+	}
+
+	c.rngMu.Lock()
+	lost := c.network.lose(c.rng, string(c.local), string(c.remote))
+	delay := c.network.latency(c.rng)
+	c.rngMu.Unlock()
+
+	if lost {
+		return len(b), nil
+	}
+
+	data := make([]byte, len(b))
+	copy(data, b)
+
+	select {
+	case c.outbox <- packet{data: data, deliverAt: time.Now().Add(delay)}:
+		return len(b), nil
+	case <-c.done:
+		return 0, net.ErrClosed
+	}
+}
+
+func (c *conn) deliver() {
+	for {
+		select {
+		case p := <-c.outbox:
+			if wait := time.Until(p.deliverAt); wait > 0 {
+				time.Sleep(wait)
+			}
+			if _, err := c.Conn.Write(p.data); err != nil {
+				return
+			}
+		case <-c.done:
+			return
+		}
+	}
+}
+
+func (c *conn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.done)
+		c.Conn.Close()
+	})
+	return nil
+}
+
+// listener accepts in-memory connections for one node
+type listener struct {
+	address string
+	accept  chan net.Conn
+	done    chan struct{}
+	once    sync.Once
+}
+
+func (l *listener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.accept:
+		return conn, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *listener) Close() error {
+	l.once.Do(func() { close(l.done) })
+	return nil
+}
+
+func (l *listener) Addr() net.Addr { return simAddr(l.address) }
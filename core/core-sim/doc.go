@@ -0,0 +1,20 @@
+// Package coresim runs a whole network of nodes inside one process so the
+// P2P code can be tested with go test instead of starting several binaries
+// against a real MongoDB.
+//
+// Nodes talk over in-memory connections instead of TCP. The network can add
+// latency, drop frames and split nodes into partitions. Each link draws its
+// faults from its own random source seeded from the seed passed to
+// NewNetwork, so a link drops and delays the same frames from run to run.
+// Runs are not exactly repeatable though: goroutine scheduling, timers and
+// the randomness in the network code itself still differ, so tests should
+// wait for an outcome rather than count on the order things happen in:
+//
+//	network := coresim.NewNetwork(1)
+//	nodes, err := network.AddNodes(5, coresim.NewMemoryStorage)
+//	network.ConnectRing()
+//	network.SetDropRate(0.1)
+//
+//	key, err := nodes[0].Publish(corecodec.ReceiveData, payload)
+//	ok := network.WaitFor(func() bool { return network.AllHave(key) }, 5*time.Second)
+package coresim
@@ -0,0 +1,253 @@
+package coresim
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+// ErrUnreachable is returned when dialing a node that is partitioned away or not listening
+var ErrUnreachable = errors.New("coresim: node unreachable")
+
+// Network is a set of simulated nodes and the links between them
+type Network struct {
+	mu        sync.Mutex
+	seed      int64
+	links     map[string]int
+	listeners map[string]*listener
+	nodes     []*Node
+	added     int // nodes ever added, which numbers their addresses
+	delay     time.Duration
+	jitter    time.Duration
+	dropRate  float64
+	partition map[string]int
+}
+
+// NewNetwork returns an empty network whose random faults all derive from seed
+func NewNetwork(seed int64) *Network {
+	return &Network{
+		seed:      seed,
+		links:     make(map[string]int),
+		listeners: make(map[string]*listener),
+	}
+}
+
+// SetLatency delays every frame by delay plus a random amount up to jitter
+func (n *Network) SetLatency(delay, jitter time.Duration) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.delay = delay
+	n.jitter = jitter
+}
+
+// SetDropRate loses each frame with probability rate
+func (n *Network) SetDropRate(rate float64) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.dropRate = rate
+}
+
+// Partition splits the network so nodes can only reach nodes in their own
+// group. Frames sent across groups are lost and dials across them fail.
+// Nodes left out of every group end up together in a group of their own.
+func (n *Network) Partition(groups ...[]*Node) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.partition = make(map[string]int)
+	for i, group := range groups {
+		for _, node := range group {
+			n.partition[node.Address] = i + 1
+		}
+	}
+}
+
+// Heal removes any partition
+func (n *Network) Heal() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.partition = nil
+}
+
+func (n *Network) reachable(from, to string) bool {
+	return n.partition == nil || n.partition[from] == n.partition[to]
+}
+
+func (n *Network) lose(rng *rand.Rand, from, to string) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if !n.reachable(from, to) {
+		return true
+	}
+	return n.dropRate > 0 && rng.Float64() < n.dropRate
+}
+
+func (n *Network) latency(rng *rand.Rand) time.Duration {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	delay := n.delay
+	if n.jitter > 0 {
+		delay += time.Duration(rng.Int63n(int64(n.jitter)))
+	}
+	return delay
+}
+
+// linkSeed gives the nth link between from and to its own seed
+func (n *Network) linkSeed(from, to string) int64 {
+	key := from + ">" + to
+	count := n.links[key]
+	n.links[key] = count + 1
+
+	hash := fnv.New64a()
+	fmt.Fprintf(hash, "%d/%s/%d", n.seed, key, count)
+	return int64(hash.Sum64())
+}
+
+// Transport is the corenetwork.Transport a simulated node uses
+type Transport struct {
+	network *Network
+	address string
+}
+
+// Dial opens an in-memory connection to the node listening on address
+func (t *Transport) Dial(address string) (net.Conn, error) {
+	n := t.network
+
+	n.mu.Lock()
+	l, ok := n.listeners[address]
+	if !ok || !n.reachable(t.address, address) {
+		n.mu.Unlock()
+		return nil, ErrUnreachable
+	}
+	clientSeed := n.linkSeed(t.address, address)
+	serverSeed := n.linkSeed(address, t.address)
+	n.mu.Unlock()
+
+	clientPipe, serverPipe := net.Pipe()
+	client := newConn(n, clientPipe, t.address, address, clientSeed)
+	server := newConn(n, serverPipe, address, t.address, serverSeed)
+
+	select {
+	case l.accept <- server:
+		return client, nil
+	case <-l.done:
+	case <-time.After(time.Second):
+	}
+	client.Close()
+	server.Close()
+	return nil, ErrUnreachable
+}
+
+// Listen registers the node as reachable at address
+func (t *Transport) Listen(address string) (net.Listener, error) {
+	n := t.network
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if _, ok := n.listeners[address]; ok {
+		return nil, fmt.Errorf("coresim: %s already in use", address)
+	}
+	l := &listener{address: address, accept: make(chan net.Conn), done: make(chan struct{})}
+	n.listeners[address] = l
+	return l, nil
+}
+
+func (n *Network) unlisten(address string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	delete(n.listeners, address)
+}
+
+// Nodes returns every node added to the network
+func (n *Network) Nodes() []*Node {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	return append([]*Node(nil), n.nodes...)
+}
+
+// Connect dials b from a
+func (n *Network) Connect(a, b *Node) error {
+	return a.Manager.Connect(b.Address)
+}
+
+// ConnectRing connects every node to the next one, closing the circle
+func (n *Network) ConnectRing() error {
+	nodes := n.Nodes()
+	for i, node := range nodes {
+		if len(nodes) < 2 {
+			break
+		}
+		if err := n.Connect(node, nodes[(i+1)%len(nodes)]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ConnectLine connects every node to the next one without closing the circle,
+// the worst case for gossip
+func (n *Network) ConnectLine() error {
+	nodes := n.Nodes()
+	for i := 0; i+1 < len(nodes); i++ {
+		if err := n.Connect(nodes[i], nodes[i+1]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ConnectAll connects every pair of nodes
+func (n *Network) ConnectAll() error {
+	nodes := n.Nodes()
+	for i := range nodes {
+		for j := i + 1; j < len(nodes); j++ {
+			if err := n.Connect(nodes[i], nodes[j]); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// WaitFor polls condition until it holds or timeout passes and reports which happened
+func (n *Network) WaitFor(condition func() bool, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for {
+		if condition() {
+			return true
+		}
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// AllHave reports whether every node has stored key
+func (n *Network) AllHave(key string) bool {
+	for _, node := range n.Nodes() {
+		if _, ok := node.Storage.Get(key); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// Stop shuts every node down
+func (n *Network) Stop() {
+	for _, node := range n.Nodes() {
+		node.Stop()
+	}
+}
@@ -0,0 +1,281 @@
+package coresim
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/json"
+	"fmt"
+	"net"
+	"time"
+
+	corecodec "github.com/jneubaum/honestvote.io/core/core-codec"
+	coreconsensus "github.com/jneubaum/honestvote.io/core/core-consensus"
+	corecrypto "github.com/jneubaum/honestvote.io/core/core-crypto"
+	coredatabase "github.com/jneubaum/honestvote.io/core/core-database/src"
+	corehttp "github.com/jneubaum/honestvote.io/core/core-http"
+	coremempool "github.com/jneubaum/honestvote.io/core/core-mempool"
+	corenetwork "github.com/jneubaum/honestvote.io/core/core-network"
+)
+
+// Node is a simulated node. It runs the same peer manager, gossip and peer
+// exchange code as a real node, just over the simulated network.
+type Node struct {
+	Address  string
+	Storage  Storage
+	Manager  *corenetwork.PeerManager
+	Gossip   *corenetwork.Gossip
+	Exchange *corenetwork.PeerExchange
+	Syncer   *corenetwork.Syncer
+	Book     *corenetwork.AddressBook
+
+	// These are set by StartConsensus
+	Chain     *coredatabase.Chain
+	State     *coredatabase.State
+	Mempool   *coremempool.Mempool
+	Consensus coreconsensus.Engine
+
+	// Handle, if set, is called for message types the node does not handle
+	// itself, so tests can plug in the protocol they are exercising
+	Handle corenetwork.Handler
+
+	network  *Network
+	listener net.Listener
+	ctx      context.Context
+	cancel   context.CancelFunc
+}
+
+// AddNode starts a new node that keeps what it receives in storage
+func (n *Network) AddNode(storage Storage) (*Node, error) {
+	//The address is taken under the lock, so nodes added at the same time
+	//never share one
+	n.mu.Lock()
+	address := fmt.Sprintf("node%d:7000", n.added)
+	n.added++
+	n.mu.Unlock()
+
+	key, err := corecrypto.GenerateKey()
+	if err != nil {
+		return nil, err
+	}
+
+	node := &Node{Address: address, Storage: storage, Book: corenetwork.NewAddressBook(), network: n}
+	node.ctx, node.cancel = context.WithCancel(context.Background())
+	identity := &corenetwork.Identity{Key: key, Address: address, Role: corenetwork.RoleFull, Height: node.height}
+	node.Manager = corenetwork.NewPeerManager(identity, 0, node.handle)
+	node.Manager.Transport = &Transport{network: n, address: address}
+	node.Manager.Book = node.Book
+	node.Gossip = corenetwork.NewGossip(node.Manager, corenetwork.DefaultMaxHops, node.handle)
+	node.Exchange = corenetwork.NewPeerExchange(node.Manager, node.Book, 0)
+	node.Manager.OnConnect = node.Exchange.Connected
+	node.Syncer = corenetwork.NewSyncer(node.Manager, storageSync{storage}, storageSync{storage})
+
+	node.listener, err = node.Manager.Transport.Listen(address)
+	if err != nil {
+		node.cancel()
+		return nil, err
+	}
+	go func() {
+		for {
+			conn, err := node.listener.Accept()
+			if err != nil {
+				return
+			}
+			go node.Manager.Accept(conn)
+		}
+	}()
+
+	n.mu.Lock()
+	n.nodes = append(n.nodes, node)
+	n.mu.Unlock()
+
+	return node, nil
+}
+
+// AddNodes starts count nodes, each with storage from newStorage
+func (n *Network) AddNodes(count int, newStorage func() Storage) ([]*Node, error) {
+	nodes := make([]*Node, count)
+	for i := range nodes {
+		node, err := n.AddNode(newStorage())
+		if err != nil {
+			return nil, err
+		}
+		nodes[i] = node
+	}
+	return nodes, nil
+}
+
+// ConsensusConfig is the chain a simulated node follows
+type ConsensusConfig struct {
+	Mode       coreconsensus.Mode
+	Validators coreconsensus.Validators
+	Interval   time.Duration
+	Admins     []corehttp.Voter
+}
+
+// StartConsensus gives the node an in-memory chain, state and mempool and
+// runs the consensus engine config names on them until the node stops. Key
+// is the node's validator key, or nil for a node that only follows. It has
+// to be called before the node connects to any other.
+func (node *Node) StartConsensus(config ConsensusConfig, key ed25519.PrivateKey) error {
+	chain, err := coredatabase.NewChain(coredatabase.NewMemoryStore())
+	if err != nil {
+		return err
+	}
+	state := coredatabase.NewState(config.Admins)
+	mempool := coremempool.NewMempool(state.Check, 0, 0)
+
+	var engine coreconsensus.Engine
+	switch config.Mode {
+	case coreconsensus.ModeBFT:
+		bft := coreconsensus.NewBFT(config.Validators, config.Interval, chain, state, mempool)
+		bft.Key = key
+		bft.Broadcast = node.broadcastConsensus
+		bft.Publish = node.publishBlock
+		engine = bft
+	default:
+		poa := coreconsensus.NewPoA(config.Validators, config.Interval, chain, state, mempool)
+		poa.Key = key
+		poa.Publish = node.publishBlock
+		engine = poa
+	}
+
+	node.Chain, node.State, node.Mempool, node.Consensus = chain, state, mempool, engine
+
+	go engine.Run(node.ctx)
+	return nil
+}
+
+// height is the node's chain height for the handshake
+func (node *Node) height() uint64 {
+	if node.Chain == nil {
+		return 0
+	}
+	return node.Chain.Height()
+}
+
+// Submit adds a transaction to the node's mempool and gossips it
+func (node *Node) Submit(tx coredatabase.Transaction) error {
+	if err := node.Mempool.Add(tx); err != nil {
+		return err
+	}
+	payload, err := json.Marshal(tx)
+	if err != nil {
+		return err
+	}
+	return node.Gossip.Publish(corecodec.Transaction, payload)
+}
+
+func (node *Node) publishBlock(block *coredatabase.Block) error {
+	payload, err := json.Marshal(block)
+	if err != nil {
+		return err
+	}
+	return node.Gossip.Publish(corecodec.Block, payload)
+}
+
+func (node *Node) broadcastConsensus(message *coreconsensus.Message) error {
+	payload, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+	return node.Gossip.Publish(corecodec.Consensus, payload)
+}
+
+// receiveChain hands transactions, blocks and consensus messages to the
+// node's mempool and engine. Anything refused is not relayed, but only
+// badly formed messages cost the sender score, which is enough for tests.
+func (node *Node) receiveChain(frame corecodec.Frame) error {
+	var err error
+	switch frame.Type {
+	case corecodec.Transaction:
+		var tx coredatabase.Transaction
+		if err := frame.Unmarshal(&tx); err != nil {
+			return err
+		}
+		err = node.Mempool.Add(tx)
+		if err == coremempool.ErrDuplicate {
+			return nil
+		}
+	case corecodec.Block:
+		var block coredatabase.Block
+		if err := frame.Unmarshal(&block); err != nil {
+			return err
+		}
+		err = node.Consensus.Accept(&block)
+		if err == coreconsensus.ErrSideBlock {
+			return nil
+		}
+		if err == coreconsensus.ErrKnownBlock {
+			return corenetwork.Ignored(err)
+		}
+	case corecodec.Consensus:
+		bft, ok := node.Consensus.(*coreconsensus.BFT)
+		if !ok {
+			return corenetwork.ErrUnknownMessage
+		}
+		var message coreconsensus.Message
+		if err := frame.Unmarshal(&message); err != nil {
+			return err
+		}
+		err = bft.Receive(&message)
+	}
+	if err != nil {
+		return corenetwork.Rejected(err)
+	}
+	return nil
+}
+
+func (node *Node) handle(peer *corenetwork.Peer, frame corecodec.Frame) error {
+	switch frame.Type {
+	case corecodec.Gossip:
+		return node.Gossip.Receive(peer, frame)
+	case corecodec.GetPeers, corecodec.Peers:
+		return node.Exchange.Receive(peer, frame)
+	case corecodec.SyncRequest, corecodec.SyncBatch:
+		return node.Syncer.Receive(peer, frame)
+	case corecodec.ReceiveData:
+		return node.Storage.Put(corenetwork.MessageID(frame.Type, frame.Payload), frame.Payload)
+	case corecodec.Transaction, corecodec.Block, corecodec.Consensus:
+		if node.Consensus != nil {
+			return node.receiveChain(frame)
+		}
+	}
+	if node.Handle != nil {
+		return node.Handle(peer, frame)
+	}
+	return corenetwork.ErrUnknownMessage
+}
+
+// Publish gossips a message from this node to the rest of the network and
+// returns the key it will be stored under
+func (node *Node) Publish(t corecodec.MessageType, payload []byte) (string, error) {
+	key := corenetwork.MessageID(t, payload)
+	if t == corecodec.ReceiveData {
+		if err := node.Storage.Put(key, payload); err != nil {
+			return "", err
+		}
+	}
+	return key, node.Gossip.Publish(t, payload)
+}
+
+// SyncFrom pulls everything other has stored into this node's storage. The
+// two nodes have to be connected.
+func (node *Node) SyncFrom(other *Node) error {
+	for _, peer := range node.Manager.Peers() {
+		if peer.Address == other.Address {
+			return node.Syncer.Sync(context.Background(), peer, "storage")
+		}
+	}
+	return ErrUnreachable
+}
+
+// Stop closes the node's listener, stops its consensus engine and drops all
+// of its peers
+func (node *Node) Stop() {
+	node.cancel()
+	node.listener.Close()
+	node.network.unlisten(node.Address)
+	for _, peer := range node.Manager.Peers() {
+		peer.Close()
+	}
+}
@@ -0,0 +1,302 @@
+package coresim
+
+import (
+	"crypto/ed25519"
+	"fmt"
+	"testing"
+	"time"
+
+	corecodec "github.com/jneubaum/honestvote.io/core/core-codec"
+	coreconsensus "github.com/jneubaum/honestvote.io/core/core-consensus"
+	coredatabase "github.com/jneubaum/honestvote.io/core/core-database/src"
+	corehttp "github.com/jneubaum/honestvote.io/core/core-http"
+)
+
+// newNetwork starts count nodes on a network that is stopped when the test ends
+func newNetwork(t *testing.T, seed int64, count int) (*Network, []*Node) {
+	t.Helper()
+
+	network := NewNetwork(seed)
+	t.Cleanup(network.Stop)
+	nodes, err := network.AddNodes(count, NewMemoryStorage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return network, nodes
+}
+
+// connected waits until every node has at least min peers
+func connected(t *testing.T, network *Network, min int) {
+	t.Helper()
+
+	ok := network.WaitFor(func() bool {
+		for _, node := range network.Nodes() {
+			if node.Manager.Len() < min {
+				return false
+			}
+		}
+		return true
+	}, 2*time.Second)
+	if !ok {
+		t.Fatal("nodes did not connect")
+	}
+}
+
+func publish(t *testing.T, node *Node, name string) string {
+	t.Helper()
+
+	key, err := node.Publish(corecodec.ReceiveData, []byte(fmt.Sprintf(`[{"name":%q}]`, name)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func TestAddNodesConcurrently(t *testing.T) {
+	network := NewNetwork(8)
+	t.Cleanup(network.Stop)
+
+	const count = 8
+	errs := make(chan error, count)
+	for i := 0; i < count; i++ {
+		go func() {
+			_, err := network.AddNode(NewMemoryStorage())
+			errs <- err
+		}()
+	}
+	for i := 0; i < count; i++ {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	addresses := make(map[string]bool)
+	for _, node := range network.Nodes() {
+		addresses[node.Address] = true
+	}
+	if len(addresses) != count {
+		t.Fatalf("expected %d nodes with their own addresses, got %d", count, len(addresses))
+	}
+}
+
+func TestGossipRing(t *testing.T) {
+	network, nodes := newNetwork(t, 1, 8)
+	network.SetLatency(time.Millisecond, 2*time.Millisecond)
+	if err := network.ConnectRing(); err != nil {
+		t.Fatal(err)
+	}
+	connected(t, network, 2)
+
+	key := publish(t, nodes[0], "ring")
+	if !network.WaitFor(func() bool { return network.AllHave(key) }, 2*time.Second) {
+		t.Fatal("message did not reach every node in the ring")
+	}
+}
+
+func TestGossipLine(t *testing.T) {
+	network, nodes := newNetwork(t, 2, 6)
+	network.SetLatency(time.Millisecond, 2*time.Millisecond)
+	if err := network.ConnectLine(); err != nil {
+		t.Fatal(err)
+	}
+	connected(t, network, 1)
+
+	//Starting at one end the message has to be relayed by every node
+	key := publish(t, nodes[0], "line")
+	if !network.WaitFor(func() bool { return network.AllHave(key) }, 2*time.Second) {
+		t.Fatal("message did not reach the end of the line")
+	}
+}
+
+func TestPartitionHeal(t *testing.T) {
+	network, nodes := newNetwork(t, 3, 6)
+	if err := network.ConnectAll(); err != nil {
+		t.Fatal(err)
+	}
+	connected(t, network, 5)
+
+	network.Partition(nodes[:3], nodes[3:])
+	key := publish(t, nodes[0], "partitioned")
+	if !network.WaitFor(func() bool {
+		_, ok := nodes[2].Storage.Get(key)
+		return ok
+	}, time.Second) {
+		t.Fatal("message did not reach its own side of the partition")
+	}
+	time.Sleep(100 * time.Millisecond)
+	for _, node := range nodes[3:] {
+		if _, ok := node.Storage.Get(key); ok {
+			t.Fatal("message crossed the partition")
+		}
+	}
+
+	network.Heal()
+	key = publish(t, nodes[4], "healed")
+	if !network.WaitFor(func() bool { return network.AllHave(key) }, 2*time.Second) {
+		t.Fatal("message did not reach every node after healing")
+	}
+}
+
+func TestDropRate(t *testing.T) {
+	network, nodes := newNetwork(t, 4, 6)
+	if err := network.ConnectAll(); err != nil {
+		t.Fatal(err)
+	}
+	connected(t, network, 5)
+
+	//Every node hears each message from several neighbours, so losing some
+	//frames does not stop it getting everywhere
+	network.SetDropRate(0.1)
+	for i := 0; i < 5; i++ {
+		key := publish(t, nodes[i], fmt.Sprint("lossy", i))
+		if !network.WaitFor(func() bool { return network.AllHave(key) }, 2*time.Second) {
+			t.Fatal("message", i, "was lost")
+		}
+	}
+}
+
+func TestSyncFrom(t *testing.T) {
+	network, nodes := newNetwork(t, 5, 2)
+	for i := 0; i < 2500; i++ {
+		nodes[0].Storage.Put(fmt.Sprintf("key%05d", i), []byte(`{"value":1}`))
+	}
+	if err := network.Connect(nodes[1], nodes[0]); err != nil {
+		t.Fatal(err)
+	}
+	connected(t, network, 1)
+
+	if err := nodes[1].SyncFrom(nodes[0]); err != nil {
+		t.Fatal(err)
+	}
+	if nodes[1].Storage.Len() != 2500 {
+		t.Fatal("synced", nodes[1].Storage.Len(), "of 2500 items")
+	}
+}
+
+// validators makes count validator keys
+func validators(count int) (coreconsensus.Validators, []ed25519.PrivateKey) {
+	var public coreconsensus.Validators
+	var keys []ed25519.PrivateKey
+	for i := 0; i < count; i++ {
+		pub, key, _ := ed25519.GenerateKey(nil)
+		public = append(public, pub)
+		keys = append(keys, key)
+	}
+	return public, keys
+}
+
+// sameChain reports whether every node has reached height and agrees on
+// the blocks up to it
+func sameChain(nodes []*Node, height uint64) bool {
+	for _, node := range nodes {
+		if node.Chain.Height() < height {
+			return false
+		}
+	}
+	for h := uint64(1); h <= height; h++ {
+		first, _ := nodes[0].Chain.BlockAt(h)
+		for _, node := range nodes[1:] {
+			block, err := node.Chain.BlockAt(h)
+			if err != nil || first == nil || block.Hash() != first.Hash() {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func TestPoA(t *testing.T) {
+	network, nodes := newNetwork(t, 6, 4)
+	public, keys := validators(3)
+	adminPublic, adminKey, _ := ed25519.GenerateKey(nil)
+	config := ConsensusConfig{
+		Mode:       coreconsensus.ModePoA,
+		Validators: public,
+		Interval:   time.Second,
+		Admins:     []corehttp.Voter{{ID: "admin", PublicKey: adminPublic, Permissions: corehttp.VoterPermissions{CanCreateElection: true}}},
+	}
+	//The last node follows the chain without producing blocks
+	for i, node := range nodes {
+		var key ed25519.PrivateKey
+		if i < len(keys) {
+			key = keys[i]
+		}
+		if err := node.StartConsensus(config, key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := network.ConnectRing(); err != nil {
+		t.Fatal(err)
+	}
+	connected(t, network, 2)
+
+	election := &coredatabase.ElectionTransaction{
+		Creator: "admin",
+		Election: corehttp.Election{
+			ID:          "e1",
+			DisplayName: "Election",
+			TicketEntries: []corehttp.TicketEntry{{
+				ID:                       "president",
+				DisplayName:              "President",
+				AllowedElectionPositions: []corehttp.ElectionPositionID{"p1"},
+				Tickets: []corehttp.Ticket{{
+					ID:                      "t1",
+					ElectionPositionEntries: []corehttp.ElectionPositionEntry{{CandidateID: "c1", ElectionPositionID: "p1"}},
+				}},
+			}},
+		},
+		Positions: []corehttp.ElectionPosition{{ID: "p1", DisplayName: "President"}},
+		Nonce:     1,
+	}
+	election.Sign(adminKey)
+	tx, err := election.Transaction()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := nodes[3].Submit(tx); err != nil {
+		t.Fatal(err)
+	}
+
+	if !network.WaitFor(func() bool { return sameChain(nodes, 1) }, 10*time.Second) {
+		t.Fatal("nodes did not agree on a block")
+	}
+	for i, node := range nodes {
+		if _, ok := node.State.Election("e1"); !ok {
+			t.Fatal("node", i, "did not apply the election")
+		}
+		if node.Mempool.Len() != 0 {
+			t.Fatal("node", i, "kept the included transaction in its mempool")
+		}
+	}
+}
+
+func TestBFT(t *testing.T) {
+	network, nodes := newNetwork(t, 7, 4)
+	//Five validators with one offline still have the four needed for a
+	//quorum, and in a line every vote has to be relayed to get there
+	public, keys := validators(5)
+	config := ConsensusConfig{Mode: coreconsensus.ModeBFT, Validators: public, Interval: 200 * time.Millisecond}
+	for i, node := range nodes {
+		if err := node.StartConsensus(config, keys[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	network.SetLatency(time.Millisecond, 5*time.Millisecond)
+	if err := network.ConnectLine(); err != nil {
+		t.Fatal(err)
+	}
+	connected(t, network, 1)
+
+	if !network.WaitFor(func() bool { return sameChain(nodes, 3) }, 30*time.Second) {
+		for i, node := range nodes {
+			t.Log("node", i, "height", node.Chain.Height())
+		}
+		t.Fatal("validators did not finalize the same blocks")
+	}
+	for h := uint64(1); h <= 3; h++ {
+		block, _ := nodes[0].Chain.BlockAt(h)
+		if err := coreconsensus.VerifyCommit(public, block); err != nil {
+			t.Fatal("block", h, err)
+		}
+	}
+}
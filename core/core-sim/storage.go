@@ -0,0 +1,100 @@
+package coresim
+
+import (
+	"sort"
+	"sync"
+
+	corenetwork "github.com/jneubaum/honestvote.io/core/core-network"
+)
+
+// Storage is where a simulated node keeps the data it receives. Tests can
+// plug in their own implementation, for example one that fails on purpose.
+type Storage interface {
+	Put(key string, value []byte) error
+	Get(key string) ([]byte, bool)
+	Keys() []string
+	Len() int
+}
+
+// MemoryStorage is a Storage backed by a map
+type MemoryStorage struct {
+	mu   sync.RWMutex
+	data map[string][]byte
+}
+
+// NewMemoryStorage returns an empty MemoryStorage
+func NewMemoryStorage() Storage {
+	return &MemoryStorage{data: make(map[string][]byte)}
+}
+
+// Put stores value under key
+func (s *MemoryStorage) Put(key string, value []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.data[key] = value
+	return nil
+}
+
+// Get returns the value stored under key
+func (s *MemoryStorage) Get(key string) ([]byte, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	value, ok := s.data[key]
+	return value, ok
+}
+
+// Keys returns every key in sorted order
+func (s *MemoryStorage) Keys() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	keys := make([]string, 0, len(s.data))
+	for key := range s.data {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Len returns the number of stored values
+func (s *MemoryStorage) Len() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return len(s.data)
+}
+
+// storageSync serves and applies sync batches straight from a Storage, using
+// the storage keys as cursors
+type storageSync struct {
+	storage Storage
+}
+
+func (s storageSync) Batch(collection, cursor string, limit int) ([]corenetwork.SyncItem, bool, error) {
+	keys := s.storage.Keys()
+	start := sort.SearchStrings(keys, cursor)
+	if start < len(keys) && keys[start] == cursor {
+		start++
+	}
+
+	var items []corenetwork.SyncItem
+	for _, key := range keys[start:] {
+		if len(items) == limit {
+			return items, false, nil
+		}
+		value, _ := s.storage.Get(key)
+		items = append(items, corenetwork.SyncItem{Cursor: key, Data: value})
+	}
+	return items, true, nil
+}
+
+func (s storageSync) Apply(collection string, items []corenetwork.SyncItem) error {
+	for _, item := range items {
+		if err := s.storage.Put(item.Cursor, item.Data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
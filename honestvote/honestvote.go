@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+
+	corenetwork "github.com/jneubaum/honestvote.io/core/core-network"
+	corenode "github.com/jneubaum/honestvote.io/core/core-node"
+	"github.com/joho/godotenv"
+)
+
+func main() {
+	role := flag.String("role", "", "what to run: full, peer, registry or observer (default $ROLE, then full)")
+	envFile := flag.String("env", ".env", "file to load the configuration from")
+	flag.Parse()
+
+	//Make sure the .env file loads
+	err := godotenv.Load(*envFile)
+	if err != nil {
+		fmt.Println("Loading ENV Failed")
+	}
+
+	if *role == "" {
+		*role = os.Getenv("ROLE")
+	}
+	if *role == "" {
+		*role = string(corenetwork.RoleFull)
+	}
+
+	config, err := corenode.LoadConfig(corenetwork.Role(*role))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	//SIGINT and SIGTERM cancel the root context, which shuts everything down
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if config.Role == corenode.RoleRegistry {
+		err = corenode.RunRegistry(ctx, config)
+	} else {
+		var node *corenode.Node
+		node, err = corenode.NewNode(ctx, config)
+		if err == nil {
+			err = node.Run()
+		}
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}